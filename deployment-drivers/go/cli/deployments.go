@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// Deployment describes a deployment returned by the deployments API.
+type Deployment struct {
+	ID              string      `json:"id" yaml:"id"`
+	Version         int         `json:"version" yaml:"version"`
+	Status          string      `json:"status" yaml:"status"`
+	PulumiOperation string      `json:"pulumiOperation" yaml:"pulumiOperation"`
+	Initiator       string      `json:"initiator" yaml:"initiator"`
+	RequestedBy     RequestedBy `json:"requestedBy" yaml:"requestedBy"`
+	Created         string      `json:"created" yaml:"created"`
+	Modified        string      `json:"modified" yaml:"modified"`
+	Jobs            []Job       `json:"jobs" yaml:"jobs"`
+}
+
+// RequestedBy describes the user that requested a deployment.
+type RequestedBy struct {
+	Name        string `json:"name" yaml:"name"`
+	GitHubLogin string `json:"githubLogin" yaml:"githubLogin"`
+}
+
+// Job describes one of a deployment's jobs.
+type Job struct {
+	Status      string `json:"status" yaml:"status"`
+	Started     string `json:"started" yaml:"started"`
+	LastUpdated string `json:"lastUpdated" yaml:"lastUpdated"`
+	Steps       []Step `json:"steps" yaml:"steps"`
+}
+
+// Step describes one of a job's steps.
+type Step struct {
+	Name        string `json:"name" yaml:"name"`
+	Status      string `json:"status" yaml:"status"`
+	Started     string `json:"started" yaml:"started"`
+	LastUpdated string `json:"lastUpdated" yaml:"lastUpdated"`
+}
+
+// CreateDeploymentResponse is the body of a response from the create deployment API.
+type CreateDeploymentResponse struct {
+	ID         string `json:"id" yaml:"id"`
+	Version    int    `json:"version" yaml:"version"`
+	ConsoleURL string `json:"consoleUrl" yaml:"consoleUrl"`
+}
+
+// StepLogs is the body of a response from the deployment logs API.
+type StepLogs struct {
+	NextOffset int       `json:"nextOffset" yaml:"nextOffset"`
+	Lines      []LogLine `json:"lines" yaml:"lines"`
+}
+
+// LogLine is a line of a step's logs.
+type LogLine struct {
+	Header    string `json:"header,omitempty" yaml:"header,omitempty"`
+	Timestamp string `json:"timestamp" yaml:"timestamp"`
+	Line      string `json:"line" yaml:"line"`
+}
+
+// timeLayouts are the layouts of the timestamps returned by the API.
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+}
+
+// parseTime parses a timestamp returned by the API. Timestamps without a time zone are in UTC.
+func parseTime(s string) (time.Time, bool) {
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// isFinished returns true if a deployment with the given status has finished.
+func isFinished(status string) bool {
+	switch status {
+	case "failed", "succeeded", "skipped":
+		return true
+	default:
+		return false
+	}
+}
+
+// Initiated returns who or what started the deployment.
+func (d Deployment) Initiated() string {
+	switch {
+	case d.RequestedBy.GitHubLogin != "":
+		return d.RequestedBy.GitHubLogin
+	case d.RequestedBy.Name != "":
+		return d.RequestedBy.Name
+	default:
+		return d.Initiator
+	}
+}
+
+// Finished returns when the deployment finished, if it has.
+func (d Deployment) Finished() (time.Time, bool) {
+	if !isFinished(d.Status) {
+		return time.Time{}, false
+	}
+	if n := len(d.Jobs); n != 0 {
+		if t, ok := parseTime(d.Jobs[n-1].LastUpdated); ok {
+			return t, true
+		}
+	}
+	return parseTime(d.Modified)
+}
+
+// Duration returns how long the deployment ran for, or has been running for if it has not finished.
+func (d Deployment) Duration() (time.Duration, bool) {
+	start, ok := parseTime(d.Created)
+	if len(d.Jobs) != 0 {
+		if t, jobOK := parseTime(d.Jobs[0].Started); jobOK {
+			start, ok = t, true
+		}
+	}
+	if !ok {
+		return 0, false
+	}
+	end, finished := d.Finished()
+	if !finished {
+		if isFinished(d.Status) {
+			return 0, false
+		}
+		end = time.Now()
+	}
+	return end.Sub(start).Round(time.Second), true
+}
+
+// formatTime formats a timestamp returned by the API for display.
+func formatTime(t time.Time, ok bool) string {
+	if !ok {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
+
+// orDash returns s, or "-" if s is empty.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// printDeploymentsTable prints a table of deployments.
+func printDeploymentsTable(w io.Writer, deployments []Deployment) {
+	fmt.Fprintln(w, "ID\tVERSION\tOPERATION\tSTATUS\tINITIATOR\tCREATED\tFINISHED\tDURATION")
+	for _, d := range deployments {
+		duration := "-"
+		if dur, ok := d.Duration(); ok {
+			duration = dur.String()
+		}
+		created, createdOK := parseTime(d.Created)
+		finished, finishedOK := d.Finished()
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\n", d.ID, d.Version, orDash(d.PulumiOperation), d.Status,
+			orDash(d.Initiated()), formatTime(created, createdOK), formatTime(finished, finishedOK), duration)
+	}
+}
+
+// printDeploymentTable prints a deployment followed by a table of its jobs' steps.
+func printDeploymentTable(w io.Writer, d Deployment) {
+	printDeploymentsTable(w, []Deployment{d})
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "JOB\tSTEP\tNAME\tSTATUS\tSTARTED\tLAST UPDATED")
+	for i, job := range d.Jobs {
+		for j, step := range job.Steps {
+			started, startedOK := parseTime(step.Started)
+			updated, updatedOK := parseTime(step.LastUpdated)
+			fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\t%s\n", i, j+1, step.Name, orDash(step.Status),
+				formatTime(started, startedOK), formatTime(updated, updatedOK))
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// envOptions holds the flags that set environment variables for deployments.
+type envOptions struct {
+	plain      *map[string]string
+	secret     *map[string]string
+	secretFile *string
+}
+
+func EnvCommandOptions(cmd *kingpin.CmdClause) *envOptions {
+	return &envOptions{
+		plain:      cmd.Flag("environment", "Environment variable to pass").StringMap(),
+		secret:     cmd.Flag("secret-env", "Secret environment variable to pass, encrypted at rest and masked in logs").PlaceHolder("KEY=VALUE").StringMap(),
+		secretFile: cmd.Flag("secret-env-file", "A file of KEY=VALUE lines to pass as secret environment variables; - reads standard input").String(),
+	}
+}
+
+// environment returns the environment variables set by the flags, or nil if none were set. Secret values are
+// registered for redaction.
+func (o *envOptions) environment() map[string]EnvironmentValue {
+	secrets := map[string]string{}
+	if *o.secretFile != "" {
+		var err error
+		if secrets, err = readEnvFile(*o.secretFile); err != nil {
+			fatalf(exitError, "reading --secret-env-file: %v", err)
+		}
+	}
+	for k, v := range *o.secret {
+		secrets[k] = v
+	}
+
+	if len(*o.plain) == 0 && len(secrets) == 0 {
+		return nil
+	}
+	env := map[string]EnvironmentValue{}
+	for k, v := range *o.plain {
+		if _, ok := secrets[k]; ok {
+			fatalf(exitUsage, "environment variable %s is set as both plain and secret", k)
+		}
+		env[k] = EnvironmentValue{Value: v}
+	}
+	for k, v := range secrets {
+		addSecret(v)
+		env[k] = EnvironmentValue{Value: v, Secret: true}
+	}
+	return env
+}
+
+// readEnvFile reads environment variables from a file of KEY=VALUE lines, or from standard input if path is "-".
+// Blank lines and lines that start with # are ignored, lines may start with "export", and values may be quoted.
+func readEnvFile(path string) (map[string]string, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	env := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("line %d: expected KEY=VALUE", n)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		env[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadEnvFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+		wantErr string
+	}{
+		{"empty", "", map[string]string{}, ""},
+		{
+			"values",
+			"# credentials\n\nAWS_ACCESS_KEY_ID=AKIA\nexport AWS_SECRET_ACCESS_KEY = \"s3cr=t\" \nTOKEN='quoted'\nEMPTY=\n",
+			map[string]string{"AWS_ACCESS_KEY_ID": "AKIA", "AWS_SECRET_ACCESS_KEY": "s3cr=t", "TOKEN": "quoted", "EMPTY": ""},
+			"",
+		},
+		{"mismatched quotes", `A="value'`, map[string]string{"A": `"value'`}, ""},
+		{"no value", "A=1\nB\n", nil, "line 2: expected KEY=VALUE"},
+		{"no key", "=value", nil, "line 1: expected KEY=VALUE"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), ".env")
+		if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readEnvFile(path)
+		switch {
+		case tt.wantErr != "":
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: got error %v, want one containing %q", tt.name, err, tt.wantErr)
+			}
+		case err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case !reflect.DeepEqual(got, tt.want):
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEnvironment(t *testing.T) {
+	file := filepath.Join(t.TempDir(), ".env")
+	if err := os.WriteFile(file, []byte("API_KEY=from-file\nTOKEN=from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		plain      map[string]string
+		secret     map[string]string
+		secretFile string
+		want       map[string]EnvironmentValue
+	}{
+		{"none", map[string]string{}, map[string]string{}, "", nil},
+		{
+			"plain and secret",
+			map[string]string{"REGION": "us-west-2"},
+			map[string]string{"API_KEY": "hunter2"},
+			"",
+			map[string]EnvironmentValue{"REGION": {Value: "us-west-2"}, "API_KEY": {Value: "hunter2", Secret: true}},
+		},
+		{
+			"flags override the file",
+			map[string]string{},
+			map[string]string{"API_KEY": "hunter2"},
+			file,
+			map[string]EnvironmentValue{"API_KEY": {Value: "hunter2", Secret: true}, "TOKEN": {Value: "from-file", Secret: true}},
+		},
+	}
+	for _, tt := range tests {
+		secrets = nil
+		o := &envOptions{plain: &tt.plain, secret: &tt.secret, secretFile: &tt.secretFile}
+		if got := o.environment(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+		for name, v := range tt.want {
+			if v.Secret && !strings.Contains(redact(name+"="+v.Value), redacted) {
+				t.Errorf("%s: secret %s wasn't registered for redaction", tt.name, name)
+			}
+		}
+	}
+	secrets = nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/go-resty/resty/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// exitCode is the status that the CLI exits with. The codes are documented in the README, so scripts may rely on
+// them; don't renumber them.
+type exitCode int
+
+const (
+	// exitError is any error that no other code describes, such as an unreadable file or an unexpected API response.
+	exitError exitCode = 1
+	// exitUsage is an invalid command, flag, or combination of flags.
+	exitUsage exitCode = 2
+	// exitAuth is a missing, invalid, or insufficient API token.
+	exitAuth exitCode = 3
+	// exitNotFound is a missing stack, deployment, settings, or profile.
+	exitNotFound exitCode = 4
+	// exitConflict is a request that conflicts with the current state, such as a deployment already in progress.
+	exitConflict exitCode = 5
+	// exitDeploymentFailed is a deployment that finished without succeeding.
+	exitDeploymentFailed exitCode = 6
+	// exitTimeout is an API request or wait that took too long.
+	exitTimeout exitCode = 7
+	// exitNetwork is a failure to reach the API.
+	exitNetwork exitCode = 8
+	// exitChanged is not an error: it is the status of settings diff --exit-code when the settings would change.
+	exitChanged exitCode = 9
+)
+
+// kind returns the name of the code that is reported in error objects.
+func (c exitCode) kind() string {
+	switch c {
+	case exitUsage:
+		return "usage"
+	case exitAuth:
+		return "auth"
+	case exitNotFound:
+		return "not_found"
+	case exitConflict:
+		return "conflict"
+	case exitDeploymentFailed:
+		return "deployment_failed"
+	case exitTimeout:
+		return "timeout"
+	case exitNetwork:
+		return "network"
+	default:
+		return "error"
+	}
+}
+
+// ErrorOutput is the error object printed in place of a result when --output is json or yaml.
+type ErrorOutput struct {
+	Error ErrorDetails `json:"error" yaml:"error"`
+}
+
+// ErrorDetails describes the error that the CLI exited with.
+type ErrorDetails struct {
+	Kind     string `json:"kind" yaml:"kind"`
+	ExitCode int    `json:"exitCode" yaml:"exitCode"`
+	Message  string `json:"message" yaml:"message"`
+	// The HTTP status of the API response that caused the error, if any.
+	StatusCode int `json:"statusCode,omitempty" yaml:"statusCode,omitempty"`
+}
+
+// fatal reports an error and exits with its code. The error is printed as a message on stderr, or as an error object
+// on stdout when --output is json or yaml. Secrets are redacted from both.
+func fatal(code exitCode, status int, message string) {
+	details := ErrorDetails{Kind: code.kind(), ExitCode: int(code), Message: redact(message), StatusCode: status}
+	printed := false
+	switch *output {
+	case outputJSON:
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		printed = enc.Encode(ErrorOutput{Error: details}) == nil
+	case outputYAML:
+		enc := yaml.NewEncoder(os.Stdout)
+		enc.SetIndent(2)
+		printed = enc.Encode(ErrorOutput{Error: details}) == nil && enc.Close() == nil
+	}
+	if !printed {
+		fmt.Fprintf(os.Stderr, "%s: error: %s\n", app.Name, details.Message)
+	}
+	os.Exit(int(code))
+}
+
+// fatalf reports an error that wasn't caused by an API response and exits with code.
+func fatalf(code exitCode, format string, args ...interface{}) {
+	fatal(code, 0, fmt.Sprintf(format, args...))
+}
+
+// checkResponse exits with the matching code if an API request failed or its response has an error status. action
+// describes the request, e.g. "getting deployment", and notFound describes what is missing if the response is a 404.
+func checkResponse(action string, resp *resty.Response, err error, notFound string) {
+	if err != nil {
+		var netErr net.Error
+		if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+			fatalf(exitTimeout, "%s: timed out: %v", action, err)
+		}
+		fatalf(exitNetwork, "%s: %v", action, err)
+	}
+	if resp.IsSuccess() {
+		return
+	}
+
+	status := resp.StatusCode()
+	var code exitCode
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		code = exitAuth
+	case status == http.StatusNotFound:
+		fatal(exitNotFound, status, notFound)
+	case status == http.StatusConflict || status == http.StatusPreconditionFailed:
+		code = exitConflict
+	case status == http.StatusRequestTimeout || status == http.StatusGatewayTimeout:
+		code = exitTimeout
+	case status == http.StatusBadRequest || status == http.StatusUnprocessableEntity:
+		code = exitUsage
+	default:
+		code = exitError
+	}
+	fatal(code, status, fmt.Sprintf("%s: %s", action, apiErrorMessage(resp)))
+}
+
+// apiErrorMessage returns the message of an API error response, or its status if the body isn't an API error, e.g. an
+// HTML page from a proxy.
+func apiErrorMessage(resp *resty.Response) string {
+	var body struct {
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(resp.Body(), &body); err == nil && body.Message != "" {
+		return fmt.Sprintf("%s (HTTP %d)", body.Message, resp.StatusCode())
+	}
+	return fmt.Sprintf("HTTP %d %s", resp.StatusCode(), http.StatusText(resp.StatusCode()))
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+
+	"github.com/go-resty/resty/v2"
+)
+
+func TestExitCodeKind(t *testing.T) {
+	for code, want := range map[exitCode]string{
+		exitError:            "error",
+		exitUsage:            "usage",
+		exitAuth:             "auth",
+		exitNotFound:         "not_found",
+		exitConflict:         "conflict",
+		exitDeploymentFailed: "deployment_failed",
+		exitTimeout:          "timeout",
+		exitNetwork:          "network",
+	} {
+		if got := code.kind(); got != want {
+			t.Errorf("exit code %d: got kind %q, want %q", code, got, want)
+		}
+	}
+}
+
+// respond returns the response of a request to a server that responds with status and body.
+func respond(t *testing.T, status int, body string) *resty.Response {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+	resp, err := resty.New().R().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestAPIErrorMessage(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+		want   string
+	}{
+		{http.StatusConflict, `{"code": 409, "message": "a deployment is already running"}`, "a deployment is already running (HTTP 409)"},
+		{http.StatusBadGateway, `<html>Bad Gateway</html>`, "HTTP 502 Bad Gateway"},
+		{http.StatusInternalServerError, `{"code": 500}`, "HTTP 500 Internal Server Error"},
+	}
+	for _, tt := range tests {
+		if got := apiErrorMessage(respond(t, tt.status, tt.body)); got != tt.want {
+			t.Errorf("%d %s: got %q, want %q", tt.status, tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestCheckResponse(t *testing.T) {
+	// checkResponse exits, so each failing response is checked in a subprocess that runs this test.
+	if status := os.Getenv("DEPLOYER_TEST_STATUS"); status != "" {
+		code, _ := strconv.Atoi(status)
+		*output = outputJSON
+		addSecret("pul-abc123")
+		checkResponse("getting deployment", respond(t, code, os.Getenv("DEPLOYER_TEST_BODY")), nil, "deployment 'abc' doesn't exist")
+		return
+	}
+
+	tests := []struct {
+		status  int
+		body    string
+		code    exitCode
+		message string
+	}{
+		{http.StatusOK, `{}`, 0, ""},
+		{http.StatusUnauthorized, `{"message": "bad token pul-abc123"}`, exitAuth, "getting deployment: bad token [secret] (HTTP 401)"},
+		{http.StatusForbidden, ``, exitAuth, "getting deployment: HTTP 403 Forbidden"},
+		{http.StatusNotFound, `{"message": "not found"}`, exitNotFound, "deployment 'abc' doesn't exist"},
+		{http.StatusConflict, ``, exitConflict, "getting deployment: HTTP 409 Conflict"},
+		{http.StatusGatewayTimeout, ``, exitTimeout, "getting deployment: HTTP 504 Gateway Timeout"},
+		{http.StatusBadRequest, `{"message": "invalid operation"}`, exitUsage, "getting deployment: invalid operation (HTTP 400)"},
+		{http.StatusInternalServerError, ``, exitError, "getting deployment: HTTP 500 Internal Server Error"},
+	}
+	for _, tt := range tests {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestCheckResponse$")
+		cmd.Env = append(os.Environ(), "DEPLOYER_TEST_STATUS="+strconv.Itoa(tt.status), "DEPLOYER_TEST_BODY="+tt.body)
+		out, err := cmd.Output()
+
+		var exitErr *exec.ExitError
+		switch {
+		case tt.code == 0:
+			if err != nil {
+				t.Errorf("%d: exited with %v", tt.status, err)
+			}
+			continue
+		case !errors.As(err, &exitErr) || exitErr.ExitCode() != int(tt.code):
+			t.Errorf("%d: got %v, want exit status %d", tt.status, err, tt.code)
+			continue
+		}
+
+		var result ErrorOutput
+		if err := json.Unmarshal(out, &result); err != nil {
+			t.Errorf("%d: %v: %s", tt.status, err, out)
+			continue
+		}
+		want := ErrorDetails{Kind: tt.code.kind(), ExitCode: int(tt.code), Message: tt.message, StatusCode: tt.status}
+		if result.Error != want {
+			t.Errorf("%d: got %+v, want %+v", tt.status, result.Error, want)
+		}
+	}
+}
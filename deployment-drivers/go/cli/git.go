@@ -0,0 +1,142 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// defaultBranch is the branch that is deployed if no branch, commit, or tag is given and the stack's saved settings
+// are not inherited.
+const defaultBranch = "refs/heads/main"
+
+// commitPattern matches full SHA-1 and SHA-256 git commit hashes.
+var commitPattern = regexp.MustCompile(`^([0-9a-f]{40}|[0-9a-f]{64})$`)
+
+// SecretValue is a value that the API stores encrypted and never returns in plaintext.
+type SecretValue struct {
+	Secret string `json:"secret"`
+}
+
+// GitAuth holds the credentials used to clone a private repository. Only one kind of credential may be set.
+type GitAuth struct {
+	AccessToken *SecretValue `json:"accessToken,omitempty"`
+	SSHAuth     *SSHAuth     `json:"sshAuth,omitempty"`
+	BasicAuth   *BasicAuth   `json:"basicAuth,omitempty"`
+}
+
+// SSHAuth holds an SSH private key used to clone a repository, and the key's passphrase, if any.
+type SSHAuth struct {
+	PrivateKey *SecretValue `json:"sshPrivateKey"`
+	Password   *SecretValue `json:"password,omitempty"`
+}
+
+// BasicAuth holds a username and password used to clone a repository over HTTPS.
+type BasicAuth struct {
+	UserName *SecretValue `json:"userName"`
+	Password *SecretValue `json:"password"`
+}
+
+// gitOptions holds the flags that choose the git revision to deploy and the credentials to clone it with.
+type gitOptions struct {
+	branch            *string
+	commit            *string
+	tag               *string
+	accessToken       *string
+	sshPrivateKeyFile *string
+	sshPassphrase     *string
+	username          *string
+	password          *string
+}
+
+func GitCommandOptions(cmd *kingpin.CmdClause) *gitOptions {
+	return &gitOptions{
+		branch:            cmd.Flag("branch", "The git branch to deploy (default refs/heads/main unless --inherit-settings is set)").String(),
+		commit:            cmd.Flag("commit", "The full SHA of the git commit to deploy").String(),
+		tag:               cmd.Flag("tag", "The git tag to deploy").String(),
+		accessToken:       cmd.Flag("git-token", "A personal access token to clone the repo with").Envar("PULUMI_DEPLOY_GIT_TOKEN").String(),
+		sshPrivateKeyFile: cmd.Flag("ssh-private-key-file", "A file that contains an SSH private key to clone the repo with").ExistingFile(),
+		sshPassphrase:     cmd.Flag("ssh-passphrase", "The passphrase of the SSH private key").Envar("PULUMI_DEPLOY_SSH_PASSPHRASE").String(),
+		username:          cmd.Flag("git-username", "The username to clone the repo with over HTTPS").String(),
+		password:          cmd.Flag("git-password", "The password to clone the repo with over HTTPS").Envar("PULUMI_DEPLOY_GIT_PASSWORD").String(),
+	}
+}
+
+// revision sets the revision of git to deploy. At most one of --branch, --commit, and --tag may be set. If none is
+// set, the default branch is deployed unless the stack's saved settings are inherited.
+func (o *gitOptions) revision(git *GitInfo, inheritSettings bool) {
+	set := 0
+	for _, v := range []string{*o.branch, *o.commit, *o.tag} {
+		if v != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		fatalf(exitUsage, "only one of --branch, --commit, and --tag may be set")
+	}
+
+	switch {
+	case *o.commit != "":
+		commit := strings.ToLower(*o.commit)
+		if !commitPattern.MatchString(commit) {
+			fatalf(exitUsage, "--commit must be a full 40- or 64-character commit SHA, got '%s'", *o.commit)
+		}
+		git.Commit = commit
+	case *o.tag != "":
+		git.Branch = "refs/tags/" + strings.TrimPrefix(*o.tag, "refs/tags/")
+	case *o.branch != "":
+		git.Branch = *o.branch
+	case !inheritSettings:
+		git.Branch = defaultBranch
+	}
+}
+
+// auth returns the credentials to clone the repo with, if any were given.
+func (o *gitOptions) auth() *GitAuth {
+	hasToken := *o.accessToken != ""
+	hasSSH := *o.sshPrivateKeyFile != ""
+	hasBasic := *o.username != "" || *o.password != ""
+
+	kinds := 0
+	for _, has := range []bool{hasToken, hasSSH, hasBasic} {
+		if has {
+			kinds++
+		}
+	}
+	switch {
+	case kinds > 1:
+		fatalf(exitUsage, "only one of --git-token, --ssh-private-key-file, and --git-username/--git-password may be set")
+	case *o.sshPassphrase != "" && !hasSSH:
+		fatalf(exitUsage, "--ssh-passphrase requires --ssh-private-key-file")
+	case hasBasic && (*o.username == "" || *o.password == ""):
+		fatalf(exitUsage, "--git-username and --git-password must be set together")
+	}
+
+	for _, secret := range []string{*o.accessToken, *o.sshPassphrase, *o.password} {
+		addSecret(secret)
+	}
+	switch {
+	case hasToken:
+		return &GitAuth{AccessToken: &SecretValue{Secret: *o.accessToken}}
+	case hasSSH:
+		key, err := os.ReadFile(*o.sshPrivateKeyFile)
+		if err != nil {
+			fatalf(exitError, "reading SSH private key: %v", err)
+		}
+		addSecret(string(key))
+		auth := &SSHAuth{PrivateKey: &SecretValue{Secret: string(key)}}
+		if *o.sshPassphrase != "" {
+			auth.Password = &SecretValue{Secret: *o.sshPassphrase}
+		}
+		return &GitAuth{SSHAuth: auth}
+	case hasBasic:
+		return &GitAuth{BasicAuth: &BasicAuth{
+			UserName: &SecretValue{Secret: *o.username},
+			Password: &SecretValue{Secret: *o.password},
+		}}
+	default:
+		return nil
+	}
+}
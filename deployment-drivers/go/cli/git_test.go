@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// newGitOptions returns git options with the given flag values. Unset flags are empty.
+func newGitOptions(flags map[string]string) *gitOptions {
+	value := func(name string) *string {
+		v := flags[name]
+		return &v
+	}
+	return &gitOptions{
+		branch:            value("branch"),
+		commit:            value("commit"),
+		tag:               value("tag"),
+		accessToken:       value("git-token"),
+		sshPrivateKeyFile: value("ssh-private-key-file"),
+		sshPassphrase:     value("ssh-passphrase"),
+		username:          value("git-username"),
+		password:          value("git-password"),
+	}
+}
+
+func TestRevision(t *testing.T) {
+	sha := "0123456789ABCDEF0123456789abcdef01234567"
+	tests := []struct {
+		name    string
+		flags   map[string]string
+		inherit bool
+		want    GitInfo
+	}{
+		{"default branch", nil, false, GitInfo{Branch: defaultBranch}},
+		{"inherited", nil, true, GitInfo{}},
+		{"branch", map[string]string{"branch": "refs/heads/dev"}, false, GitInfo{Branch: "refs/heads/dev"}},
+		{"tag", map[string]string{"tag": "v1.2.0"}, true, GitInfo{Branch: "refs/tags/v1.2.0"}},
+		{"qualified tag", map[string]string{"tag": "refs/tags/v1.2.0"}, false, GitInfo{Branch: "refs/tags/v1.2.0"}},
+		{"commit", map[string]string{"commit": sha}, false, GitInfo{Commit: "0123456789abcdef0123456789abcdef01234567"}},
+	}
+	for _, tt := range tests {
+		var got GitInfo
+		newGitOptions(tt.flags).revision(&got, tt.inherit)
+		if got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAuth(t *testing.T) {
+	key := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(key, []byte("private key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		flags   map[string]string
+		want    *GitAuth
+		secrets []string
+	}{
+		{"none", nil, nil, nil},
+		{
+			"access token",
+			map[string]string{"git-token": "ghp_token"},
+			&GitAuth{AccessToken: &SecretValue{"ghp_token"}},
+			[]string{"ghp_token"},
+		},
+		{
+			"SSH key",
+			map[string]string{"ssh-private-key-file": key, "ssh-passphrase": "phrase"},
+			&GitAuth{SSHAuth: &SSHAuth{PrivateKey: &SecretValue{"private key"}, Password: &SecretValue{"phrase"}}},
+			[]string{"phrase", "private key"},
+		},
+		{
+			"basic auth",
+			map[string]string{"git-username": "octocat", "git-password": "hunter2"},
+			&GitAuth{BasicAuth: &BasicAuth{UserName: &SecretValue{"octocat"}, Password: &SecretValue{"hunter2"}}},
+			[]string{"hunter2"},
+		},
+	}
+	for _, tt := range tests {
+		secrets = nil
+		got := newGitOptions(tt.flags).auth()
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+		if !reflect.DeepEqual(secrets, tt.secrets) {
+			t.Errorf("%s: registered secrets %q, want %q", tt.name, secrets, tt.secrets)
+		}
+	}
+	secrets = nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+const (
+	// listPageSize is the number of deployments requested per page.
+	listPageSize = 100
+	// listMaxPages is the maximum number of pages requested by the list command.
+	listMaxPages = 100
+)
+
+// ListDeploymentsResponse is the body of a response from the list deployments API.
+type ListDeploymentsResponse struct {
+	Deployments []Deployment `json:"deployments"`
+}
+
+// UnmarshalJSON accepts either a list of deployments or an object with a "deployments" property, as the API has
+// returned both.
+func (r *ListDeploymentsResponse) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '[' {
+		return json.Unmarshal(b, &r.Deployments)
+	}
+	type listDeploymentsResponse ListDeploymentsResponse
+	return json.Unmarshal(b, (*listDeploymentsResponse)(r))
+}
+
+// parseSince parses the value of the --since flag, which is either a duration before now (e.g. 24h) or a date or
+// time (e.g. 2023-03-01 or 2023-03-01T15:04:05Z).
+func parseSince(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid --since %q: must be a duration (e.g. 24h), a date (e.g. 2023-03-01), or an RFC 3339 time", s)
+}
+
+// listFilter selects the deployments printed by the list command.
+type listFilter struct {
+	statuses   []string
+	operations []string
+	since      time.Time
+}
+
+// matches returns true if d is selected by the filter. Deployments whose creation time can't be parsed are not
+// excluded by since.
+func (f listFilter) matches(d Deployment) bool {
+	if !f.since.IsZero() {
+		if created, ok := parseTime(d.Created); ok && created.Before(f.since) {
+			return false
+		}
+	}
+	return matchesAny(d.Status, f.statuses) && matchesAny(d.PulumiOperation, f.operations)
+}
+
+// matchesAny returns true if values is empty or contains v.
+func matchesAny(v string, values []string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, value := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// listDeployments pages through the stack's deployments and returns those selected by filter, newest first, up to
+// limit. A limit of 0 returns all of them.
+//
+// The order in which the API lists deployments isn't relied upon, so the selected deployments are sorted by version.
+// Paging stops at an empty page, at a page shorter than the first, which may be shorter than requested if the API caps
+// the page size, or at a page of deployments that were already listed, in case the API ignores the page parameter. It
+// also stops after listMaxPages pages. If every deployment so far was listed newest first, paging stops as soon as
+// limit deployments are selected, as the remaining pages only hold older deployments.
+func listDeployments(client *resty.Client, filter listFilter, limit int) []Deployment {
+	deployments := []Deployment{}
+	seen := map[string]bool{}
+	newestFirst, lastVersion := true, 0
+	pageSize := listPageSize
+	for page := 1; ; page++ {
+		if page > listMaxPages {
+			log.Printf("warning: only the first %d pages of deployments were listed", listMaxPages)
+			break
+		}
+
+		var body ListDeploymentsResponse
+		resp, err := client.R().
+			SetQueryParam("page", strconv.Itoa(page)).
+			SetQueryParam("pageSize", strconv.Itoa(listPageSize)).
+			SetHeader("Authorization", fmt.Sprintf("token %s", *token)).
+			SetHeader("Accept", "application/json").
+			Get(fmt.Sprintf("%s/%s/%s/%s/deployments", previewURL, *org, *project, *stack))
+		checkResponse("listing deployments", resp, err, fmt.Sprintf("stack '%s/%s/%s' doesn't exist", *org, *project, *stack))
+		if err := json.Unmarshal(resp.Body(), &body); err != nil {
+			fatalf(exitError, "decoding deployments: %v", err)
+		}
+
+		repeated := false
+		for _, d := range body.Deployments {
+			if seen[d.ID] {
+				repeated = true
+				continue
+			}
+			if len(seen) != 0 && d.Version > lastVersion {
+				newestFirst = false
+			}
+			seen[d.ID], lastVersion = true, d.Version
+			if filter.matches(d) {
+				deployments = append(deployments, d)
+			}
+		}
+
+		if page == 1 && len(body.Deployments) < pageSize {
+			pageSize = len(body.Deployments)
+		}
+		lastPage := len(body.Deployments) == 0 || len(body.Deployments) < pageSize || repeated
+		if lastPage || newestFirst && limit > 0 && len(deployments) >= limit {
+			break
+		}
+	}
+
+	sort.SliceStable(deployments, func(i, j int) bool {
+		return deployments[i].Version > deployments[j].Version
+	})
+	if limit > 0 && len(deployments) > limit {
+		deployments = deployments[:limit]
+	}
+	return deployments
+}
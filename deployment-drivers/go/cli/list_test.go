@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+func TestParseSince(t *testing.T) {
+	tests := []struct {
+		since   string
+		want    time.Time
+		wantErr bool
+	}{
+		{"2023-03-01", time.Date(2023, 3, 1, 0, 0, 0, 0, time.UTC), false},
+		{"2023-03-01T15:04:05Z", time.Date(2023, 3, 1, 15, 4, 5, 0, time.UTC), false},
+		{"yesterday", time.Time{}, true},
+		{"", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseSince(tt.since)
+		switch {
+		case tt.wantErr:
+			if err == nil {
+				t.Errorf("parseSince(%q): got %v, want an error", tt.since, got)
+			}
+		case err != nil:
+			t.Errorf("parseSince(%q): %v", tt.since, err)
+		case !got.Equal(tt.want):
+			t.Errorf("parseSince(%q) = %v, want %v", tt.since, got, tt.want)
+		}
+	}
+
+	got, err := parseSince("24h")
+	if want := time.Now().Add(-24 * time.Hour); err != nil || got.Sub(want).Abs() > time.Minute {
+		t.Errorf("parseSince(24h) = %v, %v, want about %v", got, err, want)
+	}
+}
+
+func TestListFilterMatches(t *testing.T) {
+	since := time.Date(2023, 3, 1, 0, 0, 0, 0, time.UTC)
+	d := Deployment{Status: "failed", PulumiOperation: "update", Created: "2023-03-02T00:00:00Z"}
+	tests := []struct {
+		name   string
+		filter listFilter
+		d      Deployment
+		want   bool
+	}{
+		{"no filter", listFilter{}, d, true},
+		{"status", listFilter{statuses: []string{"succeeded", "failed"}}, d, true},
+		{"other status", listFilter{statuses: []string{"succeeded"}}, d, false},
+		{"operation", listFilter{operations: []string{"UPDATE"}}, d, true},
+		{"other operation", listFilter{operations: []string{"destroy"}}, d, false},
+		{"created since", listFilter{since: since}, d, true},
+		{"created before", listFilter{since: since.AddDate(0, 0, 2)}, d, false},
+		{"unknown creation time", listFilter{since: since}, Deployment{Created: "soon"}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.filter.matches(tt.d); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// listServer serves a stack's deployments, listing the versions returned by page for each page. It returns the number
+// of pages requested so far.
+func listServer(t *testing.T, page func(n int) []int) func() int {
+	var m sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		requests++
+		m.Unlock()
+		n, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		var deployments []string
+		for _, v := range page(n) {
+			deployments = append(deployments, fmt.Sprintf(`{"id": "d-%v", "version": %v, "created": "2023-03-%02dT00:00:00Z"}`, v, v, v))
+		}
+		fmt.Fprintf(w, `{"deployments": [%s]}`, strings.Join(deployments, ", "))
+	}))
+	t.Cleanup(server.Close)
+	setBackendURL(server.URL)
+	return func() int {
+		m.Lock()
+		defer m.Unlock()
+		return requests
+	}
+}
+
+// pages returns a page function that serves the given pages, followed by empty pages.
+func pages(versions ...[]int) func(n int) []int {
+	return func(n int) []int {
+		if n < 1 || n > len(versions) {
+			return nil
+		}
+		return versions[n-1]
+	}
+}
+
+func TestListDeployments(t *testing.T) {
+	since := time.Date(2023, 3, 4, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		page     func(n int) []int
+		filter   listFilter
+		limit    int
+		want     []int
+		requests int
+	}{
+		{"unordered", pages([]int{3, 1, 5}, []int{2, 6, 4}, []int{7}), listFilter{}, 0, []int{7, 6, 5, 4, 3, 2, 1}, 3},
+		{"limited", pages([]int{3, 1, 5}, []int{2, 6, 4}, []int{7}), listFilter{}, 2, []int{7, 6}, 3},
+		{"since", pages([]int{3, 1, 5}, []int{2, 6, 4}), listFilter{since: since}, 0, []int{6, 5, 4}, 3},
+		{"oldest first and limited", pages([]int{1, 2, 3}, []int{4, 5, 6}, []int{7}), listFilter{}, 2, []int{7, 6}, 3},
+		{"newest first and limited", pages([]int{9, 8, 7}, []int{6, 5, 4}, []int{3, 2, 1}), listFilter{}, 2, []int{9, 8}, 1},
+		{"newest first, limited, and filtered", pages([]int{9, 8, 7}, []int{6, 5, 4}, []int{3, 2, 1}), listFilter{since: since}, 5, []int{9, 8, 7, 6, 5}, 2},
+		{"short first page", pages([]int{2, 1}), listFilter{}, 0, []int{2, 1}, 2},
+		{"page ignored", func(int) []int { return []int{3, 2, 1} }, listFilter{}, 0, []int{3, 2, 1}, 2},
+		{"endless", func(n int) []int { return []int{n} }, listFilter{}, 0, nil, listMaxPages},
+	}
+	captureLog(t)
+
+	for _, tt := range tests {
+		requests := listServer(t, tt.page)
+		var got []int
+		for _, d := range listDeployments(resty.New(), tt.filter, tt.limit) {
+			got = append(got, d.Version)
+		}
+		if tt.want != nil && fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: got versions %v, want %v", tt.name, got, tt.want)
+		}
+		if n := requests(); n != tt.requests {
+			t.Errorf("%s: requested %v pages, want %v", tt.name, n, tt.requests)
+		}
+	}
+}
+
+// captureLog discards the log output of a test.
+func captureLog(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+}
@@ -1,39 +1,52 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/go-resty/resty/v2"
 	"gopkg.in/alecthomas/kingpin.v2"
+	"io"
 	"log"
+	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
-const (
-	baseURL = "https://api.pulumi.com/api"
+var (
+	previewURL string
+	stackURL   string
 )
 
-var (
+// setBackendURL sets the URL of the Pulumi Service backend to use, e.g. https://api.pulumi.com.
+func setBackendURL(backend string) {
+	baseURL := strings.TrimSuffix(backend, "/") + "/api"
 	previewURL = fmt.Sprintf("%s/preview", baseURL)
-	stackURL   = fmt.Sprintf("%s/stacks", baseURL)
-)
+	stackURL = fmt.Sprintf("%s/stacks", baseURL)
+}
 
 type DeployData struct {
-	SourceContext    SourceContext    `json:"sourceContext"`
-	OperationContext OperationContext `json:"operationContext"`
+	SourceContext    *SourceContext    `json:"sourceContext,omitempty"`
+	OperationContext *OperationContext `json:"operationContext,omitempty"`
+	// True to merge the stack's saved deployment settings with the settings in the request, so that the request only
+	// needs to contain overrides.
+	InheritSettings bool   `json:"inheritSettings"`
+	Operation       string `json:"operation"`
 }
 type GitInfo struct {
-	RepoURL string `json:"repoURL"`
-	Branch  string `json:"branch"`
-	RepoDir string `json:"repoDir"`
+	RepoURL string   `json:"repoURL,omitempty"`
+	Branch  string   `json:"branch,omitempty"`
+	Commit  string   `json:"commit,omitempty"`
+	RepoDir string   `json:"repoDir,omitempty"`
+	GitAuth *GitAuth `json:"gitAuth,omitempty"`
 }
 type SourceContext struct {
 	GitInfo GitInfo `json:"git"`
 }
 type OperationContext struct {
-	Operation   string            `json:"operation"`
-	Environment map[string]string `json:"environmentVariables"`
-	Commands    []string          `json:"preRunCommands"`
+	Environment map[string]EnvironmentValue `json:"environmentVariables,omitempty"`
+	Commands    []string                    `json:"preRunCommands,omitempty"`
 }
 
 type CreateStackData struct {
@@ -54,26 +67,95 @@ func LogCommandOptions(cmd *kingpin.CmdClause) *string {
 	return flag
 }
 
+// DestroyConfirmationOptions defines the --yes flag on each of cmds, which all set the returned value.
+func DestroyConfirmationOptions(cmds ...*kingpin.CmdClause) *bool {
+	yes := new(bool)
+	for _, cmd := range cmds {
+		cmd.Flag("yes", "Confirm that the stack's resources should be destroyed").BoolVar(yes)
+	}
+	return yes
+}
+
+// requestOptions holds the flags of the commands that request deployments.
+type requestOptions struct {
+	repoURL         *string
+	repoDir         *string
+	git             *gitOptions
+	env             *envOptions
+	commands        *[]string
+	inheritSettings *bool
+	wait            *bool
+	waitTimeout     *time.Duration
+}
+
+func RequestCommandOptions(cmd *kingpin.CmdClause) *requestOptions {
+	return &requestOptions{
+		repoURL:         cmd.Flag("repoUrl", "Repo url to use for deploy").Envar("PULUMI_DEPLOY_REPO").String(),
+		repoDir:         cmd.Flag("repoDir", "Directory in Git repo to deploy").String(),
+		git:             GitCommandOptions(cmd),
+		env:             EnvCommandOptions(cmd),
+		commands:        cmd.Flag("prerun-commands", "Commands to run before Pulumi runs").Strings(),
+		inheritSettings: cmd.Flag("inherit-settings", "Use the stack's saved deployment settings, overridden by any other flags").Bool(),
+		wait:            cmd.Flag("wait", "Wait for the deployment to finish, and exit with an error if it doesn't succeed").Bool(),
+		waitTimeout:     cmd.Flag("wait-timeout", "How long --wait waits for the deployment to finish").Default("1h").Duration(),
+	}
+}
+
+// deployData returns the body of a request for a deployment of the given operation.
+func (o *requestOptions) deployData(operation string) DeployData {
+	data := DeployData{InheritSettings: *o.inheritSettings, Operation: operation}
+
+	git := GitInfo{RepoURL: *o.repoURL, RepoDir: *o.repoDir, GitAuth: o.git.auth()}
+	if git.RepoURL == "" && !data.InheritSettings {
+		git.RepoURL = defaultRepoURL
+	}
+	if !data.InheritSettings && (git.RepoURL == "" || git.RepoDir == "") {
+		fatalf(exitUsage, "--repoUrl and --repoDir are required unless --inherit-settings is set")
+	}
+	o.git.revision(&git, data.InheritSettings)
+	if git != (GitInfo{}) {
+		data.SourceContext = &SourceContext{GitInfo: git}
+	}
+	env := o.env.environment()
+	if len(env) != 0 || len(*o.commands) != 0 {
+		data.OperationContext = &OperationContext{Environment: env, Commands: *o.commands}
+	}
+	return data
+}
+
 var (
 	resp *resty.Response
 	err  error
 
+	// defaultRepoURL is the repo to deploy from if --repoUrl is not set, from the selected profile.
+	defaultRepoURL string
+
 	app = kingpin.New("pulumi-deployer", "A helper cli to use pulumi-deploy")
 	// global flags
-	org     = app.Flag("org", "Organization to use").Required().Envar("PULUMI_ORG").String()
-	stack   = app.Flag("stack", "Stack to deploy").Default("dev").String()
-	project = app.Flag("project", "Project to deploy").Required().String()
-	token   = app.Flag("token", "the Pulumi API token to use").Required().Envar("PULUMI_ACCESS_TOKEN").String()
+	org     = app.Flag("org", "Organization to use (default: the selected stack's organization, or your Pulumi user)").Envar("PULUMI_ORG").Action(recordExplicitFlag("org")).String()
+	stack   = app.Flag("stack", "Stack to deploy (default: the selected stack, or dev)").Action(recordExplicitFlag("stack")).String()
+	project = app.Flag("project", "Project to deploy (default: the project in Pulumi.yaml)").Action(recordExplicitFlag("project")).String()
+	token   = app.Flag("token", "the Pulumi API token to use (default: PULUMI_ACCESS_TOKEN, the profile's token, or the Pulumi CLI's token); prefer PULUMI_ACCESS_TOKEN, as flags are visible to other users").String()
 	debug   = app.Flag("debug", "enable debug logging").Default("false").Bool()
+	output  = app.Flag("output", "Output format: table, json, yaml, or template=TEXT, where TEXT is a Go text/template").Short('o').Default(outputTable).String()
+	timeout = app.Flag("timeout", "How long to wait for each API request").Default("1m").Duration()
+	// named profiles are kept in ~/.config/pulumi-deployer/config.yaml
+	profileName = app.Flag("profile", "The profile to use (default: the profile chosen with `profile use`)").Envar("PULUMI_DEPLOYER_PROFILE").String()
 
 	requestCmd = app.Command("request", "Request a deploy")
 	// request specific flags
-	repoUrl     = requestCmd.Flag("repoUrl", "Repo url to use for deploy").Required().Envar("PULUMI_DEPLOY_REPO").String()
-	repoDir     = requestCmd.Flag("repoDir", "Directory in Git repo to deploy").Required().String()
-	operation   = requestCmd.Flag("operation", "Operation to request").Default("update").String()
-	branch      = requestCmd.Flag("branch", "The git branch to deploy").Default("refs/heads/main").String()
-	environment = requestCmd.Flag("environment", "Environment variable to pass").StringMap()
-	commands    = requestCmd.Flag("prerun-commands", "Commands to run before Pulumi runs").Strings()
+	requestOpts = RequestCommandOptions(requestCmd)
+	operation   = requestCmd.Flag("operation", "Operation to request: preview, update, refresh, or destroy").Default("update").Enum("preview", "update", "refresh", "destroy")
+
+	// preview, refresh, and destroy request the corresponding operation
+	previewCmd  = app.Command("preview", "Request a preview")
+	previewOpts = RequestCommandOptions(previewCmd)
+	refreshCmd  = app.Command("refresh", "Request a refresh")
+	refreshOpts = RequestCommandOptions(refreshCmd)
+	destroyCmd  = app.Command("destroy", "Request a destroy of all of the stack's resources")
+	destroyOpts = RequestCommandOptions(destroyCmd)
+	// --yes confirms a destroy, whether it is requested with destroy or with request --operation destroy
+	destroyYes = DestroyConfirmationOptions(requestCmd, destroyCmd)
 
 	// logs specific flags
 	logsCmd = app.Command("logs", "Logs for a deploy")
@@ -83,23 +165,63 @@ var (
 	stepLogsCmd = app.Command("step", "Logs for a deploy")
 	stepLogId   = LogCommandOptions(stepLogsCmd)
 	stepLogStep = stepLogsCmd.Flag("step", "The step number to retrieve logs for").Default("1").Int()
+
+	// list specific flags
+	listCmd        = app.Command("list", "List a stack's deployments, newest first")
+	listStatuses   = listCmd.Flag("status", "Only list deployments with this status (repeatable)").Enums("not-started", "accepted", "running", "failed", "succeeded", "skipped")
+	listOperations = listCmd.Flag("operation", "Only list deployments of this operation (repeatable)").Enums("update", "preview", "refresh", "destroy")
+	listSince      = listCmd.Flag("since", "Only list deployments created since this duration ago (e.g. 24h), date, or RFC 3339 time").String()
+	listLimit      = listCmd.Flag("limit", "The maximum number of deployments to list; 0 lists all of them").Default("20").Int()
+
+	// settings specific flags
+	settingsCmd       = app.Command("settings", "Manage a stack's deployment settings")
+	settingsGetCmd    = settingsCmd.Command("get", "Show the stack's deployment settings")
+	settingsSetCmd    = settingsCmd.Command("set", "Merge settings from a file and flags into the stack's deployment settings")
+	settingsSetFile   = settingsSetCmd.Flag("file", "A YAML or JSON file of deployment settings").Short('f').ExistingFile()
+	settingsSetFlags  = newSettingsFlags(settingsSetCmd)
+	settingsDiffCmd   = settingsCmd.Command("diff", "Show how a settings file would change the stack's deployment settings")
+	settingsDiffFile  = settingsDiffCmd.Flag("file", "A YAML or JSON file of deployment settings").Short('f').Required().ExistingFile()
+	settingsDiffExit  = settingsDiffCmd.Flag("exit-code", "Exit with status 9 if the settings would change").Bool()
+	settingsDeleteCmd = settingsCmd.Command("delete", "Delete the stack's deployment settings")
+
+	// profile specific flags
+	profileCmd        = app.Command("profile", "Manage named profiles of defaults for orgs and backends")
+	profileAddCmd     = profileCmd.Command("add", "Add a profile")
+	profileAddOpts    = ProfileAddCommandOptions(profileAddCmd)
+	profileListCmd    = profileCmd.Command("list", "List the profiles")
+	profileUseCmd     = profileCmd.Command("use", "Use a profile by default")
+	profileUseName    = profileUseCmd.Arg("name", "The name of the profile").Required().String()
+	profileRemoveCmd  = profileCmd.Command("remove", "Remove a profile")
+	profileRemoveName = profileRemoveCmd.Arg("name", "The name of the profile").Required().String()
 )
 
 func main() {
 	kingpin.Version("0.0.1")
 
-	client := resty.New()
+	client := resty.New().SetLogger(newRedactingLogger())
+
+	command, parseErr := app.Parse(os.Args[1:])
+	if parseErr != nil {
+		fatalf(exitUsage, "%v, try --help", parseErr)
+	}
+	client.SetTimeout(*timeout)
+	warnIfTokenFlag(os.Args[1:])
+	// Profiles are managed without credentials, so that a profile can be added before logging in.
+	if !strings.HasPrefix(command, profileCmd.FullCommand()+" ") {
+		resolveDefaults(selectedProfile())
+	}
+	addSecret(*token)
+	format, formatErr := parseOutputFormat(*output)
+	if formatErr != nil {
+		fatalf(exitUsage, "%v", formatErr)
+	}
 
-	switch kingpin.MustParse(app.Parse(os.Args[1:])) {
+	switch command {
 
 	case logsCmd.FullCommand():
 		client.SetDebug(*debug)
-		resp, err = client.R().
-			SetHeader("Accept", "application/json").
-			SetHeader("Authorization", fmt.Sprintf("token %s", *token)).
-			Get(fmt.Sprintf("%s/%s/%s/%s/deployments/%s", previewURL, *org, *project, *stack, *logId))
-
-		fmt.Println(string(resp.Body()))
+		deployment := getDeployment(client, *logId)
+		err = render(format, deployment, func(w io.Writer) { printDeploymentTable(w, deployment) })
 
 	case stepLogsCmd.FullCommand():
 		client.SetDebug(*debug)
@@ -108,43 +230,153 @@ func main() {
 			SetHeader("Authorization", fmt.Sprintf("token %s", *token)).
 			Get(fmt.Sprintf("%s/%s/%s/%s/deployments/%s/logs?step=%s&offset=100", previewURL, *org, *project, *stack, *stepLogId, strconv.Itoa(*stepLogStep)))
 
-		fmt.Println(string(resp.Body()))
+		var logs StepLogs
+		decodeResponse("getting step logs", &logs, fmt.Sprintf("deployment '%s' or its step %d doesn't exist in stack '%s/%s/%s'", *stepLogId, *stepLogStep, *org, *project, *stack))
+		err = render(format, logs, func(w io.Writer) {
+			for _, l := range logs.Lines {
+				fmt.Fprintln(w, l.Header+strings.TrimSuffix(l.Line, "\n"))
+			}
+		})
+
+	case requestCmd.FullCommand(), previewCmd.FullCommand(), refreshCmd.FullCommand(), destroyCmd.FullCommand():
+		var opts *requestOptions
+		var data DeployData
+		switch command {
+		case requestCmd.FullCommand():
+			opts, data = requestOpts, requestOpts.deployData(*operation)
+		case previewCmd.FullCommand():
+			opts, data = previewOpts, previewOpts.deployData("preview")
+		case refreshCmd.FullCommand():
+			opts, data = refreshOpts, refreshOpts.deployData("refresh")
+		case destroyCmd.FullCommand():
+			opts, data = destroyOpts, destroyOpts.deployData("destroy")
+		}
+		if data.Operation == "destroy" && !*destroyYes {
+			fatalf(exitUsage, "destroy deletes all of the resources in stack '%s/%s'; pass --yes to confirm", *project, *stack)
+		}
+
+		created := createDeployment(client, data)
+		if !*opts.wait {
+			err = render(format, created, func(w io.Writer) {
+				fmt.Fprintf(w, "ID\t%s\nVERSION\t%d\nCONSOLE URL\t%s\n", created.ID, created.Version, orDash(created.ConsoleURL))
+			})
+			break
+		}
+		deployment := waitForDeployment(client, created.ID, *opts.waitTimeout)
+		if err = render(format, deployment, func(w io.Writer) { printDeploymentTable(w, deployment) }); err != nil {
+			break
+		}
+		if deployment.Status != "succeeded" {
+			// The deployment has already been printed, so only the exit code reports the failure.
+			log.Printf("deployment %s finished with status %s\n", deployment.ID, deployment.Status)
+			os.Exit(int(exitDeploymentFailed))
+		}
+
+	case listCmd.FullCommand():
+		client.SetDebug(*debug)
+		filter := listFilter{statuses: *listStatuses, operations: *listOperations}
+		if *listSince != "" {
+			if filter.since, err = parseSince(*listSince); err != nil {
+				fatalf(exitUsage, "%v", err)
+			}
+		}
+		deployments := listDeployments(client, filter, *listLimit)
+		err = render(format, deployments, func(w io.Writer) { printDeploymentsTable(w, deployments) })
+
+	case settingsGetCmd.FullCommand():
+		client.SetDebug(*debug)
+		settings := getSettings(client)
+		err = render(format, settings, func(w io.Writer) { printSettingsTable(w, settings) })
+
+	case settingsSetCmd.FullCommand():
+		client.SetDebug(*debug)
+		settings := settingsToSet(*settingsSetFile, settingsSetFlags)
+		setSettings(client, settings)
+		log.Printf("updated deployment settings for stack '%s/%s'\n", *project, *stack)
+		settings = getSettings(client)
+		err = render(format, settings, func(w io.Writer) { printSettingsTable(w, settings) })
+
+	case settingsDiffCmd.FullCommand():
+		client.SetDebug(*debug)
+		diff := diffSettings(getSettings(client), readSettingsFile(*settingsDiffFile))
+		err = render(format, diff, func(w io.Writer) { printSettingsDiffTable(w, diff) })
+		if err == nil && diff.Changed && *settingsDiffExit {
+			os.Exit(int(exitChanged))
+		}
+
+	case settingsDeleteCmd.FullCommand():
+		client.SetDebug(*debug)
+		deleteSettings(client)
+		log.Printf("deleted deployment settings for stack '%s/%s'\n", *project, *stack)
+
+	case profileAddCmd.FullCommand():
+		profileAddOpts.addProfile()
+		log.Printf("added profile '%s'\n", *profileAddOpts.name)
+
+	case profileListCmd.FullCommand():
+		profiles := listProfiles()
+		err = render(format, profiles, func(w io.Writer) { printProfilesTable(w, profiles) })
 
-	case requestCmd.FullCommand():
-		createDeployment(client)
+	case profileUseCmd.FullCommand():
+		useProfile(*profileUseName)
+		log.Printf("using profile '%s'\n", *profileUseName)
+
+	case profileRemoveCmd.FullCommand():
+		removeProfile(*profileRemoveName)
+		log.Printf("removed profile '%s'\n", *profileRemoveName)
 
 	default:
-		fmt.Println("nothing requested :(")
+		fatalf(exitUsage, "nothing requested, try --help")
+	}
+	if err != nil {
+		fatalf(exitError, "writing output: %v", err)
 	}
 }
 
-func createDeployment(client *resty.Client) {
-	client.SetDebug(*debug)
+// decodeResponse checks the last response and decodes its JSON body into v. notFound describes what is missing if
+// the response is a 404.
+func decodeResponse(action string, v interface{}, notFound string) {
+	checkResponse(action, resp, err, notFound)
+	if err := json.Unmarshal(resp.Body(), v); err != nil {
+		fatalf(exitError, "decoding response: %v", err)
+	}
+}
+
+// getDeployment returns one of the stack's deployments.
+func getDeployment(client *resty.Client, id string) Deployment {
 	resp, err = client.R().
-		SetBody(DeployData{
-			SourceContext: SourceContext{
-				GitInfo: GitInfo{
-					RepoURL: *repoUrl,
-					Branch:  *branch,
-					RepoDir: *repoDir,
-				},
-			},
-			OperationContext: OperationContext{
-				Operation:   *operation,
-				Environment: *environment,
-				Commands:    *commands,
-			}}).
-		SetHeader("Authorization", fmt.Sprintf("token %s", *token)).
 		SetHeader("Accept", "application/json").
-		Post(fmt.Sprintf("%s/%s/%s/%s/deployments", previewURL, *org, *project, *stack))
-	if err != nil {
-		log.Fatalf("error creating deployment: %v", err)
+		SetHeader("Authorization", fmt.Sprintf("token %s", *token)).
+		Get(fmt.Sprintf("%s/%s/%s/%s/deployments/%s", previewURL, *org, *project, *stack, id))
+
+	var deployment Deployment
+	decodeResponse("getting deployment", &deployment, fmt.Sprintf("deployment '%s' doesn't exist in stack '%s/%s/%s'", id, *org, *project, *stack))
+	return deployment
+}
+
+// waitInterval is how often waitForDeployment checks whether a deployment has finished.
+const waitInterval = 5 * time.Second
+
+// waitForDeployment polls a deployment until it finishes, and exits if it doesn't finish within timeout.
+func waitForDeployment(client *resty.Client, id string, timeout time.Duration) Deployment {
+	deadline := time.Now().Add(timeout)
+	for {
+		deployment := getDeployment(client, id)
+		if isFinished(deployment.Status) {
+			return deployment
+		}
+		if time.Now().Add(waitInterval).After(deadline) {
+			fatalf(exitTimeout, "deployment %s didn't finish within %v; it is %s", id, timeout, deployment.Status)
+		}
+		time.Sleep(waitInterval)
 	}
+}
 
-	switch resp.StatusCode() {
-	case 401:
-		log.Fatalf("auth error: %s", resp.Body())
-	case 404:
+// createDeployment requests a deployment of the stack, creating the stack if it doesn't exist.
+func createDeployment(client *resty.Client, data DeployData) CreateDeploymentResponse {
+	client.SetDebug(*debug)
+	resp, err = postDeployment(client, data)
+	if err == nil && resp.StatusCode() == http.StatusNotFound {
 		log.Printf("stack '%s/%s' doesn't exist, creating it.\n", *project, *stack)
 		resp, err = client.R().
 			SetBody(CreateStackData{
@@ -153,13 +385,22 @@ func createDeployment(client *resty.Client) {
 			SetHeader("Authorization", fmt.Sprintf("token %s", *token)).
 			SetHeader("Accept", "application/json").
 			Post(fmt.Sprintf("%s/%s/%s", stackURL, *org, *project))
-		if resp.StatusCode() == 200 {
-			log.Printf("created stack '%s/%s', now creating deployment.\n", *project, *stack)
-			createDeployment(client)
-		} else {
-			log.Fatalf("Error: %s", string(resp.Body()))
-		}
-	default:
-		log.Printf("created deployment with id: %s\n", string(resp.Body()))
+		checkResponse("creating stack", resp, err, fmt.Sprintf("organization '%s' doesn't exist", *org))
+		log.Printf("created stack '%s/%s', now creating deployment.\n", *project, *stack)
+		resp, err = postDeployment(client, data)
 	}
+
+	var deployment CreateDeploymentResponse
+	decodeResponse("creating deployment", &deployment, fmt.Sprintf("stack '%s/%s/%s' doesn't exist", *org, *project, *stack))
+	log.Printf("created deployment with id: %s\n", deployment.ID)
+	return deployment
+}
+
+// postDeployment sends a request for a deployment of the stack.
+func postDeployment(client *resty.Client, data DeployData) (*resty.Response, error) {
+	return client.R().
+		SetBody(data).
+		SetHeader("Authorization", fmt.Sprintf("token %s", *token)).
+		SetHeader("Accept", "application/json").
+		Post(fmt.Sprintf("%s/%s/%s/%s/deployments", previewURL, *org, *project, *stack))
 }
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestDestroyConfirmation(t *testing.T) {
+	tests := []struct {
+		args []string
+		want bool
+	}{
+		{[]string{"destroy"}, false},
+		{[]string{"destroy", "--yes"}, true},
+		{[]string{"request", "--operation", "destroy"}, false},
+		{[]string{"request", "--operation", "destroy", "--yes"}, true},
+	}
+	for _, tt := range tests {
+		*destroyYes = false
+		if _, err := app.Parse(tt.args); err != nil {
+			t.Errorf("%q: %v", tt.args, err)
+			continue
+		}
+		if *destroyYes != tt.want {
+			t.Errorf("%q: got confirmed %v, want %v", tt.args, *destroyYes, tt.want)
+		}
+	}
+	*destroyYes = false
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The formats accepted by the --output flag.
+const (
+	outputTable    = "table"
+	outputJSON     = "json"
+	outputYAML     = "yaml"
+	outputTemplate = "template"
+)
+
+// outputFormat is the parsed value of the --output flag.
+type outputFormat struct {
+	// One of outputTable, outputJSON, outputYAML, or outputTemplate.
+	kind string
+	// The template to execute, if kind is outputTemplate.
+	template *template.Template
+}
+
+// parseOutputFormat parses the value of the --output flag, which is "table", "json", "yaml", or "template=TEXT",
+// where TEXT is a Go text/template that is executed with the command's result.
+func parseOutputFormat(s string) (outputFormat, error) {
+	switch s {
+	case outputTable, outputJSON, outputYAML:
+		return outputFormat{kind: s}, nil
+	}
+	if strings.HasPrefix(s, outputTemplate+"=") {
+		tmpl, err := template.New("output").Parse(strings.TrimPrefix(s, outputTemplate+"="))
+		if err != nil {
+			return outputFormat{}, fmt.Errorf("invalid --output template: %w", err)
+		}
+		return outputFormat{kind: outputTemplate, template: tmpl}, nil
+	}
+	return outputFormat{}, fmt.Errorf("invalid --output %q: must be table, json, yaml, or template=TEXT", s)
+}
+
+// render writes a command's result to stdout in the chosen format. printTable writes the human-readable form of the
+// result; its writer aligns tab-separated columns.
+func render(format outputFormat, v interface{}, printTable func(w io.Writer)) error {
+	switch format.kind {
+	case outputJSON:
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case outputYAML:
+		enc := yaml.NewEncoder(os.Stdout)
+		enc.SetIndent(2)
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+		return enc.Close()
+	case outputTemplate:
+		// Buffer the output so that a final newline can be added if the template doesn't end with one.
+		var buf bytes.Buffer
+		if err := format.template.Execute(&buf, v); err != nil {
+			return err
+		}
+		if buf.Len() != 0 && !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+			buf.WriteByte('\n')
+		}
+		_, err := buf.WriteTo(os.Stdout)
+		return err
+	default:
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		printTable(w)
+		return w.Flush()
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// captureStdout returns what f writes to stdout.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	done := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		done <- string(b)
+	}()
+	f()
+	w.Close()
+	return <-done
+}
+
+func TestParseOutputFormat(t *testing.T) {
+	tests := []struct {
+		output  string
+		kind    string
+		wantErr string
+	}{
+		{"table", outputTable, ""},
+		{"json", outputJSON, ""},
+		{"yaml", outputYAML, ""},
+		{"template={{.ID}}", outputTemplate, ""},
+		{"template={{.ID", "", "invalid --output template"},
+		{"xml", "", `invalid --output "xml"`},
+		{"template", "", `invalid --output "template"`},
+	}
+	for _, tt := range tests {
+		got, err := parseOutputFormat(tt.output)
+		switch {
+		case tt.wantErr != "":
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseOutputFormat(%q): got error %v, want one containing %q", tt.output, err, tt.wantErr)
+			}
+		case err != nil:
+			t.Errorf("parseOutputFormat(%q): %v", tt.output, err)
+		case got.kind != tt.kind || (got.kind == outputTemplate) != (got.template != nil):
+			t.Errorf("parseOutputFormat(%q) = %+v, want kind %v", tt.output, got, tt.kind)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	v := Deployment{ID: "d-1", Version: 2, Status: "succeeded"}
+	tests := []struct {
+		output string
+		want   string
+	}{
+		{"table", "ID   STATUS\nd-1  succeeded\n"},
+		{"json", `"id": "d-1",`},
+		{"yaml", "id: d-1\n"},
+		{"template={{.ID}} is {{.Status}}", "d-1 is succeeded\n"},
+		{"template={{.ID}}\n", "d-1\n"},
+		{"template=", ""},
+	}
+	for _, tt := range tests {
+		format, err := parseOutputFormat(tt.output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := captureStdout(t, func() {
+			err = render(format, v, func(w io.Writer) {
+				fmt.Fprintln(w, "ID\tSTATUS")
+				fmt.Fprintf(w, "%s\t%s\n", v.ID, v.Status)
+			})
+		})
+		if err != nil {
+			t.Errorf("%q: %v", tt.output, err)
+		}
+		if tt.want == "" && got != "" || !strings.Contains(got, tt.want) {
+			t.Errorf("%q: got output %q, want %q", tt.output, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+	"gopkg.in/yaml.v3"
+)
+
+// profile holds the defaults for one org or backend. Tokens are never stored in the config file: a profile names an
+// environment variable or a file to read its token from.
+type profile struct {
+	// The URL of the Pulumi Service backend, e.g. https://api.pulumi.com.
+	BackendURL string `json:"backendURL,omitempty" yaml:"backendURL,omitempty"`
+	// The environment variable that holds the API token.
+	TokenEnv string `json:"tokenEnv,omitempty" yaml:"tokenEnv,omitempty"`
+	// The file that holds the API token.
+	TokenFile string `json:"tokenFile,omitempty" yaml:"tokenFile,omitempty"`
+	Org       string `json:"org,omitempty" yaml:"org,omitempty"`
+	Project   string `json:"project,omitempty" yaml:"project,omitempty"`
+	Stack     string `json:"stack,omitempty" yaml:"stack,omitempty"`
+	// The repo to deploy from unless --repoUrl is set or the stack's saved settings are inherited.
+	RepoURL string `json:"repoURL,omitempty" yaml:"repoURL,omitempty"`
+}
+
+// token reads the profile's API token from its environment variable or file. token returns an empty string if the
+// profile has no token source.
+func (p *profile) token() (string, error) {
+	switch {
+	case p.TokenEnv != "":
+		t := os.Getenv(p.TokenEnv)
+		if t == "" {
+			return "", fmt.Errorf("environment variable %s is not set", p.TokenEnv)
+		}
+		return t, nil
+	case p.TokenFile != "":
+		path := p.TokenFile
+		if strings.HasPrefix(path, "~/") {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return "", err
+			}
+			path = filepath.Join(home, strings.TrimPrefix(path, "~/"))
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
+	default:
+		return "", nil
+	}
+}
+
+// profileConfig is the CLI's config file, which holds its named profiles.
+type profileConfig struct {
+	// The profile that is used if neither --profile nor PULUMI_DEPLOYER_PROFILE is set.
+	Current  string              `yaml:"current,omitempty"`
+	Profiles map[string]*profile `yaml:"profiles,omitempty"`
+}
+
+// profileConfigPath returns the path of the config file: $XDG_CONFIG_HOME/pulumi-deployer/config.yaml, or
+// ~/.config/pulumi-deployer/config.yaml.
+func profileConfigPath() (string, error) {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "pulumi-deployer", "config.yaml"), nil
+}
+
+// readProfileConfig reads the config file. If there is no config file, the config is empty.
+func readProfileConfig() (*profileConfig, string) {
+	path, err := profileConfigPath()
+	if err != nil {
+		fatalf(exitError, "finding config file: %v", err)
+	}
+	config := &profileConfig{}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return config, path
+	} else if err != nil {
+		fatalf(exitError, "reading config file: %v", err)
+	}
+	if err := yaml.Unmarshal(b, config); err != nil {
+		fatalf(exitError, "parsing %s: %v", path, err)
+	}
+	return config, path
+}
+
+// writeProfileConfig writes the config file. It is only readable by the current user, as it says where tokens are.
+func writeProfileConfig(config *profileConfig, path string) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(config); err != nil {
+		fatalf(exitError, "encoding config file: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		fatalf(exitError, "writing config file: %v", err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o600); err != nil {
+		fatalf(exitError, "writing config file: %v", err)
+	}
+}
+
+// selectedProfile returns the profile chosen by --profile or PULUMI_DEPLOYER_PROFILE, or else the config file's
+// current profile. selectedProfile returns nil if no profile is chosen.
+func selectedProfile() *profile {
+	config, path := readProfileConfig()
+	name := *profileName
+	if name == "" {
+		name = config.Current
+	}
+	if name == "" {
+		return nil
+	}
+	p, ok := config.Profiles[name]
+	if !ok {
+		fatalf(exitNotFound, "profile '%s' not found in %s", name, path)
+	}
+	return p
+}
+
+// profileAddOptions holds the flags of `profile add`.
+type profileAddOptions struct {
+	name       *string
+	backendURL *string
+	tokenEnv   *string
+	tokenFile  *string
+	repoURL    *string
+	use        *bool
+}
+
+func ProfileAddCommandOptions(cmd *kingpin.CmdClause) *profileAddOptions {
+	return &profileAddOptions{
+		name:       cmd.Arg("name", "The name of the profile").Required().String(),
+		backendURL: cmd.Flag("backend-url", "The URL of the Pulumi Service backend (default: the Pulumi CLI's backend)").String(),
+		tokenEnv:   cmd.Flag("token-env", "The environment variable to read the API token from").String(),
+		tokenFile:  cmd.Flag("token-file", "The file to read the API token from").String(),
+		repoURL:    cmd.Flag("repo-url", "The default repo to deploy from").String(),
+		use:        cmd.Flag("use", "Use the profile by default").Bool(),
+	}
+}
+
+// explicitFlags records the global flags that were given on the command line, rather than set by an environment
+// variable such as PULUMI_ORG.
+var explicitFlags = map[string]bool{}
+
+// recordExplicitFlag returns a flag action that records that the named flag was given on the command line.
+func recordExplicitFlag(name string) kingpin.Action {
+	return func(*kingpin.ParseContext) error {
+		explicitFlags[name] = true
+		return nil
+	}
+}
+
+// explicitValue returns the value of the named global flag if it was given on the command line, and otherwise "".
+func explicitValue(name string, value *string) string {
+	if !explicitFlags[name] {
+		return ""
+	}
+	return *value
+}
+
+// addProfile adds a profile to the config file. The profile's default org, project, and stack are set by the global
+// --org, --project, and --stack flags if they are given on the command line; PULUMI_ORG isn't saved in the profile.
+func (o *profileAddOptions) addProfile() {
+	switch {
+	case *o.tokenEnv != "" && *o.tokenFile != "":
+		fatalf(exitUsage, "only one of --token-env and --token-file may be set")
+	case *o.backendURL != "" && !isServiceBackend(*o.backendURL):
+		fatalf(exitUsage, "--backend-url must be an http or https URL, got '%s'", *o.backendURL)
+	}
+
+	config, path := readProfileConfig()
+	if _, ok := config.Profiles[*o.name]; ok {
+		fatalf(exitConflict, "profile '%s' already exists; remove it first to replace it", *o.name)
+	}
+	if config.Profiles == nil {
+		config.Profiles = map[string]*profile{}
+	}
+	config.Profiles[*o.name] = &profile{
+		BackendURL: strings.TrimSuffix(*o.backendURL, "/"),
+		TokenEnv:   *o.tokenEnv,
+		TokenFile:  *o.tokenFile,
+		Org:        explicitValue("org", org),
+		Project:    explicitValue("project", project),
+		Stack:      explicitValue("stack", stack),
+		RepoURL:    *o.repoURL,
+	}
+	if *o.use {
+		config.Current = *o.name
+	}
+	writeProfileConfig(config, path)
+}
+
+// useProfile makes a profile the config file's current profile.
+func useProfile(name string) {
+	config, path := readProfileConfig()
+	if _, ok := config.Profiles[name]; !ok {
+		fatalf(exitNotFound, "profile '%s' not found in %s", name, path)
+	}
+	config.Current = name
+	writeProfileConfig(config, path)
+}
+
+// removeProfile removes a profile from the config file. If it was the current profile, no profile is current.
+func removeProfile(name string) {
+	config, path := readProfileConfig()
+	if _, ok := config.Profiles[name]; !ok {
+		fatalf(exitNotFound, "profile '%s' not found in %s", name, path)
+	}
+	delete(config.Profiles, name)
+	if config.Current == name {
+		config.Current = ""
+	}
+	writeProfileConfig(config, path)
+}
+
+// ListedProfile is a profile as printed by `profile list`.
+type ListedProfile struct {
+	Name    string `json:"name" yaml:"name"`
+	Current bool   `json:"current" yaml:"current"`
+	profile `yaml:",inline"`
+}
+
+// listProfiles returns the profiles in the config file, sorted by name.
+func listProfiles() []ListedProfile {
+	config, _ := readProfileConfig()
+	current := *profileName
+	if current == "" {
+		current = config.Current
+	}
+	profiles := make([]ListedProfile, 0, len(config.Profiles))
+	for name, p := range config.Profiles {
+		profiles = append(profiles, ListedProfile{Name: name, Current: name == current, profile: *p})
+	}
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Name < profiles[j].Name })
+	return profiles
+}
+
+// printProfilesTable prints a table of profiles, marking the current one.
+func printProfilesTable(w io.Writer, profiles []ListedProfile) {
+	if len(profiles) == 0 {
+		fmt.Fprintln(w, "no profiles")
+		return
+	}
+	fmt.Fprintln(w, "CURRENT\tNAME\tBACKEND\tORG\tPROJECT\tSTACK")
+	for _, p := range profiles {
+		current := ""
+		if p.Current {
+			current = "*"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", current, p.Name, orDash(p.BackendURL), orDash(p.Org), orDash(p.Project), orDash(p.Stack))
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestProfileToken(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("ACME_PULUMI_TOKEN", "pul-env")
+	t.Setenv("UNSET_PULUMI_TOKEN", "")
+	writeFile(t, filepath.Join(home, "tokens", "acme"), "pul-file\n")
+
+	tests := []struct {
+		name    string
+		p       profile
+		want    string
+		wantErr string
+	}{
+		{"no token source", profile{}, "", ""},
+		{"environment variable", profile{TokenEnv: "ACME_PULUMI_TOKEN"}, "pul-env", ""},
+		{"unset environment variable", profile{TokenEnv: "UNSET_PULUMI_TOKEN"}, "", "UNSET_PULUMI_TOKEN is not set"},
+		{"file", profile{TokenFile: filepath.Join(home, "tokens", "acme")}, "pul-file", ""},
+		{"file in home", profile{TokenFile: "~/tokens/acme"}, "pul-file", ""},
+		{"missing file", profile{TokenFile: "~/tokens/other"}, "", "no such file"},
+	}
+	for _, tt := range tests {
+		got, err := tt.p.token()
+		switch {
+		case tt.wantErr != "":
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: got error %v, want one containing %q", tt.name, err, tt.wantErr)
+			}
+		case err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case got != tt.want:
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("PULUMI_ORG", "env-org")
+	setGlobalFlags(t, "", "", "", "")
+	saved := *profileName
+	t.Cleanup(func() {
+		*profileName = saved
+		explicitFlags = map[string]bool{}
+	})
+	*profileName = ""
+
+	if p := selectedProfile(); p != nil {
+		t.Fatalf("got profile %+v without a config file", p)
+	}
+	// Only flags given on the command line are saved, not PULUMI_ORG.
+	for _, args := range [][]string{
+		{"--project", "website", "profile", "add", "acme", "--backend-url", "https://pulumi.acme.internal/", "--use"},
+		{"--org", "jaxxstorm", "profile", "add", "oss", "--backend-url=", "--no-use"},
+	} {
+		explicitFlags = map[string]bool{}
+		if _, err := app.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		profileAddOpts.addProfile()
+	}
+
+	*profileName = ""
+	if p := selectedProfile(); p == nil || *p != (profile{BackendURL: "https://pulumi.acme.internal", Project: "website"}) {
+		t.Errorf("got current profile %+v", p)
+	}
+	*profileName = "oss"
+	if p := selectedProfile(); p == nil || *p != (profile{Org: "jaxxstorm"}) {
+		t.Errorf("got profile oss %+v", p)
+	}
+	*profileName = ""
+
+	removeProfile("acme")
+	profiles := listProfiles()
+	if len(profiles) != 1 || profiles[0].Name != "oss" || profiles[0].Current {
+		t.Errorf("got profiles %+v after removing the current profile", profiles)
+	}
+}
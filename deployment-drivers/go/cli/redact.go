@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// redacted replaces secret values in debug output.
+const redacted = "[secret]"
+
+var (
+	// authorizationPattern matches the credentials of Authorization headers, after the scheme.
+	authorizationPattern = regexp.MustCompile(`(?mi)^([ \t]*Authorization[ \t]*:[ \t]*)(?:(\w+)[ \t]+)?\S.*$`)
+	// secretFieldPattern matches the values of JSON secret fields, i.e. {"secret": value}.
+	secretFieldPattern = regexp.MustCompile(`("secret"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+	// sensitiveKeyPattern matches JSON string fields named like environment variables that hold credentials, e.g.
+	// AWS_SECRET_ACCESS_KEY or GITHUB_TOKEN.
+	sensitiveKeyPattern = regexp.MustCompile(`("[A-Z0-9_]*(?:SECRET|TOKEN|PASSWORD|PASSWD|PASSPHRASE|PRIVATE_KEY|ACCESS_KEY|API_KEY|CREDENTIAL)[A-Z0-9_]*"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+)
+
+// secrets holds the values that must never be printed, such as the API token and secret environment variables.
+var secrets []string
+
+// addSecret registers a value for redaction. The value's JSON-encoded form is registered too, as request bodies are
+// logged as JSON.
+func addSecret(s string) {
+	if s == "" {
+		return
+	}
+	secrets = append(secrets, s)
+	if b, err := json.Marshal(s); err == nil {
+		if quoted := string(b[1 : len(b)-1]); quoted != s {
+			secrets = append(secrets, quoted)
+		}
+	}
+}
+
+// redact replaces every registered secret in s, along with the credentials of Authorization headers, the values of
+// secret fields, and the values of fields whose names suggest they hold credentials.
+func redact(s string) string {
+	s = authorizationPattern.ReplaceAllStringFunc(s, func(header string) string {
+		m := authorizationPattern.FindStringSubmatch(header)
+		if m[2] != "" {
+			return m[1] + m[2] + " " + redacted
+		}
+		return m[1] + redacted
+	})
+	s = secretFieldPattern.ReplaceAllString(s, `$1"`+redacted+`"`)
+	s = sensitiveKeyPattern.ReplaceAllString(s, `$1"`+redacted+`"`)
+
+	if len(secrets) == 0 {
+		return s
+	}
+	// Replace longer secrets first, so that a secret that contains another is replaced whole.
+	sorted := append([]string(nil), secrets...)
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+	pairs := make([]string, 0, 2*len(sorted))
+	for _, secret := range sorted {
+		pairs = append(pairs, secret, redacted)
+	}
+	return strings.NewReplacer(pairs...).Replace(s)
+}
+
+// redactingLogger is a resty logger that redacts secrets from everything it logs, including the requests and
+// responses logged by --debug.
+type redactingLogger struct {
+	l *log.Logger
+}
+
+func newRedactingLogger() redactingLogger {
+	return redactingLogger{l: log.Default()}
+}
+
+func (r redactingLogger) Errorf(format string, v ...interface{}) {
+	r.output("ERROR RESTY "+format, v...)
+}
+
+func (r redactingLogger) Warnf(format string, v ...interface{}) {
+	r.output("WARN RESTY "+format, v...)
+}
+
+func (r redactingLogger) Debugf(format string, v ...interface{}) {
+	r.output("DEBUG RESTY "+format, v...)
+}
+
+func (r redactingLogger) output(format string, v ...interface{}) {
+	r.l.Print(redact(fmt.Sprintf(format, v...)))
+}
+
+// warnIfTokenFlag warns if the API token was passed on the command line, where other users of the machine can see it
+// in the process list and it is saved to shell history.
+func warnIfTokenFlag(args []string) {
+	for _, arg := range args {
+		if arg == "--" {
+			return
+		}
+		if arg == "--token" || strings.HasPrefix(arg, "--token=") {
+			log.Printf("warning: --token is visible to other users and saved in shell history; set PULUMI_ACCESS_TOKEN or run `pulumi login` instead")
+			return
+		}
+	}
+}
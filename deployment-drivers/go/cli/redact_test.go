@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		want string
+	}{
+		{"authorization header", "Authorization: token pul-abc123", "Authorization: token [secret]"},
+		{"authorization without a scheme", "  authorization:pul-abc123", "  authorization:[secret]"},
+		{"secret field", `{"API_KEY": {"secret": "hu\"nter"}}`, `{"API_KEY": {"secret": "[secret]"}}`},
+		{"sensitive key", `{"AWS_SECRET_ACCESS_KEY": "abc", "REGION": "us-west-2"}`, `{"AWS_SECRET_ACCESS_KEY": "[secret]", "REGION": "us-west-2"}`},
+		{"sensitive key in lower case", `{"token": "abc"}`, `{"token": "abc"}`},
+		{"registered secret", "cloning with ghp_registered", "cloning with [secret]"},
+		{"registered secret containing another", "key: ghp_registered-long", "key: [secret]"},
+		{"JSON-encoded secret", `{"value": "line\nbreak"}`, `{"value": "[secret]"}`},
+	}
+	secrets = nil
+	defer func() { secrets = nil }()
+	addSecret("ghp_registered")
+	addSecret("ghp_registered-long")
+	addSecret("line\nbreak")
+	addSecret("")
+
+	for _, tt := range tests {
+		if got := redact(tt.s); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRedactingLogger(t *testing.T) {
+	secrets = nil
+	defer func() { secrets = nil }()
+	addSecret("pul-abc123")
+
+	var buf bytes.Buffer
+	l := redactingLogger{l: log.New(&buf, "", 0)}
+	l.Debugf("request body: %s", `{"token": "pul-abc123"}`)
+	if got := buf.String(); strings.Contains(got, "pul-abc123") || !strings.HasPrefix(got, "DEBUG RESTY") {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestWarnIfTokenFlag(t *testing.T) {
+	tests := []struct {
+		args []string
+		want bool
+	}{
+		{[]string{"list"}, false},
+		{[]string{"list", "--token", "pul-abc123"}, true},
+		{[]string{"--token=pul-abc123", "list"}, true},
+		{[]string{"list", "--", "--token"}, false},
+		{[]string{"list", "--tokens"}, false},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		log.SetOutput(&buf)
+		warnIfTokenFlag(tt.args)
+		log.SetOutput(os.Stderr)
+		if got := strings.Contains(buf.String(), "warning: --token"); got != tt.want {
+			t.Errorf("%q: got warning %v, want %v", tt.args, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-resty/resty/v2"
+	"gopkg.in/alecthomas/kingpin.v2"
+	"gopkg.in/yaml.v3"
+)
+
+// DeploymentSettings are the deployment settings saved for a stack.
+type DeploymentSettings struct {
+	SourceContext    *SettingsSourceContext    `json:"sourceContext,omitempty" yaml:"sourceContext,omitempty"`
+	OperationContext *SettingsOperationContext `json:"operationContext,omitempty" yaml:"operationContext,omitempty"`
+	GitHub           *GitHubSettings           `json:"gitHub,omitempty" yaml:"gitHub,omitempty"`
+}
+
+// SettingsSourceContext describes where a stack's Pulumi program comes from.
+type SettingsSourceContext struct {
+	Git *GitSettings `json:"git,omitempty" yaml:"git,omitempty"`
+}
+
+// GitSettings describes the git repository that holds a stack's Pulumi program.
+type GitSettings struct {
+	RepoURL string `json:"repoURL,omitempty" yaml:"repoURL,omitempty"`
+	Branch  string `json:"branch,omitempty" yaml:"branch,omitempty"`
+	Commit  string `json:"commit,omitempty" yaml:"commit,omitempty"`
+	RepoDir string `json:"repoDir,omitempty" yaml:"repoDir,omitempty"`
+}
+
+// SettingsOperationContext describes the environment that a stack's deployments run in.
+type SettingsOperationContext struct {
+	PreRunCommands []string                    `json:"preRunCommands,omitempty" yaml:"preRunCommands,omitempty"`
+	Environment    map[string]EnvironmentValue `json:"environmentVariables,omitempty" yaml:"environmentVariables,omitempty"`
+	OIDC           *OIDCSettings               `json:"oidc,omitempty" yaml:"oidc,omitempty"`
+}
+
+// EnvironmentValue is the value of an environment variable in deployment settings. Plain values are strings. Secret
+// values are sent as {"secret": value} and are returned encrypted, as {"ciphertext": value}.
+type EnvironmentValue struct {
+	Value      string
+	Secret     bool
+	Ciphertext string
+}
+
+// MarshalJSON implements json.Marshaler.
+func (v EnvironmentValue) MarshalJSON() ([]byte, error) {
+	return json.Marshal(v.jsonValue())
+}
+
+// MarshalYAML implements yaml.Marshaler.
+func (v EnvironmentValue) MarshalYAML() (interface{}, error) {
+	return v.jsonValue(), nil
+}
+
+// jsonValue returns the API's representation of v.
+func (v EnvironmentValue) jsonValue() interface{} {
+	switch {
+	case v.Ciphertext != "":
+		return map[string]string{"ciphertext": v.Ciphertext}
+	case v.Secret:
+		return map[string]string{"secret": v.Value}
+	default:
+		return v.Value
+	}
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (v *EnvironmentValue) UnmarshalJSON(b []byte) error {
+	*v = EnvironmentValue{}
+	if err := json.Unmarshal(b, &v.Value); err == nil {
+		return nil
+	}
+	var secret struct {
+		Secret     *string `json:"secret"`
+		Ciphertext string  `json:"ciphertext"`
+	}
+	if err := json.Unmarshal(b, &secret); err != nil {
+		return fmt.Errorf("environment variable must be a string, {secret: value}, or {ciphertext: value}: %w", err)
+	}
+	if secret.Secret != nil {
+		v.Value, v.Secret = *secret.Secret, true
+	}
+	v.Ciphertext = secret.Ciphertext
+	return nil
+}
+
+// OIDCSettings configures OIDC credential exchange with cloud providers.
+type OIDCSettings struct {
+	AWS   *AWSOIDCSettings   `json:"aws,omitempty" yaml:"aws,omitempty"`
+	Azure *AzureOIDCSettings `json:"azure,omitempty" yaml:"azure,omitempty"`
+	GCP   *GCPOIDCSettings   `json:"gcp,omitempty" yaml:"gcp,omitempty"`
+}
+
+// AWSOIDCSettings configures OIDC credential exchange with AWS.
+type AWSOIDCSettings struct {
+	RoleARN     string   `json:"roleArn,omitempty" yaml:"roleArn,omitempty"`
+	SessionName string   `json:"sessionName,omitempty" yaml:"sessionName,omitempty"`
+	Duration    string   `json:"duration,omitempty" yaml:"duration,omitempty"`
+	PolicyARNs  []string `json:"policyArns,omitempty" yaml:"policyArns,omitempty"`
+}
+
+// AzureOIDCSettings configures OIDC credential exchange with Azure.
+type AzureOIDCSettings struct {
+	ClientID       string `json:"clientId,omitempty" yaml:"clientId,omitempty"`
+	TenantID       string `json:"tenantId,omitempty" yaml:"tenantId,omitempty"`
+	SubscriptionID string `json:"subscriptionId,omitempty" yaml:"subscriptionId,omitempty"`
+}
+
+// GCPOIDCSettings configures OIDC credential exchange with Google Cloud.
+type GCPOIDCSettings struct {
+	ProjectID      string `json:"projectId,omitempty" yaml:"projectId,omitempty"`
+	Region         string `json:"region,omitempty" yaml:"region,omitempty"`
+	WorkloadPoolID string `json:"workloadPoolId,omitempty" yaml:"workloadPoolId,omitempty"`
+	ProviderID     string `json:"providerId,omitempty" yaml:"providerId,omitempty"`
+	ServiceAccount string `json:"serviceAccount,omitempty" yaml:"serviceAccount,omitempty"`
+	TokenLifetime  string `json:"tokenLifetime,omitempty" yaml:"tokenLifetime,omitempty"`
+}
+
+// GitHubSettings configures the GitHub app integration for a stack. The toggles are pointers so that they can be
+// explicitly turned off.
+type GitHubSettings struct {
+	Repository          string   `json:"repository,omitempty" yaml:"repository,omitempty"`
+	Paths               []string `json:"paths,omitempty" yaml:"paths,omitempty"`
+	DeployCommits       *bool    `json:"deployCommits,omitempty" yaml:"deployCommits,omitempty"`
+	PreviewPullRequests *bool    `json:"previewPullRequests,omitempty" yaml:"previewPullRequests,omitempty"`
+}
+
+// optionalBool is a boolean flag that records whether it was set, so that an unset flag leaves a setting unchanged.
+// Like other boolean flags, it has a --no-<name> counterpart.
+type optionalBool struct {
+	value *bool
+}
+
+func (b *optionalBool) Set(s string) error {
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	b.value = &v
+	return nil
+}
+
+func (b *optionalBool) String() string {
+	if b.value == nil {
+		return ""
+	}
+	return strconv.FormatBool(*b.value)
+}
+
+func (b *optionalBool) IsBoolFlag() bool {
+	return true
+}
+
+// settingsURL returns the URL of the stack's deployment settings.
+func settingsURL() string {
+	return fmt.Sprintf("%s/%s/%s/%s/deployment/settings", previewURL, *org, *project, *stack)
+}
+
+// checkSettingsResponse exits if a deployment settings request failed.
+func checkSettingsResponse(action string, resp *resty.Response, err error) {
+	checkResponse(action+" deployment settings", resp, err,
+		fmt.Sprintf("stack '%s/%s/%s' doesn't exist or has no deployment settings", *org, *project, *stack))
+}
+
+// getSettings returns the stack's deployment settings.
+func getSettings(client *resty.Client) DeploymentSettings {
+	resp, err := client.R().
+		SetHeader("Authorization", fmt.Sprintf("token %s", *token)).
+		SetHeader("Accept", "application/json").
+		Get(settingsURL())
+	checkSettingsResponse("getting", resp, err)
+
+	var settings DeploymentSettings
+	if err := json.Unmarshal(resp.Body(), &settings); err != nil {
+		fatalf(exitError, "decoding deployment settings: %v", err)
+	}
+	return settings
+}
+
+// setSettings merges settings into the stack's deployment settings.
+func setSettings(client *resty.Client, settings DeploymentSettings) {
+	resp, err := client.R().
+		SetBody(settings).
+		SetHeader("Authorization", fmt.Sprintf("token %s", *token)).
+		SetHeader("Accept", "application/json").
+		Post(settingsURL())
+	checkSettingsResponse("setting", resp, err)
+}
+
+// deleteSettings deletes the stack's deployment settings.
+func deleteSettings(client *resty.Client) {
+	resp, err := client.R().
+		SetHeader("Authorization", fmt.Sprintf("token %s", *token)).
+		SetHeader("Accept", "application/json").
+		Delete(settingsURL())
+	checkSettingsResponse("deleting", resp, err)
+}
+
+// readSettingsFile reads deployment settings from a YAML or JSON file. Keys are the same as the API's.
+func readSettingsFile(path string) DeploymentSettings {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		fatalf(exitError, "reading settings file: %v", err)
+	}
+	// Decode through JSON so that the file is interpreted exactly as the API would interpret it.
+	var doc interface{}
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		fatalf(exitError, "parsing settings file %s: %v", path, err)
+	}
+	j, err := json.Marshal(doc)
+	if err != nil {
+		fatalf(exitError, "parsing settings file %s: %v", path, err)
+	}
+	dec := json.NewDecoder(strings.NewReader(string(j)))
+	dec.DisallowUnknownFields()
+	var settings DeploymentSettings
+	if err := dec.Decode(&settings); err != nil {
+		fatalf(exitError, "parsing settings file %s: %v", path, err)
+	}
+	return settings
+}
+
+// settingsFlags holds the values of the flags of the settings set command.
+type settingsFlags struct {
+	repoURL             string
+	branch              string
+	repoDir             string
+	env                 *envOptions
+	preRunCommands      []string
+	awsRoleARN          string
+	awsSessionName      string
+	gitHubRepository    string
+	gitHubPaths         []string
+	deployCommits       optionalBool
+	previewPullRequests optionalBool
+}
+
+// newSettingsFlags defines the flags of the settings set command.
+func newSettingsFlags(cmd *kingpin.CmdClause) *settingsFlags {
+	f := &settingsFlags{}
+	cmd.Flag("repo-url", "The git repository that contains the Pulumi program").StringVar(&f.repoURL)
+	cmd.Flag("branch", "The git branch to deploy").StringVar(&f.branch)
+	cmd.Flag("repo-dir", "The directory in the git repository that contains the Pulumi program").StringVar(&f.repoDir)
+	f.env = EnvCommandOptions(cmd)
+	cmd.Flag("prerun-commands", "Commands to run before Pulumi runs").StringsVar(&f.preRunCommands)
+	cmd.Flag("aws-role-arn", "The AWS IAM Role ARN to assume via OIDC").StringVar(&f.awsRoleARN)
+	cmd.Flag("aws-session-name", "The session name to use for AWS OIDC").StringVar(&f.awsSessionName)
+	cmd.Flag("github-repository", "The GitHub repository (owner/name) to integrate with").StringVar(&f.gitHubRepository)
+	cmd.Flag("github-paths", "Path filters that select the commits and pull requests that trigger deployments").StringsVar(&f.gitHubPaths)
+	cmd.Flag("deploy-commits", "Run an update when commits are pushed to the branch").SetValue(&f.deployCommits)
+	cmd.Flag("preview-pull-requests", "Run a preview for pull requests against the branch").SetValue(&f.previewPullRequests)
+	return f
+}
+
+// apply overlays the flags that were set onto settings.
+func (f *settingsFlags) apply(settings *DeploymentSettings) {
+	if f.repoURL != "" || f.branch != "" || f.repoDir != "" {
+		if settings.SourceContext == nil {
+			settings.SourceContext = &SettingsSourceContext{}
+		}
+		if settings.SourceContext.Git == nil {
+			settings.SourceContext.Git = &GitSettings{}
+		}
+		git := settings.SourceContext.Git
+		if f.repoURL != "" {
+			git.RepoURL = f.repoURL
+		}
+		if f.branch != "" {
+			git.Branch = f.branch
+		}
+		if f.repoDir != "" {
+			git.RepoDir = f.repoDir
+		}
+	}
+
+	env := f.env.environment()
+	if len(env) != 0 || len(f.preRunCommands) != 0 || f.awsRoleARN != "" || f.awsSessionName != "" {
+		if settings.OperationContext == nil {
+			settings.OperationContext = &SettingsOperationContext{}
+		}
+		op := settings.OperationContext
+		for k, v := range env {
+			if op.Environment == nil {
+				op.Environment = map[string]EnvironmentValue{}
+			}
+			op.Environment[k] = v
+		}
+		if len(f.preRunCommands) != 0 {
+			op.PreRunCommands = f.preRunCommands
+		}
+		if f.awsRoleARN != "" || f.awsSessionName != "" {
+			if op.OIDC == nil {
+				op.OIDC = &OIDCSettings{}
+			}
+			if op.OIDC.AWS == nil {
+				op.OIDC.AWS = &AWSOIDCSettings{}
+			}
+			if f.awsRoleARN != "" {
+				op.OIDC.AWS.RoleARN = f.awsRoleARN
+			}
+			if f.awsSessionName != "" {
+				op.OIDC.AWS.SessionName = f.awsSessionName
+			}
+		}
+	}
+
+	if f.gitHubRepository != "" || len(f.gitHubPaths) != 0 || f.deployCommits.value != nil || f.previewPullRequests.value != nil {
+		if settings.GitHub == nil {
+			settings.GitHub = &GitHubSettings{}
+		}
+		gh := settings.GitHub
+		if f.gitHubRepository != "" {
+			gh.Repository = f.gitHubRepository
+		}
+		if len(f.gitHubPaths) != 0 {
+			gh.Paths = f.gitHubPaths
+		}
+		if f.deployCommits.value != nil {
+			gh.DeployCommits = f.deployCommits.value
+		}
+		if f.previewPullRequests.value != nil {
+			gh.PreviewPullRequests = f.previewPullRequests.value
+		}
+	}
+}
+
+// settingsToSet returns the settings that settings set merges into the stack's settings: those in the file at path,
+// if any, overlaid with the flags that were set. settingsToSet exits if there is nothing to set, as posting empty
+// settings would only change the stack's settings by accident.
+func settingsToSet(path string, flags *settingsFlags) DeploymentSettings {
+	var settings DeploymentSettings
+	if path != "" {
+		settings = readSettingsFile(path)
+	}
+	flags.apply(&settings)
+	if settings == (DeploymentSettings{}) {
+		fatalf(exitUsage, "nothing to set: pass a settings file with --file or at least one setting flag, try --help")
+	}
+	return settings
+}
+
+// toMap converts settings to their generic JSON form.
+func (s DeploymentSettings) toMap() map[string]interface{} {
+	b, err := json.Marshal(s)
+	if err != nil {
+		fatalf(exitError, "encoding deployment settings: %v", err)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		fatalf(exitError, "encoding deployment settings: %v", err)
+	}
+	return m
+}
+
+// mergeSettings returns the settings that result from merging patch into current, as the settings API does: objects
+// are merged recursively and any other value in patch replaces the value in current. Environment variables are
+// replaced individually, even if their values are secret objects.
+func mergeSettings(current, patch map[string]interface{}) map[string]interface{} {
+	merged := map[string]interface{}{}
+	for k, v := range current {
+		merged[k] = v
+	}
+	for k, v := range patch {
+		cur, curOK := merged[k].(map[string]interface{})
+		p, pOK := v.(map[string]interface{})
+		switch {
+		case curOK && pOK && k == "environmentVariables":
+			env := map[string]interface{}{}
+			for name, value := range cur {
+				env[name] = value
+			}
+			for name, value := range p {
+				env[name] = value
+			}
+			merged[k] = env
+		case curOK && pOK:
+			merged[k] = mergeSettings(cur, p)
+		default:
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// SettingsDiff describes the changes that applying a settings file would make to a stack's deployment settings.
+// Secret environment variables are shown as [secret]. The API returns them encrypted, so a secret that is set both
+// in the stack's settings and in the file can't be compared; its name is listed in Unknown instead of being shown as a
+// change.
+type SettingsDiff struct {
+	Changed bool                   `json:"changed" yaml:"changed"`
+	Unknown []string               `json:"unknown,omitempty" yaml:"unknown,omitempty"`
+	Current map[string]interface{} `json:"current" yaml:"current"`
+	Desired map[string]interface{} `json:"desired" yaml:"desired"`
+	Diff    []string               `json:"diff" yaml:"diff"`
+}
+
+// diffSettings compares the stack's current settings with the settings that would result from applying patch.
+func diffSettings(current, patch DeploymentSettings) SettingsDiff {
+	cur := current.toMap()
+	desired := redactSecretEnvironment(mergeSettings(cur, patch.toMap()))
+	cur = redactSecretEnvironment(cur)
+
+	var unknown []string
+	if patch.OperationContext != nil && current.OperationContext != nil {
+		for name, v := range patch.OperationContext.Environment {
+			if old, ok := current.OperationContext.Environment[name]; ok && v.isSecret() && old.isSecret() {
+				unknown = append(unknown, name)
+			}
+		}
+		sort.Strings(unknown)
+	}
+
+	diff := diffLines(settingsYAML(cur), settingsYAML(desired))
+	changed := false
+	for _, line := range diff {
+		if !strings.HasPrefix(line, " ") {
+			changed = true
+		}
+	}
+	return SettingsDiff{Changed: changed, Unknown: unknown, Current: cur, Desired: desired, Diff: diff}
+}
+
+// isSecret returns true if v is a secret, either to be set or as returned encrypted by the API.
+func (v EnvironmentValue) isSecret() bool {
+	return v.Secret || v.Ciphertext != ""
+}
+
+// redactSecretEnvironment returns a copy of settings, in their generic JSON form, with the values of secret
+// environment variables replaced by [secret].
+func redactSecretEnvironment(settings map[string]interface{}) map[string]interface{} {
+	op, ok := settings["operationContext"].(map[string]interface{})
+	if !ok {
+		return settings
+	}
+	env, ok := op["environmentVariables"].(map[string]interface{})
+	if !ok {
+		return settings
+	}
+
+	redactedEnv := map[string]interface{}{}
+	for name, value := range env {
+		if _, secret := value.(map[string]interface{}); secret {
+			value = redacted
+		}
+		redactedEnv[name] = value
+	}
+	redactedOp := map[string]interface{}{}
+	for k, v := range op {
+		redactedOp[k] = v
+	}
+	redactedOp["environmentVariables"] = redactedEnv
+	redactedSettings := map[string]interface{}{}
+	for k, v := range settings {
+		redactedSettings[k] = v
+	}
+	redactedSettings["operationContext"] = redactedOp
+	return redactedSettings
+}
+
+// settingsYAML returns the lines of the YAML form of settings. Keys are sorted so that equal settings produce equal
+// lines.
+func settingsYAML(settings map[string]interface{}) []string {
+	if len(settings) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(settings); err != nil {
+		fatalf(exitError, "encoding deployment settings: %v", err)
+	}
+	return strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+}
+
+// diffLines returns a line diff of a and b. Each line is prefixed with " " if it is in both, "-" if it is only in a,
+// and "+" if it is only in b.
+func diffLines(a, b []string) []string {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var diff []string
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			diff = append(diff, " "+a[i])
+			i, j = i+1, j+1
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			diff = append(diff, "-"+a[i])
+			i++
+		default:
+			diff = append(diff, "+"+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		diff = append(diff, "-"+a[i])
+	}
+	for ; j < len(b); j++ {
+		diff = append(diff, "+"+b[j])
+	}
+	return diff
+}
+
+// printSettingsTable prints settings as YAML, which is easier to read than a table for nested settings.
+func printSettingsTable(w io.Writer, settings DeploymentSettings) {
+	lines := settingsYAML(settings.toMap())
+	if len(lines) == 0 {
+		fmt.Fprintln(w, "no deployment settings")
+		return
+	}
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+}
+
+// printSettingsDiffTable prints a settings diff, followed by the secrets that can't be compared.
+func printSettingsDiffTable(w io.Writer, diff SettingsDiff) {
+	if !diff.Changed {
+		fmt.Fprintln(w, "no changes")
+	} else {
+		for _, line := range diff.Diff {
+			fmt.Fprintln(w, line)
+		}
+	}
+	if len(diff.Unknown) != 0 {
+		fmt.Fprintf(w, "secret environment variables can't be compared and may change: %s\n", strings.Join(diff.Unknown, ", "))
+	}
+}
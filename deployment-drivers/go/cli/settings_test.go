@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+func TestEnvironmentValueJSON(t *testing.T) {
+	tests := []struct {
+		json string
+		want EnvironmentValue
+	}{
+		{`"plain"`, EnvironmentValue{Value: "plain"}},
+		{`{"secret": "hunter2"}`, EnvironmentValue{Value: "hunter2", Secret: true}},
+		{`{"ciphertext": "Y2lwaGVy"}`, EnvironmentValue{Ciphertext: "Y2lwaGVy"}},
+	}
+	for _, tt := range tests {
+		var got EnvironmentValue
+		if err := json.Unmarshal([]byte(tt.json), &got); err != nil {
+			t.Errorf("%s: %v", tt.json, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.json, got, tt.want)
+		}
+		if b, _ := json.Marshal(got); strings.ReplaceAll(tt.json, " ", "") != string(b) {
+			t.Errorf("%s: marshaled as %s", tt.json, b)
+		}
+	}
+	if err := json.Unmarshal([]byte(`1`), &EnvironmentValue{}); err == nil {
+		t.Error("a number was accepted as an environment variable")
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		a, b []string
+		want []string
+	}{
+		{nil, nil, nil},
+		{[]string{"a", "b"}, []string{"a", "b"}, []string{" a", " b"}},
+		{[]string{"a", "b", "c"}, []string{"a", "c", "d"}, []string{" a", "-b", " c", "+d"}},
+		{nil, []string{"a"}, []string{"+a"}},
+	}
+	for _, tt := range tests {
+		if got := diffLines(tt.a, tt.b); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("diffLines(%q, %q) = %q, want %q", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestDiffSettings(t *testing.T) {
+	env := func(vars map[string]EnvironmentValue) DeploymentSettings {
+		return DeploymentSettings{OperationContext: &SettingsOperationContext{Environment: vars}}
+	}
+	current := env(map[string]EnvironmentValue{
+		"REGION":  {Value: "us-west-2"},
+		"API_KEY": {Ciphertext: "Y2lwaGVy"},
+	})
+	tests := []struct {
+		name    string
+		patch   DeploymentSettings
+		changed bool
+		unknown []string
+		diff    string
+	}{
+		{"no changes", env(map[string]EnvironmentValue{"REGION": {Value: "us-west-2"}}), false, nil, ""},
+		{"plain change", env(map[string]EnvironmentValue{"REGION": {Value: "us-east-1"}}), true, nil, "+    REGION: us-east-1"},
+		{"existing secret", env(map[string]EnvironmentValue{"API_KEY": {Value: "hunter2", Secret: true}}), false, []string{"API_KEY"}, ""},
+		{"new secret", env(map[string]EnvironmentValue{"TOKEN": {Value: "hunter2", Secret: true}}), true, nil, "+    TOKEN: '[secret]'"},
+		{"secret made plain", env(map[string]EnvironmentValue{"API_KEY": {Value: "key"}}), true, nil, "+    API_KEY: key"},
+		{"git", DeploymentSettings{SourceContext: &SettingsSourceContext{Git: &GitSettings{Branch: "main"}}}, true, nil, "+    branch: main"},
+	}
+	for _, tt := range tests {
+		diff := diffSettings(current, tt.patch)
+		if diff.Changed != tt.changed || !reflect.DeepEqual(diff.Unknown, tt.unknown) {
+			t.Errorf("%s: got changed %v and unknown %v, want %v and %v", tt.name, diff.Changed, diff.Unknown, tt.changed, tt.unknown)
+		}
+		if tt.diff != "" && !strings.Contains(strings.Join(diff.Diff, "\n"), tt.diff) {
+			t.Errorf("%s: diff %q doesn't contain %q", tt.name, diff.Diff, tt.diff)
+		}
+
+		var table bytes.Buffer
+		printSettingsDiffTable(&table, diff)
+		b, _ := json.Marshal(diff)
+		for _, out := range []string{table.String(), string(b)} {
+			if strings.Contains(out, "hunter2") || strings.Contains(out, "Y2lwaGVy") {
+				t.Errorf("%s: output contains a secret: %s", tt.name, out)
+			}
+		}
+		if len(tt.unknown) != 0 && !strings.Contains(table.String(), "may change: API_KEY") {
+			t.Errorf("%s: table doesn't list the secrets that may change: %s", tt.name, table.String())
+		}
+	}
+}
+
+func TestMergeSettings(t *testing.T) {
+	current := map[string]interface{}{
+		"sourceContext": map[string]interface{}{"git": map[string]interface{}{"repoURL": "https://a", "branch": "main"}},
+		"operationContext": map[string]interface{}{
+			"environmentVariables": map[string]interface{}{"A": "1", "S": map[string]interface{}{"ciphertext": "x"}},
+		},
+	}
+	patch := map[string]interface{}{
+		"sourceContext": map[string]interface{}{"git": map[string]interface{}{"branch": "dev"}},
+		"operationContext": map[string]interface{}{
+			"environmentVariables": map[string]interface{}{"S": map[string]interface{}{"secret": "y"}},
+		},
+	}
+	want := map[string]interface{}{
+		"sourceContext": map[string]interface{}{"git": map[string]interface{}{"repoURL": "https://a", "branch": "dev"}},
+		"operationContext": map[string]interface{}{
+			"environmentVariables": map[string]interface{}{"A": "1", "S": map[string]interface{}{"secret": "y"}},
+		},
+	}
+	if got := mergeSettings(current, patch); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestSettingsToSet(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "deploy.yaml")
+	if err := os.WriteFile(file, []byte("sourceContext:\n  git:\n    repoURL: https://github.com/acme/website.git\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	empty := filepath.Join(t.TempDir(), "empty.yaml")
+	if err := os.WriteFile(empty, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// settingsToSet exits if there is nothing to set, so those cases are checked in a subprocess that runs this test.
+	parse := func(args ...string) *settingsFlags {
+		app := kingpin.New("deployer", "")
+		flags := newSettingsFlags(app.Command("set", ""))
+		if _, err := app.Parse(append([]string{"set"}, args...)); err != nil {
+			t.Fatal(err)
+		}
+		return flags
+	}
+	if path, ok := os.LookupEnv("DEPLOYER_TEST_SETTINGS_FILE"); ok {
+		settingsToSet(path, parse())
+		return
+	}
+
+	tests := []struct {
+		name  string
+		path  string
+		flags []string
+		want  string
+	}{
+		{"file", file, nil, "https://github.com/acme/website.git"},
+		{"flag", "", []string{"--branch", "refs/heads/dev"}, "refs/heads/dev"},
+		{"file and flag", file, []string{"--no-deploy-commits"}, "https://github.com/acme/website.git"},
+	}
+	for _, tt := range tests {
+		b, _ := json.Marshal(settingsToSet(tt.path, parse(tt.flags...)))
+		if !strings.Contains(string(b), tt.want) {
+			t.Errorf("%s: got settings %s, want %q", tt.name, b, tt.want)
+		}
+	}
+
+	for _, path := range []string{"", empty} {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestSettingsToSet$")
+		cmd.Env = append(os.Environ(), "DEPLOYER_TEST_SETTINGS_FILE="+path)
+		var exitErr *exec.ExitError
+		if err := cmd.Run(); !errors.As(err, &exitErr) || exitErr.ExitCode() != int(exitUsage) {
+			t.Errorf("file %q and no flags: got %v, want exit status %d", path, err, exitUsage)
+		}
+	}
+}
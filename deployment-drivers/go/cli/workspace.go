@@ -0,0 +1,269 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultBackendURL is the URL of the Pulumi Service.
+const defaultBackendURL = "https://api.pulumi.com"
+
+// pulumiHome returns the Pulumi CLI's home directory: $PULUMI_HOME, or ~/.pulumi.
+func pulumiHome() (string, error) {
+	if dir := os.Getenv("PULUMI_HOME"); dir != "" {
+		return dir, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".pulumi"), nil
+}
+
+// pulumiCredentials is the part of the Pulumi CLI's credentials.json that the CLI uses.
+type pulumiCredentials struct {
+	// The URL of the backend that the Pulumi CLI is logged in to.
+	Current string `json:"current"`
+	// The access tokens for each backend, by URL.
+	AccessTokens map[string]string `json:"accessTokens"`
+	// The accounts for each backend, by URL.
+	Accounts map[string]struct {
+		AccessToken string `json:"accessToken"`
+		Username    string `json:"username"`
+	} `json:"accounts"`
+}
+
+// readPulumiCredentials reads the Pulumi CLI's credentials.json. If the Pulumi CLI has never logged in, the
+// credentials are empty.
+func readPulumiCredentials() (pulumiCredentials, error) {
+	dir := os.Getenv("PULUMI_CREDENTIALS_PATH")
+	if dir == "" {
+		home, err := pulumiHome()
+		if err != nil {
+			return pulumiCredentials{}, err
+		}
+		dir = home
+	}
+
+	path := filepath.Join(dir, "credentials.json")
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return pulumiCredentials{}, nil
+	} else if err != nil {
+		return pulumiCredentials{}, err
+	}
+	var creds pulumiCredentials
+	if err := json.Unmarshal(b, &creds); err != nil {
+		return pulumiCredentials{}, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return creds, nil
+}
+
+// currentBackend returns the URL of the backend that the Pulumi CLI is logged in to. As for the Pulumi CLI, the
+// backend can be overridden by PULUMI_BACKEND_URL.
+func (c pulumiCredentials) currentBackend() string {
+	if url := os.Getenv("PULUMI_BACKEND_URL"); url != "" {
+		return url
+	}
+	return c.Current
+}
+
+// login returns the access token and username that the Pulumi CLI uses for a backend, if it has logged in to it.
+func (c pulumiCredentials) login(backend string) (token, username string) {
+	token = c.AccessTokens[backend]
+	if account, ok := c.Accounts[backend]; ok {
+		username = account.Username
+		if token == "" {
+			token = account.AccessToken
+		}
+	}
+	return token, username
+}
+
+// isServiceBackend returns true if a backend URL refers to a Pulumi Service. Self-managed backends, e.g. file:// or
+// s3://, don't support deployments.
+func isServiceBackend(url string) bool {
+	return strings.HasPrefix(url, "https://") || strings.HasPrefix(url, "http://")
+}
+
+// pulumiProject describes the Pulumi project in or above the current directory.
+type pulumiProject struct {
+	// The project's name.
+	name string
+	// The path of the project's Pulumi.yaml.
+	path string
+}
+
+// findPulumiProject searches dir and its parents for a Pulumi.yaml. findPulumiProject returns false if there is none.
+func findPulumiProject(dir string) (pulumiProject, bool, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return pulumiProject{}, false, err
+	}
+	for {
+		for _, name := range []string{"Pulumi.yaml", "Pulumi.yml"} {
+			path := filepath.Join(dir, name)
+			b, err := os.ReadFile(path)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			} else if err != nil {
+				return pulumiProject{}, false, err
+			}
+			var project struct {
+				Name string `yaml:"name"`
+			}
+			if err := yaml.Unmarshal(b, &project); err != nil {
+				return pulumiProject{}, false, fmt.Errorf("parsing %s: %w", path, err)
+			}
+			return pulumiProject{name: project.Name, path: path}, true, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return pulumiProject{}, false, nil
+		}
+		dir = parent
+	}
+}
+
+// selectedStack returns the stack selected for a project with `pulumi stack select`, if any. The name may be
+// qualified with an organization and project, e.g. "acme/website/prod".
+func (p pulumiProject) selectedStack() (string, error) {
+	home, err := pulumiHome()
+	if err != nil {
+		return "", err
+	}
+	// The Pulumi CLI names each project's workspace file after the project and a hash of the path of its Pulumi.yaml.
+	hash := sha1.Sum([]byte(p.path))
+	path := filepath.Join(home, "workspaces", p.name+"-"+hex.EncodeToString(hash[:])+"-workspace.json")
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	var settings struct {
+		Stack string `json:"stack"`
+	}
+	if err := json.Unmarshal(b, &settings); err != nil {
+		return "", fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return settings.Stack, nil
+}
+
+// parseStackName splits a possibly-qualified stack name into its organization, project, and stack. The organization
+// and project are empty if the name doesn't include them.
+func parseStackName(name string) (org, project, stack string) {
+	parts := strings.Split(name, "/")
+	switch len(parts) {
+	case 3:
+		return parts[0], parts[1], parts[2]
+	case 2:
+		return parts[0], "", parts[1]
+	default:
+		return "", "", name
+	}
+}
+
+// resolveDefaults fills in the settings that were not set by flags or environment variables, first from the selected
+// profile, if any, then from the Pulumi CLI's credentials and the Pulumi project in the current directory.
+//
+// The API token is chosen for the backend: --token always applies, but PULUMI_ACCESS_TOKEN belongs to the Pulumi
+// CLI's backend, so it is ignored if the profile sets a backend. That profile's token comes from its own token source
+// or from the Pulumi CLI's login to its backend.
+func resolveDefaults(p *profile) {
+	creds, err := readPulumiCredentials()
+	if err != nil {
+		fatalf(exitError, "reading Pulumi credentials: %v", err)
+	}
+	backend := creds.currentBackend()
+	profileBackend := p != nil && p.BackendURL != ""
+	if profileBackend {
+		backend = p.BackendURL
+	}
+	if !isServiceBackend(backend) {
+		backend = defaultBackendURL
+	}
+	setBackendURL(backend)
+	loginToken, username := creds.login(backend)
+
+	if p != nil {
+		if *token == "" {
+			if *token, err = p.token(); err != nil {
+				fatalf(exitError, "reading token for profile: %v", err)
+			}
+		}
+		fillDefault(org, p.Org)
+		fillDefault(project, p.Project)
+		fillDefault(stack, p.Stack)
+		defaultRepoURL = p.RepoURL
+	}
+	if !profileBackend {
+		fillDefault(token, os.Getenv("PULUMI_ACCESS_TOKEN"))
+	}
+	fillDefault(token, loginToken)
+
+	if *org == "" || *project == "" || *stack == "" {
+		project, found, err := findPulumiProject(".")
+		if err != nil {
+			fatalf(exitError, "reading Pulumi project: %v", err)
+		}
+		if found {
+			applyProjectDefaults(project)
+		}
+	}
+	fillDefault(org, username)
+	fillDefault(stack, "dev")
+
+	switch {
+	case *token == "" && profileBackend:
+		fatalf(exitAuth, "no Pulumi access token for %s: set the profile's --token-env or --token-file, or run `pulumi login %s`", backend, backend)
+	case *token == "":
+		fatalf(exitAuth, "no Pulumi access token: set PULUMI_ACCESS_TOKEN or run `pulumi login`")
+	case *org == "":
+		fatalf(exitUsage, "no organization: pass --org, set PULUMI_ORG, or select a stack with `pulumi stack select`")
+	case *project == "":
+		fatalf(exitUsage, "no project: pass --project or run in a directory with a Pulumi.yaml")
+	}
+}
+
+// fillDefault sets *setting to value if it is empty.
+func fillDefault(setting *string, value string) {
+	if *setting == "" {
+		*setting = value
+	}
+}
+
+// applyProjectDefaults fills in the organization, project, and stack from a Pulumi project and its selected stack.
+func applyProjectDefaults(p pulumiProject) {
+	selected, err := p.selectedStack()
+	if err != nil {
+		fatalf(exitError, "reading selected stack: %v", err)
+	}
+	stackOrg, stackProject, stackName := parseStackName(selected)
+	if *project == "" {
+		*project = p.name
+		if stackProject != "" {
+			*project = stackProject
+		}
+	}
+	// The selected stack only applies to the project it was selected for.
+	if *project != p.name && *project != stackProject {
+		return
+	}
+	if *org == "" {
+		*org = stackOrg
+	}
+	if *stack == "" {
+		*stack = stackName
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeFile writes a file, creating its directory.
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// setGlobalFlags sets the global flags that name the token, org, project, and stack, and restores them after the test.
+func setGlobalFlags(t *testing.T, tokenValue, orgValue, projectValue, stackValue string) {
+	saved := []string{*token, *org, *project, *stack}
+	*token, *org, *project, *stack = tokenValue, orgValue, projectValue, stackValue
+	t.Cleanup(func() {
+		*token, *org, *project, *stack = saved[0], saved[1], saved[2], saved[3]
+		defaultRepoURL = ""
+	})
+}
+
+func TestParseStackName(t *testing.T) {
+	tests := []struct {
+		name                string
+		org, project, stack string
+	}{
+		{"dev", "", "", "dev"},
+		{"acme/dev", "acme", "", "dev"},
+		{"acme/website/dev", "acme", "website", "dev"},
+	}
+	for _, tt := range tests {
+		org, project, stack := parseStackName(tt.name)
+		if org != tt.org || project != tt.project || stack != tt.stack {
+			t.Errorf("parseStackName(%q) = %q, %q, %q", tt.name, org, project, stack)
+		}
+	}
+}
+
+func TestPulumiCredentials(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("PULUMI_CREDENTIALS_PATH", dir)
+	t.Setenv("PULUMI_BACKEND_URL", "")
+	writeFile(t, filepath.Join(dir, "credentials.json"), `{
+		"current": "https://api.pulumi.com",
+		"accessTokens": {"https://api.pulumi.com": "pul-cloud"},
+		"accounts": {
+			"https://api.pulumi.com": {"username": "jaxxstorm"},
+			"https://pulumi.acme.internal": {"accessToken": "pul-acme", "username": "acme-bot"}
+		}
+	}`)
+
+	creds, err := readPulumiCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := creds.currentBackend(); got != "https://api.pulumi.com" {
+		t.Errorf("got current backend %q", got)
+	}
+	tests := []struct {
+		backend, token, username string
+	}{
+		{"https://api.pulumi.com", "pul-cloud", "jaxxstorm"},
+		{"https://pulumi.acme.internal", "pul-acme", "acme-bot"},
+		{"https://other.example.com", "", ""},
+	}
+	for _, tt := range tests {
+		if token, username := creds.login(tt.backend); token != tt.token || username != tt.username {
+			t.Errorf("login(%q) = %q, %q, want %q, %q", tt.backend, token, username, tt.token, tt.username)
+		}
+	}
+
+	t.Setenv("PULUMI_BACKEND_URL", "https://pulumi.acme.internal")
+	if got := creds.currentBackend(); got != "https://pulumi.acme.internal" {
+		t.Errorf("PULUMI_BACKEND_URL didn't override the current backend: %q", got)
+	}
+
+	t.Setenv("PULUMI_CREDENTIALS_PATH", t.TempDir())
+	if creds, err := readPulumiCredentials(); err != nil || creds.Current != "" {
+		t.Errorf("got %+v, %v without a credentials file", creds, err)
+	}
+}
+
+func TestIsServiceBackend(t *testing.T) {
+	for url, want := range map[string]bool{
+		"https://api.pulumi.com": true,
+		"http://localhost:8080":  true,
+		"file://~":               false,
+		"s3://bucket":            false,
+		"":                       false,
+	} {
+		if got := isServiceBackend(url); got != want {
+			t.Errorf("isServiceBackend(%q) = %v, want %v", url, got, want)
+		}
+	}
+}
+
+func TestProjectDefaults(t *testing.T) {
+	home, root := t.TempDir(), t.TempDir()
+	t.Setenv("PULUMI_HOME", home)
+	writeFile(t, filepath.Join(root, "Pulumi.yaml"), "name: website\nruntime: nodejs\n")
+	dir := filepath.Join(root, "src", "pages")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	p, found, err := findPulumiProject(dir)
+	if err != nil || !found || p.name != "website" || p.path != filepath.Join(root, "Pulumi.yaml") {
+		t.Fatalf("got %+v, %v, %v", p, found, err)
+	}
+	if _, found, err := findPulumiProject(home); err != nil || found {
+		t.Errorf("found a project outside of one: %v", err)
+	}
+
+	hash := sha1.Sum([]byte(p.path))
+	workspace := filepath.Join(home, "workspaces", "website-"+hex.EncodeToString(hash[:])+"-workspace.json")
+	writeFile(t, workspace, `{"stack": "acme/website/prod"}`)
+
+	tests := []struct {
+		name                            string
+		org, project, stack             string
+		wantOrg, wantProject, wantStack string
+	}{
+		{"unset", "", "", "", "acme", "website", "prod"},
+		{"flags take precedence", "other", "", "staging", "other", "website", "staging"},
+		{"another project", "", "api", "", "", "api", ""},
+	}
+	for _, tt := range tests {
+		setGlobalFlags(t, "", tt.org, tt.project, tt.stack)
+		applyProjectDefaults(p)
+		if *org != tt.wantOrg || *project != tt.wantProject || *stack != tt.wantStack {
+			t.Errorf("%s: got %s/%s/%s, want %s/%s/%s", tt.name, *org, *project, *stack, tt.wantOrg, tt.wantProject, tt.wantStack)
+		}
+	}
+}
+
+func TestResolveDefaultsToken(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("PULUMI_CREDENTIALS_PATH", dir)
+	t.Setenv("PULUMI_BACKEND_URL", "")
+	t.Setenv("ACME_PULUMI_TOKEN", "pul-acme-env")
+	writeFile(t, filepath.Join(dir, "credentials.json"), `{
+		"current": "https://api.pulumi.com",
+		"accessTokens": {"https://api.pulumi.com": "pul-cloud-login", "https://pulumi.acme.internal": "pul-acme-login"}
+	}`)
+
+	acme := "https://pulumi.acme.internal"
+	tests := []struct {
+		name        string
+		flag        string
+		env         string
+		profile     *profile
+		wantToken   string
+		wantBackend string
+	}{
+		{"login", "", "", nil, "pul-cloud-login", defaultBackendURL},
+		{"environment", "", "pul-cloud-env", nil, "pul-cloud-env", defaultBackendURL},
+		{"flag", "pul-flag", "pul-cloud-env", nil, "pul-flag", defaultBackendURL},
+		{"profile backend ignores the environment", "", "pul-cloud-env", &profile{BackendURL: acme}, "pul-acme-login", acme},
+		{"profile backend and token", "", "pul-cloud-env", &profile{BackendURL: acme, TokenEnv: "ACME_PULUMI_TOKEN"}, "pul-acme-env", acme},
+		{"profile backend and flag", "pul-flag", "pul-cloud-env", &profile{BackendURL: acme, TokenEnv: "ACME_PULUMI_TOKEN"}, "pul-flag", acme},
+		{"profile token", "", "pul-cloud-env", &profile{TokenEnv: "ACME_PULUMI_TOKEN"}, "pul-acme-env", defaultBackendURL},
+		{"profile without a token", "", "pul-cloud-env", &profile{Org: "acme"}, "pul-cloud-env", defaultBackendURL},
+	}
+	for _, tt := range tests {
+		t.Setenv("PULUMI_ACCESS_TOKEN", tt.env)
+		setGlobalFlags(t, tt.flag, "acme", "website", "dev")
+		resolveDefaults(tt.profile)
+		if *token != tt.wantToken || previewURL != tt.wantBackend+"/api/preview" {
+			t.Errorf("%s: got token %q for %s, want %q for %s", tt.name, *token, previewURL, tt.wantToken, tt.wantBackend)
+		}
+	}
+}
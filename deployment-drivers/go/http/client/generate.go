@@ -0,0 +1,7 @@
+// Package client provides a typed Go client for the static site REST API.
+//
+// The client is generated from the server's OpenAPI document. To regenerate it after changing the document, run
+// `go generate ./...` from the root of the module.
+package client
+
+//go:generate go run github.com/oapi-codegen/oapi-codegen/v2/cmd/oapi-codegen@v2.5.1 -config oapi-codegen.yaml ../openapi.json
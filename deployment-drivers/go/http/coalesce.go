@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// deploymentPollInterval is the time between checks for the completion of a site's deployment.
+const deploymentPollInterval = 5 * time.Second
+
+// pendingUpdate is an update that is waiting for a site's current deployment to finish.
+type pendingUpdate struct {
+	// The update to deploy.
+	update contentUpdate
+	// The ID of the request that submitted the update.
+	requestID string
+	// The IDs of the requests whose updates were replaced by this update.
+	superseded []string
+}
+
+// siteUpdates tracks a site with a deployment that may be pending or running.
+type siteUpdates struct {
+	// The update to deploy once the current deployment finishes, if any.
+	pending *pendingUpdate
+}
+
+// updateResult describes the outcome of submitting an update.
+type updateResult struct {
+	// True if the update was queued behind the site's current deployment rather than deployed immediately.
+	Queued bool
+	// The IDs of the requests whose queued updates were replaced by this update.
+	Superseded []string
+}
+
+// updateCoalescer coalesces bursts of updates to a site. While a deployment started by the server is pending or
+// running, newer updates replace any queued update rather than each starting a deployment of their own. Once the
+// current deployment finishes, only the latest queued update is deployed.
+//
+// An update that is still queued when the server stops is never deployed, even though its request was accepted. A
+// queued update whose deployment is being started when the server stops is not interrupted; wait waits for it.
+type updateCoalescer struct {
+	// The context for watching sites' deployments. Queued updates are abandoned when it is canceled.
+	ctx context.Context
+	// Tracks the goroutines that watch sites' deployments.
+	watchers sync.WaitGroup
+
+	// deploy starts a deployment of the given update for a site.
+	deploy func(ctx context.Context, site string, update contentUpdate) error
+	// failed is called when the deployment of a queued update fails to start.
+	failed func(ctx context.Context, site string, update contentUpdate, err error)
+	// status returns the status of a site's current deployment.
+	status func(ctx context.Context, site string) (string, error)
+	// The time between checks for the completion of a site's deployment.
+	pollInterval time.Duration
+
+	m     sync.Mutex
+	sites map[string]*siteUpdates
+}
+
+// newUpdateCoalescer creates an updateCoalescer that deploys updates to s's sites.
+func newUpdateCoalescer(ctx context.Context, s *siteServer) *updateCoalescer {
+	return &updateCoalescer{
+		ctx:    ctx,
+		deploy: s.deploy,
+		failed: s.queuedUpdateFailed,
+		status: func(ctx context.Context, site string) (string, error) {
+			return s.client.getStackCurrentDeploymentStatus(ctx, s.org, s.project, site)
+		},
+		pollInterval: deploymentPollInterval,
+		sites:        map[string]*siteUpdates{},
+	}
+}
+
+// isDeploymentInProgress returns true if a deployment with the given status has not finished.
+func isDeploymentInProgress(status string) bool {
+	switch status {
+	case "not-started", "accepted", "running":
+		return true
+	default:
+		return false
+	}
+}
+
+// submit deploys an update to a site. If a deployment is already in progress, the update is queued instead,
+// replacing any update that was already queued.
+func (c *updateCoalescer) submit(ctx context.Context, site string, update contentUpdate) (updateResult, error) {
+	c.m.Lock()
+	if st, ok := c.sites[site]; ok {
+		pending := &pendingUpdate{update: update, requestID: requestIDFromContext(ctx)}
+		if prev := st.pending; prev != nil {
+			pending.superseded = append(prev.superseded, prev.requestID)
+			updatesSupersededTotal.Inc()
+		}
+		st.pending = pending
+		c.m.Unlock()
+
+		logf(ctx, "queued update for site '%s'", site)
+		return updateResult{Queued: true, Superseded: pending.superseded}, nil
+	}
+	st := &siteUpdates{}
+	c.sites[site] = st
+	c.m.Unlock()
+
+	err := c.deploy(ctx, site, update)
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	if err != nil && st.pending == nil {
+		// Nothing is in progress, so stop tracking the site.
+		if c.sites[site] == st {
+			delete(c.sites, site)
+		}
+		return updateResult{}, err
+	}
+	// Watch the new deployment, or deploy the update that was queued while ours was being started.
+	c.startWatch(site, st)
+	return updateResult{}, err
+}
+
+// track records that a deployment was started for a site by other means, so that updates submitted while it is in
+// progress are queued behind it.
+func (c *updateCoalescer) track(site string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if _, ok := c.sites[site]; !ok {
+		st := &siteUpdates{}
+		c.sites[site] = st
+		c.startWatch(site, st)
+	}
+}
+
+// cancel discards a site's queued update, if any, and stops tracking the site. It returns the IDs of the requests
+// whose updates were discarded.
+func (c *updateCoalescer) cancel(site string) []string {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	st, ok := c.sites[site]
+	if !ok {
+		return nil
+	}
+	delete(c.sites, site)
+	if st.pending == nil {
+		return nil
+	}
+	return append(st.pending.superseded, st.pending.requestID)
+}
+
+// isPending returns true if a site has a queued update.
+func (c *updateCoalescer) isPending(site string) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	st, ok := c.sites[site]
+	return ok && st.pending != nil
+}
+
+// startWatch starts a goroutine that watches a site's deployment. The caller must hold c.m.
+func (c *updateCoalescer) startWatch(site string, st *siteUpdates) {
+	c.watchers.Add(1)
+	go func() {
+		defer c.watchers.Done()
+		c.watch(site, st)
+	}()
+}
+
+// wait waits for the goroutines that watch sites' deployments to return after c.ctx is canceled, including any that
+// are starting the deployment of a queued update. wait returns ctx's error if ctx is done first.
+func (c *updateCoalescer) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		c.watchers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// watch polls a site's current deployment until it finishes, then deploys the site's queued update, if any. watch
+// returns once the site has no deployment in progress and no queued update, or once the site is no longer tracked by
+// st.
+func (c *updateCoalescer) watch(site string, st *siteUpdates) {
+	ticker := time.NewTicker(c.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			c.m.Lock()
+			if st.pending != nil {
+				logf(contextWithRequestID(c.ctx, st.pending.requestID), "abandoning queued update for site '%s'", site)
+			}
+			c.m.Unlock()
+			return
+		case <-ticker.C:
+		}
+
+		status, err := c.status(c.ctx, site)
+		switch {
+		case errors.Is(err, errStackNotFound):
+			c.cancel(site)
+			return
+		case err != nil:
+			logf(c.ctx, "checking deployment status for site '%s': %v", site, err)
+			continue
+		case isDeploymentInProgress(status):
+			continue
+		}
+
+		c.m.Lock()
+		if c.sites[site] != st {
+			c.m.Unlock()
+			return
+		}
+		pending := st.pending
+		if pending == nil {
+			delete(c.sites, site)
+			c.m.Unlock()
+			return
+		}
+		st.pending = nil
+		c.m.Unlock()
+
+		// Starting a deployment takes several Pulumi API calls, so it isn't canceled with c.ctx; wait waits for it instead.
+		ctx := contextWithRequestID(context.Background(), pending.requestID)
+		if err := c.deploy(ctx, site, pending.update); err != nil {
+			logf(ctx, "deploying queued update for site '%s': %v", site, err)
+			c.failed(ctx, site, pending.update, err)
+		} else {
+			logf(ctx, "deployed queued update for site '%s'", site)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// fakeSite is a site whose deployments are recorded and whose deployment status is set by the test.
+type fakeSite struct {
+	m        sync.Mutex
+	deployed []string
+	status   string
+	err      error
+}
+
+func (f *fakeSite) deploy(ctx context.Context, site string, update contentUpdate) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.deployed = append(f.deployed, update.Content)
+	f.status = "running"
+	return nil
+}
+
+func (f *fakeSite) getStatus(ctx context.Context, site string) (string, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.status, f.err
+}
+
+func (f *fakeSite) set(status string, err error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.status, f.err = status, err
+}
+
+func (f *fakeSite) deployments() []string {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return append([]string(nil), f.deployed...)
+}
+
+// newTestCoalescer returns a coalescer that deploys to f and polls it every millisecond.
+func newTestCoalescer(t *testing.T, f *fakeSite) *updateCoalescer {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return &updateCoalescer{
+		ctx:          ctx,
+		deploy:       f.deploy,
+		failed:       func(context.Context, string, contentUpdate, error) {},
+		status:       f.getStatus,
+		pollInterval: time.Millisecond,
+		sites:        map[string]*siteUpdates{},
+	}
+}
+
+// waitFor polls cond until it returns true, failing the test if it doesn't within a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %v", what)
+}
+
+// tracked returns true if c is tracking the given site.
+func (c *updateCoalescer) tracked(site string) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	_, ok := c.sites[site]
+	return ok
+}
+
+func TestCoalescerDeploysLatestQueuedUpdate(t *testing.T) {
+	captureLog(t)
+	f := &fakeSite{}
+	c := newTestCoalescer(t, f)
+
+	submits := []struct {
+		requestID  string
+		content    string
+		queued     bool
+		superseded []string
+	}{
+		{"req-1", "first", false, nil},
+		{"req-2", "second", true, nil},
+		{"req-3", "third", true, []string{"req-2"}},
+		{"req-4", "fourth", true, []string{"req-2", "req-3"}},
+	}
+	for _, s := range submits {
+		ctx := contextWithRequestID(context.Background(), s.requestID)
+		result, err := c.submit(ctx, "blog", contentUpdate{Content: s.content})
+		if err != nil {
+			t.Fatalf("%s: %v", s.requestID, err)
+		}
+		if result.Queued != s.queued || !reflect.DeepEqual(result.Superseded, s.superseded) {
+			t.Errorf("%s: got %+v, want queued %v superseding %v", s.requestID, result, s.queued, s.superseded)
+		}
+	}
+	if !c.isPending("blog") {
+		t.Error("site has no pending update")
+	}
+
+	f.set("succeeded", nil)
+	waitFor(t, "the queued update to deploy", func() bool { return len(f.deployments()) == 2 })
+	if got, want := f.deployments(), []string{"first", "fourth"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("deployed %v, want %v", got, want)
+	}
+
+	f.set("succeeded", nil)
+	waitFor(t, "the site to be untracked", func() bool { return !c.tracked("blog") })
+}
+
+func TestCoalescerCancel(t *testing.T) {
+	captureLog(t)
+	f := &fakeSite{}
+	c := newTestCoalescer(t, f)
+
+	if got := c.cancel("blog"); got != nil {
+		t.Errorf("cancel of an untracked site returned %v", got)
+	}
+	for _, id := range []string{"req-1", "req-2", "req-3"} {
+		if _, err := c.submit(contextWithRequestID(context.Background(), id), "blog", contentUpdate{Content: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := c.cancel("blog"), []string{"req-2", "req-3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("cancel returned %v, want %v", got, want)
+	}
+	if c.isPending("blog") || c.tracked("blog") {
+		t.Error("canceled site is still tracked")
+	}
+
+	// A watcher for the canceled site doesn't deploy anything once the deployment finishes.
+	f.set("succeeded", nil)
+	time.Sleep(20 * time.Millisecond)
+	if got := f.deployments(); len(got) != 1 {
+		t.Errorf("deployed %v after cancel, want only the first update", got)
+	}
+}
+
+func TestCoalescerDeployError(t *testing.T) {
+	c := newTestCoalescer(t, &fakeSite{})
+	errDeploy := errors.New("deploy failed")
+	c.deploy = func(context.Context, string, contentUpdate) error { return errDeploy }
+
+	if _, err := c.submit(context.Background(), "blog", contentUpdate{}); !errors.Is(err, errDeploy) {
+		t.Errorf("got error %v, want %v", err, errDeploy)
+	}
+	if c.tracked("blog") {
+		t.Error("site is tracked after its deployment failed to start")
+	}
+}
+
+func TestCoalescerStopsWhenStackIsDeleted(t *testing.T) {
+	captureLog(t)
+	f := &fakeSite{}
+	c := newTestCoalescer(t, f)
+
+	c.track("blog")
+	if _, err := c.submit(context.Background(), "blog", contentUpdate{Content: "queued"}); err != nil {
+		t.Fatal(err)
+	}
+	f.set("", errStackNotFound)
+	waitFor(t, "the site to be untracked", func() bool { return !c.tracked("blog") })
+	if got := f.deployments(); len(got) != 0 {
+		t.Errorf("deployed %v to a deleted stack", got)
+	}
+}
+
+func TestIsDeploymentInProgress(t *testing.T) {
+	for status, want := range map[string]bool{
+		"not-started": true,
+		"accepted":    true,
+		"running":     true,
+		"succeeded":   false,
+		"failed":      false,
+		"":            false,
+	} {
+		if got := isDeploymentInProgress(status); got != want {
+			t.Errorf("isDeploymentInProgress(%q) = %v, want %v", status, got, want)
+		}
+	}
+}
+
+func TestCoalescerWaitsForQueuedDeployment(t *testing.T) {
+	captureLog(t)
+	f := &fakeSite{}
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	c := newTestCoalescer(t, f)
+	c.ctx = ctx
+
+	started, release := make(chan struct{}), make(chan struct{})
+	var deployErr error
+	c.deploy = func(ctx context.Context, site string, update contentUpdate) error {
+		if update.Content == "queued" {
+			close(started)
+			<-release
+			deployErr = ctx.Err()
+		}
+		return f.deploy(ctx, site, update)
+	}
+	for _, content := range []string{"first", "queued"} {
+		if _, err := c.submit(context.Background(), "blog", contentUpdate{Content: content}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.set("succeeded", nil)
+	<-started
+
+	// Stopping doesn't interrupt the queued update's deployment, and wait waits for it.
+	stop()
+	timeout, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := c.wait(timeout); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("wait returned %v while a deployment was being started", err)
+	}
+	close(release)
+	if err := c.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if deployErr != nil {
+		t.Errorf("the queued update's deployment was canceled: %v", deployErr)
+	}
+	if got := f.deployments(); !reflect.DeepEqual(got, []string{"first", "queued"}) {
+		t.Errorf("deployed %v", got)
+	}
+}
+
+func TestQueuedUpdateFailure(t *testing.T) {
+	captureLog(t)
+	var m sync.Mutex
+	posts := 0
+	client := fakePulumiClient(func(r *http.Request) (int, string) {
+		m.Lock()
+		defer m.Unlock()
+		switch {
+		case r.Method == http.MethodPost:
+			posts++
+			if posts > 1 {
+				return http.StatusInternalServerError, `{"code": 500, "message": "internal error"}`
+			}
+			return http.StatusAccepted, `{"id": "d-1"}`
+		case posts == 0 || r.URL.Query().Get("page") != "1":
+			return http.StatusOK, `[]`
+		default:
+			return http.StatusOK, `[{"version": 1, "status": "succeeded"}]`
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := &siteServer{
+		client:    client,
+		org:       "acme",
+		project:   "sites",
+		quotas:    newQuotas(quotaOptions{maxDeploymentsPerSite: 2}),
+		revisions: newRevisionStore(),
+	}
+	s.updates = newUpdateCoalescer(ctx, s)
+	s.updates.pollInterval = time.Millisecond
+
+	for _, content := range []string{"deployed", "queued"} {
+		r := httptest.NewRequest(http.MethodPost, "/sites/blog", strings.NewReader(fmt.Sprintf(`{"content": %q}`, content)))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		s.update(w, r, httprouter.Params{{Key: "id", Value: "blog"}})
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("%s: got status %v: %s", content, w.Code, w.Body)
+		}
+	}
+
+	waitFor(t, "the queued update to fail", func() bool { return len(s.revisions.list("blog")) == 2 })
+	if rev := s.revisions.list("blog")[0]; rev.Content != "queued" || rev.Status != "failed" || rev.DeploymentID != "" {
+		t.Errorf("got revision %+v, want a failed revision of the queued update", rev)
+	}
+	// Only the deployed update counts against the quota.
+	if p := s.quotas.reserveDeployment("blog"); p != nil {
+		t.Errorf("the failed update's reservation wasn't released: %v", p.Detail)
+	}
+}
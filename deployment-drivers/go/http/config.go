@@ -0,0 +1,392 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix is the prefix of the environment variables that configure the server. Each setting can be set by an
+// environment variable named after its flag, e.g. SITE_SERVER_ROLE_ARN for -role-arn.
+const envPrefix = "SITE_SERVER_"
+
+// envOverrides maps settings to environment variables that do not follow the envPrefix convention.
+var envOverrides = map[string]string{
+	"token": "PULUMI_ACCESS_TOKEN",
+}
+
+// secretSettings is the set of settings whose values are redacted when the configuration is printed.
+var secretSettings = map[string]bool{
+	"token":              true,
+	"secret-output-keys": true,
+	"api-keys":           true,
+}
+
+// config holds the site server's settings.
+type config struct {
+	// The repository, branch, and directory that hold the Pulumi program that manages each site's resources.
+	repository string
+	branch     string
+	dir        string
+
+	// The AWS region, IAM Role, and session name used for deployments.
+	region      string
+	roleARN     string
+	sessionName string
+
+	// The Pulumi API token, or a file that contains the token. If tokenFile is set, it takes precedence over token.
+	token     string
+	tokenFile string
+
+	// The org and project that will hold the stacks that back each static site.
+	org     string
+	project string
+
+	// HTTP server settings.
+	addr              string
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	shutdownTimeout   time.Duration
+	tlsCert           string
+	tlsKey            string
+
+	// The OTLP/HTTP endpoint to export traces to, if any.
+	otlpEndpoint string
+
+	// Per-client rate limits and quotas. Zero disables the corresponding limit. Clients that send one of the
+	// comma-separated API keys are identified by that key; other clients are identified by their IP address.
+	apiKeys               string
+	rateLimit             float64
+	rateBurst             int
+	maxSitesPerClient     int
+	maxDeploymentsPerSite int
+
+	// How long responses to requests with idempotency keys are kept. Zero disables idempotency keys.
+	idempotencyWindow time.Duration
+
+	// The stack outputs exposed by the "get site outputs" REST API, and the API keys that may read secret outputs. See
+	// parseOutputMapping for the format of the mapping. The keys are comma-separated.
+	outputs          string
+	secretOutputKeys string
+
+	// Where stack outputs are read from: "export" to export each stack's checkpoint, or "api" to use the Pulumi
+	// service's stack outputs API, which avoids downloading the stack's whole state.
+	outputsSource string
+}
+
+// defaultConfig returns the server's default settings.
+func defaultConfig() config {
+	return config{
+		branch:            "main",
+		region:            "us-west-2",
+		sessionName:       "site-deploy",
+		addr:              ":8080",
+		readHeaderTimeout: 10 * time.Second,
+		readTimeout:       30 * time.Second,
+		writeTimeout:      2 * time.Minute,
+		idleTimeout:       2 * time.Minute,
+		shutdownTimeout:   2 * time.Minute,
+		rateLimit:         1,
+		rateBurst:         5,
+		idempotencyWindow: 24 * time.Hour,
+		outputsSource:     outputsSourceExport,
+	}
+}
+
+// bindFlags defines a flag for each of c's settings. Each flag's default is the setting's current value.
+func (c *config) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.repository, "repo", c.repository, "the GitHub repository that contains the site's Pulumi program")
+	fs.StringVar(&c.branch, "branch", c.branch, "the git branch that contains the site's Pulumi program")
+	fs.StringVar(&c.dir, "dir", c.dir, "the subdirectory of the git repository that contains the site's Pulumi program")
+	fs.StringVar(&c.region, "region", c.region, "the AWS region to deploy to")
+	fs.StringVar(&c.roleARN, "role-arn", c.roleARN, "the AWS IAM Role ARN to use for OIDC integration")
+	fs.StringVar(&c.sessionName, "session-name", c.sessionName, "the session name to use for AWS OIDC integration")
+	fs.StringVar(&c.token, "token", c.token, "the Pulumi API token to use; prefer PULUMI_ACCESS_TOKEN or -token-file, as flags are visible to other users")
+	fs.StringVar(&c.tokenFile, "token-file", c.tokenFile, "a file that contains the Pulumi API token to use")
+	fs.StringVar(&c.org, "org", c.org, "the Pulumi organization to use")
+	fs.StringVar(&c.project, "project", c.project, "the Pulumi project to deploy")
+	fs.StringVar(&c.addr, "addr", c.addr, "the address to listen on")
+	fs.DurationVar(&c.readHeaderTimeout, "read-header-timeout", c.readHeaderTimeout, "the maximum time to read request headers")
+	fs.DurationVar(&c.readTimeout, "read-timeout", c.readTimeout, "the maximum time to read an entire request")
+	fs.DurationVar(&c.writeTimeout, "write-timeout", c.writeTimeout, "the maximum time to handle a request and write its response")
+	fs.DurationVar(&c.idleTimeout, "idle-timeout", c.idleTimeout, "the maximum time to keep an idle connection open")
+	fs.DurationVar(&c.shutdownTimeout, "shutdown-timeout", c.shutdownTimeout, "the maximum time to wait for in-flight requests to complete on shutdown")
+	fs.StringVar(&c.tlsCert, "tls-cert", c.tlsCert, "the TLS certificate file to serve HTTPS with; reloaded automatically when changed")
+	fs.StringVar(&c.tlsKey, "tls-key", c.tlsKey, "the TLS private key file to serve HTTPS with; reloaded automatically when changed")
+	fs.StringVar(&c.otlpEndpoint, "otlp-endpoint", c.otlpEndpoint, "the OTLP/HTTP endpoint to export traces to (e.g. http://localhost:4318); tracing is disabled if empty")
+	fs.StringVar(&c.apiKeys, "api-keys", c.apiKeys, "the comma-separated API keys that identify clients for rate limits and quotas; clients without one of these keys are identified by their IP address")
+	fs.Float64Var(&c.rateLimit, "rate-limit", c.rateLimit, "the sustained rate of mutating requests allowed per client, in requests per second; 0 disables rate limiting")
+	fs.IntVar(&c.rateBurst, "rate-burst", c.rateBurst, "the number of mutating requests a client may make in a burst")
+	fs.IntVar(&c.maxSitesPerClient, "max-sites-per-client", c.maxSitesPerClient, "the maximum number of sites each client may create; 0 is unlimited")
+	fs.IntVar(&c.maxDeploymentsPerSite, "max-deployments-per-site", c.maxDeploymentsPerSite, "the maximum number of deployments per site per hour; 0 is unlimited")
+	fs.DurationVar(&c.idempotencyWindow, "idempotency-window", c.idempotencyWindow, "how long to remember responses to requests with an Idempotency-Key header; 0 ignores the header")
+	fs.StringVar(&c.outputs, "outputs", c.outputs, "the comma-separated stack outputs to expose, each as output or output=field; all outputs are exposed if empty")
+	fs.StringVar(&c.secretOutputKeys, "secret-output-keys", c.secretOutputKeys, "the comma-separated API keys that may read secret stack outputs")
+	fs.StringVar(&c.outputsSource, "outputs-source", c.outputsSource, "where to read stack outputs from: export (the stack's checkpoint) or api (the Pulumi service's decrypted stack outputs API)")
+}
+
+// envVar returns the name of the environment variable for the given setting.
+func envVar(setting string) string {
+	if name, ok := envOverrides[setting]; ok {
+		return name
+	}
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(setting, "-", "_"))
+}
+
+// loadConfig loads the server's settings. Settings are layered: defaults are overridden by the config file, which is
+// overridden by environment variables, which are overridden by command line flags. The config file may be YAML or TOML;
+// its keys are the names of the command line flags.
+//
+// loadConfig returns the settings, whether the -print-config flag was passed, and any error encountered while loading
+// the settings. The settings are not validated.
+func loadConfig(args []string, getenv func(string) string) (*config, bool, error) {
+	cfg := defaultConfig()
+	fs := flag.NewFlagSet("site-server", flag.ExitOnError)
+	cfg.bindFlags(fs)
+	configFile := fs.String("config", getenv(envPrefix+"CONFIG"), "a YAML or TOML file to read settings from")
+	printConfig := fs.Bool("print-config", false, "print the effective settings with secrets redacted and exit")
+	if err := fs.Parse(args); err != nil {
+		return nil, false, err
+	}
+
+	// Record the flags that were explicitly set, then reset each setting to its default so that the lower layers can
+	// be applied beneath the flags. The bound flags are used to parse values from every layer.
+	explicit := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
+	if _, ok := explicit["token"]; ok {
+		fmt.Fprintf(os.Stderr, "warning: the Pulumi API token was passed on the command line, where it is visible to other users; use PULUMI_ACCESS_TOKEN or -token-file instead\n")
+	}
+	cfg = defaultConfig()
+
+	isSetting := func(name string) bool {
+		return name != "config" && name != "print-config" && fs.Lookup(name) != nil
+	}
+
+	if *configFile != "" {
+		values, err := readConfigFile(*configFile)
+		if err != nil {
+			return nil, false, err
+		}
+		names := make([]string, 0, len(values))
+		for name := range values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var problems []string
+		for _, name := range names {
+			if !isSetting(name) {
+				return nil, false, fmt.Errorf("%v: unknown setting %q", *configFile, name)
+			}
+			v, problem := configFileValue(name, values[name])
+			if problem != "" {
+				problems = append(problems, problem)
+				continue
+			}
+			if err := fs.Set(name, v); err != nil {
+				return nil, false, fmt.Errorf("%v: %v: %w", *configFile, name, err)
+			}
+		}
+		if len(problems) > 0 {
+			return nil, false, fmt.Errorf("%v: invalid configuration:\n  %v", *configFile, strings.Join(problems, "\n  "))
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || !isSetting(f.Name) {
+			return
+		}
+		if v := getenv(envVar(f.Name)); v != "" {
+			if setErr := fs.Set(f.Name, v); setErr != nil {
+				err = fmt.Errorf("%v: %w", envVar(f.Name), setErr)
+			}
+		}
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	for name, v := range explicit {
+		if isSetting(name) {
+			if err := fs.Set(name, v); err != nil {
+				return nil, false, fmt.Errorf("-%v: %w", name, err)
+			}
+		}
+	}
+
+	if cfg.tokenFile != "" {
+		token, err := os.ReadFile(cfg.tokenFile)
+		if err != nil {
+			return nil, false, fmt.Errorf("reading token file: %w", err)
+		}
+		cfg.token = strings.TrimSpace(string(token))
+	}
+
+	return &cfg, *printConfig, nil
+}
+
+// configFileValue returns the value of a setting read from a config file as it would be passed to the setting's flag.
+// Settings are single values, except that outputs may also be a list, whose entries are joined with commas. If the
+// value can't be converted, configFileValue returns a problem that names the setting.
+func configFileValue(name string, v interface{}) (string, string) {
+	if v == nil {
+		return "", ""
+	}
+	switch {
+	case isScalar(v):
+		return fmt.Sprint(v), ""
+	case name != "outputs":
+		return "", fmt.Sprintf("%v must be a single value, not a list or map", name)
+	}
+	list, ok := v.([]interface{})
+	entries := make([]string, len(list))
+	for i, entry := range list {
+		if !isScalar(entry) {
+			ok = false
+		}
+		entries[i] = fmt.Sprint(entry)
+	}
+	if !ok {
+		return "", fmt.Sprintf("%v must be a list of strings or a comma-separated string", name)
+	}
+	return strings.Join(entries, ","), ""
+}
+
+// isScalar returns true if v, decoded from YAML or TOML, is a single value rather than a list or map.
+func isScalar(v interface{}) bool {
+	if v == nil {
+		return false
+	}
+	switch reflect.TypeOf(v).Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return false
+	}
+	return true
+}
+
+// splitKeys splits a comma-separated list of API keys, ignoring surrounding whitespace and empty entries.
+func splitKeys(s string) []string {
+	var keys []string
+	for _, key := range strings.Split(s, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// readConfigFile reads settings from a YAML or TOML file. The format is determined by the file's extension.
+func readConfigFile(path string) (map[string]interface{}, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+
+	values := map[string]interface{}{}
+	switch ext := filepath.Ext(path); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(contents, &values)
+	case ".toml":
+		err = toml.Unmarshal(contents, &values)
+	default:
+		return nil, fmt.Errorf("config file %v must have a .yaml, .yml, or .toml extension", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing config file: %w", err)
+	}
+	return values, nil
+}
+
+// validate checks that c's settings are complete and consistent. All problems are reported at once.
+func (c *config) validate() error {
+	var problems []string
+	required := func(value, setting string) {
+		if value == "" {
+			problems = append(problems, fmt.Sprintf("%v is required (set -%v or %v)", setting, setting, envVar(setting)))
+		}
+	}
+	positive := func(value time.Duration, setting string) {
+		if value <= 0 {
+			problems = append(problems, fmt.Sprintf("%v must be positive", setting))
+		}
+	}
+
+	required(c.repository, "repo")
+	required(c.roleARN, "role-arn")
+	required(c.project, "project")
+	if c.token == "" {
+		problems = append(problems, "a Pulumi API token is required (set PULUMI_ACCESS_TOKEN or -token-file)")
+	}
+	positive(c.readHeaderTimeout, "read-header-timeout")
+	positive(c.readTimeout, "read-timeout")
+	positive(c.writeTimeout, "write-timeout")
+	positive(c.idleTimeout, "idle-timeout")
+	positive(c.shutdownTimeout, "shutdown-timeout")
+	if (c.tlsCert == "") != (c.tlsKey == "") {
+		problems = append(problems, "tls-cert and tls-key must be set together")
+	}
+	if c.rateLimit < 0 {
+		problems = append(problems, "rate-limit must not be negative")
+	}
+	if c.rateLimit > 0 && c.rateBurst < 1 {
+		problems = append(problems, "rate-burst must be at least 1 when rate-limit is set")
+	}
+	if c.maxSitesPerClient < 0 {
+		problems = append(problems, "max-sites-per-client must not be negative")
+	}
+	if c.maxDeploymentsPerSite < 0 {
+		problems = append(problems, "max-deployments-per-site must not be negative")
+	}
+	if c.idempotencyWindow < 0 {
+		problems = append(problems, "idempotency-window must not be negative")
+	}
+	if _, err := parseOutputMapping(c.outputs); err != nil {
+		problems = append(problems, fmt.Sprintf("outputs: %v", err))
+	}
+	if c.outputsSource != outputsSourceExport && c.outputsSource != outputsSourceAPI {
+		problems = append(problems, fmt.Sprintf("outputs-source must be %s or %s", outputsSourceExport, outputsSourceAPI))
+	}
+	if c.otlpEndpoint != "" {
+		if u, err := url.Parse(c.otlpEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			problems = append(problems, "otlp-endpoint must be an http or https URL")
+		}
+	}
+
+	if len(problems) != 0 {
+		return errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// print writes c's settings to w as YAML, redacting secret values.
+func (c *config) print(w io.Writer) error {
+	// Bind a new flag set to a copy of the settings so that each setting can be formatted by its flag.
+	snapshot := *c
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	snapshot.bindFlags(fs)
+
+	values := map[string]string{}
+	fs.VisitAll(func(f *flag.Flag) {
+		v := f.Value.String()
+		if secretSettings[f.Name] && v != "" {
+			v = "[redacted]"
+		}
+		values[f.Name] = v
+	})
+	return yaml.NewEncoder(w).Encode(values)
+}
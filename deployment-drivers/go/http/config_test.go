@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mapEnv returns a getenv function that reads from env.
+func mapEnv(env map[string]string) func(string) string {
+	return func(name string) string { return env[name] }
+}
+
+func TestLoadConfigLayers(t *testing.T) {
+	dir := t.TempDir()
+	yamlFile := filepath.Join(dir, "site-server.yaml")
+	if err := os.WriteFile(yamlFile, []byte("repo: file/repo\nbranch: file-branch\nregion: eu-west-1\nrate-limit: 2.5\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tomlFile := filepath.Join(dir, "site-server.toml")
+	if err := os.WriteFile(tomlFile, []byte("repo = \"toml/repo\"\nread-timeout = \"45s\"\noutputs = [\"websiteUrl\", \"cdn=cdnUrl\"]\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	outputsFile := filepath.Join(dir, "outputs.yaml")
+	if err := os.WriteFile(outputsFile, []byte("outputs:\n  - websiteUrl\n  - cdn=cdnUrl\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		args  []string
+		env   map[string]string
+		check func(*config) string
+	}{
+		{
+			name: "defaults",
+			check: func(c *config) string {
+				if c.branch != "main" || c.addr != ":8080" || c.rateLimit != 1 {
+					return "defaults not applied"
+				}
+				return ""
+			},
+		},
+		{
+			name: "file over defaults",
+			args: []string{"-config", yamlFile},
+			check: func(c *config) string {
+				if c.repository != "file/repo" || c.region != "eu-west-1" || c.rateLimit != 2.5 || c.addr != ":8080" {
+					return "file settings not applied"
+				}
+				return ""
+			},
+		},
+		{
+			name: "toml file",
+			env:  map[string]string{"SITE_SERVER_CONFIG": tomlFile},
+			check: func(c *config) string {
+				if c.repository != "toml/repo" || c.readTimeout != 45*time.Second || c.outputs != "websiteUrl,cdn=cdnUrl" {
+					return "TOML settings not applied"
+				}
+				return ""
+			},
+		},
+		{
+			name: "outputs list",
+			args: []string{"-config", outputsFile},
+			check: func(c *config) string {
+				if c.outputs != "websiteUrl,cdn=cdnUrl" {
+					return "outputs list not joined"
+				}
+				return ""
+			},
+		},
+		{
+			name: "environment over file",
+			args: []string{"-config", yamlFile},
+			env:  map[string]string{"SITE_SERVER_BRANCH": "env-branch", "PULUMI_ACCESS_TOKEN": "env-token"},
+			check: func(c *config) string {
+				if c.branch != "env-branch" || c.repository != "file/repo" || c.token != "env-token" {
+					return "environment settings not applied"
+				}
+				return ""
+			},
+		},
+		{
+			name: "flags over environment",
+			args: []string{"-config", yamlFile, "-branch", "flag-branch"},
+			env:  map[string]string{"SITE_SERVER_BRANCH": "env-branch"},
+			check: func(c *config) string {
+				if c.branch != "flag-branch" {
+					return "flag not applied over the environment"
+				}
+				return ""
+			},
+		},
+	}
+	for _, tt := range tests {
+		cfg, _, err := loadConfig(tt.args, mapEnv(tt.env))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if msg := tt.check(cfg); msg != "" {
+			t.Errorf("%s: %s: %+v", tt.name, msg, *cfg)
+		}
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	unknown := filepath.Join(dir, "unknown.yaml")
+	if err := os.WriteFile(unknown, []byte("colour: blue\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	list := filepath.Join(dir, "list.yaml")
+	if err := os.WriteFile(list, []byte("branch: [a, b]\nregion:\n  name: us-west-2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tomlTable := filepath.Join(dir, "table.toml")
+	if err := os.WriteFile(tomlTable, []byte("[outputs]\nwebsiteUrl = \"url\"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	nested := filepath.Join(dir, "nested.yaml")
+	if err := os.WriteFile(nested, []byte("outputs:\n  - [websiteUrl]\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	json := filepath.Join(dir, "settings.json")
+	if err := os.WriteFile(json, []byte("{}"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		want string
+	}{
+		{"unknown setting", []string{"-config", unknown}, nil, `unknown setting "colour"`},
+		{"list value", []string{"-config", list}, nil, "branch must be a single value, not a list or map\n  region must be a single value"},
+		{"map value", []string{"-config", tomlTable}, nil, "outputs must be a list of strings or a comma-separated string"},
+		{"nested outputs list", []string{"-config", nested}, nil, "outputs must be a list of strings or a comma-separated string"},
+		{"unsupported extension", []string{"-config", json}, nil, "must have a .yaml, .yml, or .toml extension"},
+		{"invalid environment value", nil, map[string]string{"SITE_SERVER_RATE_BURST": "many"}, "SITE_SERVER_RATE_BURST"},
+		{"missing token file", []string{"-token-file", filepath.Join(dir, "missing")}, nil, "reading token file"},
+	}
+	for _, tt := range tests {
+		_, _, err := loadConfig(tt.args, mapEnv(tt.env))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got error %v, want one containing %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigTokenFile(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("file-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, _, err := loadConfig([]string{"-token-file", tokenFile}, mapEnv(map[string]string{"PULUMI_ACCESS_TOKEN": "env-token"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.token != "file-token" {
+		t.Errorf("got token %q, want the token file's contents", cfg.token)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	valid := func() config {
+		c := defaultConfig()
+		c.repository, c.roleARN, c.project, c.token = "acme/site", "arn:aws:iam::1:role/deploy", "sites", "token"
+		return c
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*config)
+		want   []string
+	}{
+		{"valid", func(*config) {}, nil},
+		{"missing settings", func(c *config) { c.repository, c.token = "", "" }, []string{"repo is required", "a Pulumi API token is required"}},
+		{"tls pair", func(c *config) { c.tlsCert = "cert.pem" }, []string{"tls-cert and tls-key must be set together"}},
+		{"timeouts", func(c *config) { c.readTimeout = 0 }, []string{"read-timeout must be positive"}},
+		{"rate burst", func(c *config) { c.rateBurst = 0 }, []string{"rate-burst must be at least 1"}},
+		{"outputs source", func(c *config) { c.outputsSource = "s3" }, []string{"outputs-source must be export or api"}},
+		{"otlp endpoint", func(c *config) { c.otlpEndpoint = "localhost:4318" }, []string{"otlp-endpoint must be an http or https URL"}},
+	}
+	for _, tt := range tests {
+		c := valid()
+		tt.modify(&c)
+		err := c.validate()
+		if len(tt.want) == 0 {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		for _, want := range tt.want {
+			if err == nil || !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: got error %v, want one containing %q", tt.name, err, want)
+			}
+		}
+	}
+}
+
+func TestConfigPrintRedactsSecrets(t *testing.T) {
+	c := defaultConfig()
+	c.token, c.secretOutputKeys, c.apiKeys, c.repository = "pul-secret", "key-1,key-2", "client-key", "acme/site"
+
+	var buf bytes.Buffer
+	if err := c.print(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, secret := range []string{"pul-secret", "key-1", "client-key"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("printed config contains %q:\n%s", secret, out)
+		}
+	}
+	if !strings.Contains(out, "repo: acme/site") || !strings.Contains(out, "token: '[redacted]'") {
+		t.Errorf("printed config is missing settings:\n%s", out)
+	}
+}
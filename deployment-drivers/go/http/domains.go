@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// domainTagName is the name of the stack tag that records a site's custom domain. Tags are stored by the Pulumi
+	// service, so claims on domains survive server restarts and are shared between replicas.
+	domainTagName = "siteDomain"
+
+	// The environment variables that pass a site's custom domain and its verification status to the Pulumi program.
+	envSiteDomain         = "SITE_DOMAIN"
+	envSiteDomainVerified = "SITE_DOMAIN_VERIFIED"
+
+	// maxDomainLength is the maximum length of a DNS name.
+	maxDomainLength = 253
+
+	// dnsLookupTimeout bounds the DNS lookup that checks a domain's validation record.
+	dnsLookupTimeout = 5 * time.Second
+)
+
+// The statuses of a site's custom domain.
+const (
+	// The domain's owner must create the validation record for the domain's TLS certificate.
+	domainPendingValidation = "PENDING_VALIDATION"
+	// The domain has been verified. The domain will be activated by the site's next deployment.
+	domainValidated = "VALIDATED"
+	// The validation record exists and a deployment that activates the domain is in progress.
+	domainProvisioning = "PROVISIONING"
+	// The site is served over HTTPS at the domain.
+	domainActive = "ACTIVE"
+)
+
+// domainLabelPattern matches a single label of a DNS name.
+var domainLabelPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// dnsRecord describes a DNS record.
+type dnsRecord struct {
+	// The record's name.
+	Name string `json:"name"`
+	// The record's type, e.g. "CNAME".
+	Type string `json:"type"`
+	// The record's value.
+	Value string `json:"value"`
+}
+
+// siteDomain describes a site's custom domain.
+type siteDomain struct {
+	// The domain name.
+	Name string `json:"name"`
+	// The status of the domain. One of PENDING_VALIDATION, VALIDATED, PROVISIONING, or ACTIVE.
+	Status string `json:"status"`
+	// The DNS record that the domain's owner must create to validate the domain's TLS certificate, once known.
+	ValidationRecord *dnsRecord `json:"validationRecord,omitempty"`
+	// The host name that the domain must be a CNAME for, once the domain is active.
+	Target string `json:"target,omitempty"`
+}
+
+// normalizeDomain returns the canonical form of a domain name: lower case, without a trailing period.
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
+
+// validateDomain checks that domain is a usable custom domain. The domain must be normalized.
+func validateDomain(domain string) *invalidParam {
+	if domain == "" {
+		return nil
+	}
+
+	var reason string
+	labels := strings.Split(domain, ".")
+	switch {
+	case len(domain) > maxDomainLength:
+		reason = fmt.Sprintf("must be at most %v characters", maxDomainLength)
+	case len(labels) < 2:
+		reason = "must be a fully-qualified domain name"
+	default:
+		for _, label := range labels {
+			if !domainLabelPattern.MatchString(label) {
+				reason = fmt.Sprintf("label '%s' must be 1-63 alphanumerics or hyphens and may not start or end with a hyphen", label)
+				break
+			}
+		}
+		if reason == "" {
+			return nil
+		}
+	}
+	return &invalidParam{Name: "domain", Reason: reason}
+}
+
+// domainRegistry tracks claims on custom domains and the verification of each site's domain.
+type domainRegistry struct {
+	// lookupCNAME returns the canonical name of a host.
+	lookupCNAME func(ctx context.Context, host string) (string, error)
+
+	m sync.Mutex
+	// The domains claimed by sites that are being created, by domain.
+	claiming map[string]string
+	// The sites whose domains have been verified by this server.
+	verified map[string]bool
+}
+
+func newDomainRegistry() *domainRegistry {
+	return &domainRegistry{
+		lookupCNAME: net.DefaultResolver.LookupCNAME,
+		claiming:    map[string]string{},
+		verified:    map[string]bool{},
+	}
+}
+
+// claimDomain claims a custom domain for a site that is being created. If the domain is claimed by another site,
+// claimDomain returns a problem. Otherwise, the returned function must be called once the site's stack has been
+// created and tagged with the domain, or has failed to be created.
+func (s *siteServer) claimDomain(ctx context.Context, site, domain string) (func(), *problem, error) {
+	claimed := func(other string) *problem {
+		return &problem{
+			Title:  "Domain already claimed.",
+			Status: http.StatusConflict,
+			Detail: fmt.Sprintf("domain '%s' is already used by site '%s'", domain, other),
+			Code:   codeDomainClaimed,
+		}
+	}
+
+	d := s.domains
+	d.m.Lock()
+	if other, ok := d.claiming[domain]; ok && other != site {
+		d.m.Unlock()
+		return nil, claimed(other), nil
+	}
+	d.claiming[domain] = site
+	d.m.Unlock()
+
+	release := func() {
+		d.m.Lock()
+		defer d.m.Unlock()
+		if d.claiming[domain] == site {
+			delete(d.claiming, domain)
+		}
+	}
+
+	stacks, err := s.client.listStacksWithTag(ctx, s.org, s.project, domainTagName, domain)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	for _, other := range stacks {
+		if other != site {
+			release()
+			return nil, claimed(other), nil
+		}
+	}
+	return release, nil, nil
+}
+
+// forget discards what the registry knows about a site.
+func (d *domainRegistry) forget(site string) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	delete(d.verified, site)
+}
+
+// isVerified returns true if the server has verified a site's domain.
+func (d *domainRegistry) isVerified(site string) bool {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	return d.verified[site]
+}
+
+// checkValidationRecord returns true if the given validation record exists in DNS.
+func (d *domainRegistry) checkValidationRecord(ctx context.Context, record *dnsRecord) bool {
+	if !strings.EqualFold(record.Type, "CNAME") {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dnsLookupTimeout)
+	defer cancel()
+
+	cname, err := d.lookupCNAME(ctx, record.Name)
+	if err != nil {
+		return false
+	}
+	return normalizeDomain(cname) == normalizeDomain(record.Value)
+}
+
+// operationContext returns the operation context for a site's deployments.
+func (s *siteServer) operationContext(domain string, domainVerified bool) *operationContext {
+	env := map[string]string{
+		"AWS_REGION": s.region,
+	}
+	if domain != "" {
+		env[envSiteDomain] = domain
+		if domainVerified {
+			env[envSiteDomainVerified] = "true"
+		}
+	}
+	return &operationContext{
+		Environment: env,
+		OIDC: &oidcContext{
+			AWS: &awsOIDCContext{
+				RoleARN:     s.roleARN,
+				SessionName: s.sessionName,
+			},
+		},
+	}
+}
+
+// getDomain determines the status of a site's custom domain from the site's stack outputs and whether the server has
+// verified the domain. getDomain returns nil if the site has no custom domain.
+func (s *siteServer) getDomain(site string, outputs map[string]interface{}, deploying bool) *siteDomain {
+	name, _ := outputs["customDomain"].(string)
+	if name == "" {
+		return nil
+	}
+	domain := &siteDomain{Name: name}
+
+	if target, _ := outputs["customDomainTarget"].(string); target != "" {
+		domain.Status, domain.Target = domainActive, target
+		return domain
+	}
+
+	if record, ok := outputs["domainValidationRecord"].(map[string]interface{}); ok {
+		domain.ValidationRecord = &dnsRecord{}
+		domain.ValidationRecord.Name, _ = record["name"].(string)
+		domain.ValidationRecord.Type, _ = record["type"].(string)
+		domain.ValidationRecord.Value, _ = record["value"].(string)
+	}
+
+	switch {
+	case !s.domains.isVerified(site):
+		domain.Status = domainPendingValidation
+	case deploying:
+		domain.Status = domainProvisioning
+	default:
+		domain.Status = domainValidated
+	}
+	return domain
+}
+
+// verifyDomain implements the "verify site domain" REST API. If the validation record of the site's custom domain
+// exists, verifyDomain records that the domain has been validated, so that the site's deployments serve the domain,
+// and redeploys the site's latest revision if it is known. The response describes the domain.
+func (s *siteServer) verifyDomain(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	id := params.ByName("id")
+	if p := validateParams(validateSiteID(id)); p != nil {
+		p.write(w, r)
+		return
+	}
+
+	outputs, err := s.client.getStackOutputs(r.Context(), s.org, s.project, id)
+	if err != nil {
+		if err == errStackNotFound {
+			siteNotFound(w, r, id)
+		} else {
+			serverError(w, r, fmt.Errorf("getting stack outputs: %w", err))
+		}
+		return
+	}
+
+	domain := s.getDomain(id, outputs, false)
+	if domain == nil {
+		p := problem{
+			Title:  "Domain not found.",
+			Status: http.StatusNotFound,
+			Detail: fmt.Sprintf("site '%s' has no custom domain", id),
+			Code:   codeDomainNotFound,
+		}
+		p.write(w, r)
+		return
+	}
+	if domain.Status == domainPendingValidation {
+		if record := domain.ValidationRecord; record == nil || !s.domains.checkValidationRecord(r.Context(), record) {
+			detail := fmt.Sprintf("the validation record for domain '%s' is not known yet; retry once the site's "+
+				"deployment finishes", domain.Name)
+			if record != nil {
+				detail = fmt.Sprintf("create a %s record named '%s' with the value '%s', then retry", record.Type,
+					record.Name, record.Value)
+			}
+			p := problem{
+				Title:     "Domain not validated.",
+				Status:    http.StatusConflict,
+				Detail:    detail,
+				Code:      codeDomainNotValidated,
+				Retryable: true,
+			}
+			p.write(w, r)
+			return
+		}
+
+		deploying, p, err := s.activateDomain(r.Context(), id, domain.Name)
+		switch {
+		case p != nil:
+			p.write(w, r)
+			return
+		case err != nil:
+			serverError(w, r, fmt.Errorf("verifying domain: %w", err))
+			return
+		}
+		domain.Status = domainValidated
+		if deploying {
+			domain.Status = domainProvisioning
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(domain); err != nil {
+		logf(r.Context(), "encoding response: %v", err)
+	}
+}
+
+// activateDomain records that a site's custom domain has been validated, so that the site's deployments serve the
+// domain, and redeploys the site's latest successfully deployed revision if it is known. As for rollback, a revision
+// that failed or is still deploying is never redeployed. The redeployment counts against the site's deployment quota;
+// if the quota is exhausted, activateDomain returns a problem and leaves the domain unverified. activateDomain returns
+// true if it started or queued a deployment.
+func (s *siteServer) activateDomain(ctx context.Context, site, domain string) (bool, *problem, error) {
+	latest, redeploy, err := s.latestDeployedRevision(ctx, site)
+	if err != nil {
+		return false, nil, err
+	}
+	if redeploy {
+		if p := s.quotas.reserveDeployment(site); p != nil {
+			return false, p, nil
+		}
+	}
+
+	err = s.client.patchDeploymentSettings(ctx, s.org, s.project, site, DeploymentSettings{
+		OperationContext: s.operationContext(domain, true),
+	})
+	if err != nil {
+		if redeploy {
+			s.quotas.releaseDeployment(site)
+		}
+		return false, nil, fmt.Errorf("patching deployment settings: %w", err)
+	}
+
+	s.domains.m.Lock()
+	s.domains.verified[site] = true
+	s.domains.m.Unlock()
+	logf(ctx, "verified domain '%s' for site '%s'", domain, site)
+
+	if !redeploy {
+		logf(ctx, "no deployed content of site '%s' is known; domain '%s' will be activated by the site's next update",
+			site, domain)
+		return false, nil, nil
+	}
+	update := contentUpdate{Content: latest.Content, Author: latest.Author}
+	result, err := s.updates.submit(ctx, site, update)
+	if err != nil || len(result.Superseded) != 0 {
+		s.quotas.releaseDeployment(site)
+	}
+	if err != nil {
+		return false, nil, fmt.Errorf("starting deployment: %w", err)
+	}
+	observedSites.set(site, "DEPLOYING")
+	return true, nil, nil
+}
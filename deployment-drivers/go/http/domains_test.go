@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestValidateDomain(t *testing.T) {
+	tests := []struct {
+		domain string
+		valid  bool
+	}{
+		{"", true},
+		{"hello.example.com", true},
+		{"xn--bcher-kva.example", true},
+		{"localhost", false},
+		{"-hello.example.com", false},
+		{"hello_world.example.com", false},
+		{"hello..example.com", false},
+		{strings.Repeat("a", 64) + ".example.com", false},
+		{strings.Repeat("abcdefghi.", 26) + "com", false},
+	}
+	for _, tt := range tests {
+		if got := validateDomain(tt.domain) == nil; got != tt.valid {
+			t.Errorf("validateDomain(%q): got valid %v, want %v", tt.domain, got, tt.valid)
+		}
+	}
+}
+
+// validationRecordOutput is the validation record output by a site's stack before its domain is active.
+var validationRecordOutput = map[string]interface{}{
+	"name":  "_1234.hello.example.com.",
+	"type":  "CNAME",
+	"value": "_5678.acm-validations.aws.",
+}
+
+func TestGetDomain(t *testing.T) {
+	pending := map[string]interface{}{"customDomain": "hello.example.com", "domainValidationRecord": validationRecordOutput}
+	tests := []struct {
+		name      string
+		outputs   map[string]interface{}
+		verified  bool
+		deploying bool
+		want      string
+	}{
+		{"no domain", map[string]interface{}{"websiteUrl": "http://bucket"}, false, false, ""},
+		{"unverified", pending, false, false, domainPendingValidation},
+		{"unverified while deploying", pending, false, true, domainPendingValidation},
+		{"verified", pending, true, false, domainValidated},
+		{"verified while deploying", pending, true, true, domainProvisioning},
+		{"active", map[string]interface{}{"customDomain": "hello.example.com", "customDomainTarget": "d1.cloudfront.net"}, false, false, domainActive},
+	}
+	for _, tt := range tests {
+		s := &siteServer{domains: newDomainRegistry()}
+		if tt.verified {
+			s.domains.verified["hello"] = true
+		}
+		got := s.getDomain("hello", tt.outputs, tt.deploying)
+		switch {
+		case tt.want == "" && got != nil:
+			t.Errorf("%s: got domain %+v, want none", tt.name, got)
+		case tt.want != "" && (got == nil || got.Status != tt.want):
+			t.Errorf("%s: got domain %+v, want status %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCheckValidationRecord(t *testing.T) {
+	tests := []struct {
+		name   string
+		record dnsRecord
+		cname  string
+		err    error
+		want   bool
+	}{
+		{"matches", dnsRecord{Name: "_1234.hello.example.com.", Type: "CNAME", Value: "_5678.acm-validations.aws."}, "_5678.ACM-validations.aws", nil, true},
+		{"different value", dnsRecord{Name: "_1234.hello.example.com.", Type: "CNAME", Value: "_5678.acm-validations.aws."}, "other.example.com.", nil, false},
+		{"lookup fails", dnsRecord{Name: "_1234.hello.example.com.", Type: "CNAME", Value: "_5678.acm-validations.aws."}, "", errors.New("no such host"), false},
+		{"not a CNAME", dnsRecord{Name: "hello.example.com", Type: "TXT", Value: "token"}, "token", nil, false},
+	}
+	for _, tt := range tests {
+		d := newDomainRegistry()
+		d.lookupCNAME = func(ctx context.Context, host string) (string, error) {
+			if host != tt.record.Name {
+				t.Errorf("%s: looked up %q, want %q", tt.name, host, tt.record.Name)
+			}
+			return tt.cname, tt.err
+		}
+		if got := d.checkValidationRecord(context.Background(), &tt.record); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// domainTestServer is a site server whose Pulumi API serves a single site, "hello", with the given outputs and records
+// the mutating calls made to it.
+type domainTestServer struct {
+	*siteServer
+
+	m     sync.Mutex
+	calls []string
+}
+
+func newDomainTestServer(t *testing.T, outputs map[string]interface{}, cname string) *domainTestServer {
+	ts := &domainTestServer{}
+	client := fakePulumiClient(func(r *http.Request) (int, string) {
+		switch {
+		case r.Method != http.MethodGet:
+			ts.m.Lock()
+			ts.calls = append(ts.calls, r.Method+" "+r.URL.Path)
+			ts.m.Unlock()
+			if strings.HasSuffix(r.URL.Path, "/settings") {
+				return http.StatusOK, `{}`
+			}
+			return http.StatusAccepted, `{"id": "d-new"}`
+		case strings.HasSuffix(r.URL.Path, "/export"):
+			deployment, _ := json.Marshal(map[string]interface{}{
+				"resources": []interface{}{map[string]interface{}{"type": stackResourceType, "outputs": outputs}},
+			})
+			return http.StatusOK, `{"version": 3, "deployment": ` + string(deployment) + `}`
+		default:
+			return http.StatusOK, `[]`
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	ts.siteServer = &siteServer{
+		client:    client,
+		org:       "acme",
+		project:   "sites",
+		quotas:    newQuotas(quotaOptions{maxDeploymentsPerSite: 1}),
+		revisions: newRevisionStore(),
+		domains:   newDomainRegistry(),
+	}
+	ts.updates = newUpdateCoalescer(ctx, ts.siteServer)
+	ts.domains.lookupCNAME = func(ctx context.Context, host string) (string, error) {
+		if cname == "" {
+			return "", errors.New("no such host")
+		}
+		return cname, nil
+	}
+	return ts
+}
+
+// mutatingCalls returns the mutating Pulumi API calls made so far.
+func (ts *domainTestServer) mutatingCalls() []string {
+	ts.m.Lock()
+	defer ts.m.Unlock()
+	return append([]string(nil), ts.calls...)
+}
+
+func TestGetSiteDoesNotVerifyDomain(t *testing.T) {
+	captureLog(t)
+	outputs := map[string]interface{}{"customDomain": "hello.example.com", "domainValidationRecord": validationRecordOutput}
+	ts := newDomainTestServer(t, outputs, "_5678.acm-validations.aws.")
+	ts.revisions.add("hello", revision{Content: "hello", Status: "succeeded"})
+
+	w := httptest.NewRecorder()
+	ts.get(w, httptest.NewRequest(http.MethodGet, "/sites/hello", nil), httprouter.Params{{Key: "id", Value: "hello"}})
+
+	var resp getSiteResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	if resp.Domain == nil || resp.Domain.Status != domainPendingValidation {
+		t.Errorf("got domain %+v, want a domain pending validation", resp.Domain)
+	}
+	if calls := ts.mutatingCalls(); len(calls) != 0 {
+		t.Errorf("GET made mutating Pulumi API calls: %v", calls)
+	}
+	if ts.domains.isVerified("hello") {
+		t.Error("GET verified the domain")
+	}
+}
+
+func TestVerifyDomain(t *testing.T) {
+	deployed := []string{"succeeded"}
+	pending := map[string]interface{}{"customDomain": "hello.example.com", "domainValidationRecord": validationRecordOutput}
+	tests := []struct {
+		name      string
+		outputs   map[string]interface{}
+		cname     string
+		revisions []string
+		verified  bool
+		status    int
+		code      string
+		domain    string
+		wantCalls int
+	}{
+		{"no domain", map[string]interface{}{}, "", deployed, false, http.StatusNotFound, codeDomainNotFound, "", 0},
+		{"record missing", pending, "", deployed, false, http.StatusConflict, codeDomainNotValidated, "", 0},
+		{"record unknown", map[string]interface{}{"customDomain": "hello.example.com"}, "_5678.acm-validations.aws.", deployed, false, http.StatusConflict, codeDomainNotValidated, "", 0},
+		{"verified and redeployed", pending, "_5678.acm-validations.aws.", deployed, false, http.StatusOK, "", domainProvisioning, 2},
+		{"verified without content", pending, "_5678.acm-validations.aws.", nil, false, http.StatusOK, "", domainValidated, 1},
+		{"latest revision failed", pending, "_5678.acm-validations.aws.", []string{"succeeded", "failed"}, false, http.StatusOK, "", domainProvisioning, 2},
+		{"no revision succeeded", pending, "_5678.acm-validations.aws.", []string{"failed", "failed"}, false, http.StatusOK, "", domainValidated, 1},
+		{"already verified", pending, "_5678.acm-validations.aws.", deployed, true, http.StatusOK, "", domainValidated, 0},
+		{"already active", map[string]interface{}{"customDomain": "hello.example.com", "customDomainTarget": "d1.cloudfront.net"}, "", deployed, false, http.StatusOK, "", domainActive, 0},
+	}
+	captureLog(t)
+
+	for _, tt := range tests {
+		ts := newDomainTestServer(t, tt.outputs, tt.cname)
+		for _, status := range tt.revisions {
+			ts.revisions.add("hello", revision{Content: status, Status: status})
+		}
+		if tt.verified {
+			ts.domains.verified["hello"] = true
+		}
+
+		w := httptest.NewRecorder()
+		ts.verifyDomain(w, httptest.NewRequest(http.MethodPost, "/sites/hello/domain/verify", nil), httprouter.Params{{Key: "id", Value: "hello"}})
+
+		if w.Code != tt.status {
+			t.Errorf("%s: got status %v, want %v: %s", tt.name, w.Code, tt.status, w.Body)
+			continue
+		}
+		if tt.code != "" && !strings.Contains(w.Body.String(), `"code":"`+tt.code+`"`) {
+			t.Errorf("%s: body %s doesn't have code %v", tt.name, w.Body, tt.code)
+		}
+		if tt.domain != "" {
+			var domain siteDomain
+			if err := json.Unmarshal(w.Body.Bytes(), &domain); err != nil || domain.Status != tt.domain {
+				t.Errorf("%s: got domain %s, want status %v", tt.name, w.Body, tt.domain)
+			}
+		}
+		if calls := ts.mutatingCalls(); len(calls) != tt.wantCalls {
+			t.Errorf("%s: got Pulumi API calls %v, want %v", tt.name, calls, tt.wantCalls)
+		}
+		// Only a successfully deployed revision is redeployed.
+		if latest := ts.revisions.list("hello"); tt.domain == domainProvisioning && latest[0].Content != "succeeded" {
+			t.Errorf("%s: redeployed revision %+v", tt.name, latest[0])
+		}
+	}
+}
+
+func TestVerifyDomainRespectsDeploymentQuota(t *testing.T) {
+	captureLog(t)
+	outputs := map[string]interface{}{"customDomain": "hello.example.com", "domainValidationRecord": validationRecordOutput}
+	ts := newDomainTestServer(t, outputs, "_5678.acm-validations.aws.")
+	ts.revisions.add("hello", revision{Content: "hello", Status: "succeeded"})
+	if p := ts.quotas.reserveDeployment("hello"); p != nil {
+		t.Fatal(p.Detail)
+	}
+
+	w := httptest.NewRecorder()
+	ts.verifyDomain(w, httptest.NewRequest(http.MethodPost, "/sites/hello/domain/verify", nil), httprouter.Params{{Key: "id", Value: "hello"}})
+	if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), codeQuotaExceeded) {
+		t.Errorf("got %v %s, want a quota problem", w.Code, w.Body)
+	}
+	if calls := ts.mutatingCalls(); len(calls) != 0 || ts.domains.isVerified("hello") {
+		t.Errorf("domain was verified despite the quota: %v", calls)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// readinessTimeout bounds the Pulumi API call made by the readiness check.
+const readinessTimeout = 5 * time.Second
+
+// healthResponse defines the body of a response from the health check REST APIs.
+type healthResponse struct {
+	// "ok" if the check passed.
+	Status string `json:"status"`
+}
+
+// healthz implements the liveness check. The server is live as long as it is able to serve requests.
+func (s *siteServer) healthz(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&healthResponse{Status: "ok"}); err != nil {
+		logf(r.Context(), "encoding response: %v", err)
+	}
+}
+
+// readyz implements the readiness check. The server is ready if its Pulumi API token is valid, which is checked by
+// fetching the token's identity.
+func (s *siteServer) readyz(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	if _, err := s.client.getCurrentUser(ctx); err != nil {
+		logf(r.Context(), "readiness check failed: %v", err)
+		p := problem{
+			Title:     "Not ready.",
+			Status:    http.StatusServiceUnavailable,
+			Detail:    fmt.Sprintf("checking Pulumi API token: %v", err),
+			Code:      codeNotReady,
+			Retryable: true,
+		}
+		p.write(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&healthResponse{Status: "ok"}); err != nil {
+		logf(r.Context(), "encoding response: %v", err)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// idempotencyKeyHeader is the header that carries a client-chosen key identifying a mutating request, so that
+	// retries of the request are not applied twice.
+	idempotencyKeyHeader = "Idempotency-Key"
+
+	// idempotentReplayedHeader is set on responses that were replayed from an earlier request with the same key.
+	idempotentReplayedHeader = "Idempotent-Replayed"
+
+	// maxIdempotencyKeyLength is the maximum length of an idempotency key.
+	maxIdempotencyKeyLength = 255
+
+	// idempotencyPruneInterval is the minimum time between sweeps for expired idempotency records.
+	idempotencyPruneInterval = time.Minute
+)
+
+// idempotencyRecord records a request made with an idempotency key and, once it completes, its response.
+type idempotencyRecord struct {
+	// A hash of the request's method, path, and body.
+	requestHash [sha256.Size]byte
+	// True once the response has been recorded.
+	done bool
+	// When the record expires. Only set once the response has been recorded.
+	expires time.Time
+
+	// The recorded response.
+	status int
+	header http.Header
+	body   []byte
+}
+
+// idempotencyStore records the responses to requests made with an Idempotency-Key header so that retries can be
+// answered with the original response. Keys are scoped to the client that sent them.
+//
+// A retry that arrives after the server restarts, or that reaches a different replica, is handled as a new request.
+type idempotencyStore struct {
+	// How long responses are kept. Zero disables idempotency key support.
+	window time.Duration
+
+	m         sync.Mutex
+	records   map[string]*idempotencyRecord
+	lastPrune time.Time
+}
+
+func newIdempotencyStore(window time.Duration) *idempotencyStore {
+	return &idempotencyStore{
+		window:    window,
+		records:   map[string]*idempotencyRecord{},
+		lastPrune: time.Now(),
+	}
+}
+
+// responseRecorder passes a response through to the client while recording it.
+type responseRecorder struct {
+	http.ResponseWriter
+
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status, r.header = status, r.Header().Clone()
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// isReplayable returns true if a response with the given status should be replayed to retries. Responses that
+// indicate a transient failure are not recorded, so that retries are attempted again.
+func isReplayable(status int) bool {
+	return status != http.StatusTooManyRequests && status < http.StatusInternalServerError
+}
+
+// isValidIdempotencyKey returns true if key is a non-empty string of printable ASCII characters of reasonable length.
+func isValidIdempotencyKey(key string) bool {
+	if len(key) > maxIdempotencyKeyLength {
+		return false
+	}
+	return isValidRequestID(key)
+}
+
+// idempotent wraps h so that requests with an Idempotency-Key header are applied at most once within the store's
+// window. A retry with the same key and the same method, path, and body receives the original response. A request
+// that reuses a key with a different body, or that arrives while the original request is still in progress, fails.
+func (s *idempotencyStore) idempotent(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" || s.window <= 0 {
+			h(w, r, params)
+			return
+		}
+		if !isValidIdempotencyKey(key) {
+			p := validateParams(&invalidParam{
+				Name:   idempotencyKeyHeader,
+				Reason: fmt.Sprintf("must be 1-%v printable ASCII characters", maxIdempotencyKeyLength),
+			})
+			p.write(w, r)
+			return
+		}
+
+		// Read the body so that it can be hashed, then restore it for the handler. Bodies that are too large are
+		// rejected by the handler, so there is no need to read them in full.
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestBodyBytes+1))
+		if err != nil {
+			p := problem{
+				Title:  "Malformed request body.",
+				Status: http.StatusBadRequest,
+				Detail: fmt.Sprintf("reading request body: %v", err),
+				Code:   codeMalformed,
+			}
+			p.write(w, r)
+			return
+		}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+
+		hash := sha256.New()
+		fmt.Fprintf(hash, "%s %s\n", r.Method, r.URL.RequestURI())
+		hash.Write(body)
+		var requestHash [sha256.Size]byte
+		copy(requestHash[:], hash.Sum(nil))
+
+		recordKey := clientKey(r) + " " + key
+		record, p := s.begin(recordKey, requestHash)
+		if p != nil {
+			p.write(w, r)
+			return
+		}
+		if record != nil {
+			logf(r.Context(), "replaying response for idempotency key %q", key)
+			for name, values := range record.header {
+				if name != requestIDHeader {
+					w.Header()[name] = values
+				}
+			}
+			w.Header().Set(idempotentReplayedHeader, "true")
+			w.WriteHeader(record.status)
+			if _, err := w.Write(record.body); err != nil {
+				logf(r.Context(), "writing response: %v", err)
+			}
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		completed := false
+		defer func() {
+			if !completed {
+				// The handler panicked, so allow the request to be retried.
+				s.discard(recordKey)
+			}
+		}()
+		h(rec, r, params)
+		completed = true
+		s.finish(recordKey, rec)
+	}
+}
+
+// begin looks up the record for the given key. If a completed record for the same request exists, begin returns it.
+// If no record exists, begin creates one and returns nil; the caller must then handle the request and call finish.
+// Otherwise, begin returns a problem that describes the conflict.
+func (s *idempotencyStore) begin(key string, requestHash [sha256.Size]byte) (*idempotencyRecord, *problem) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastPrune) >= idempotencyPruneInterval {
+		for k, record := range s.records {
+			if record.done && now.After(record.expires) {
+				delete(s.records, k)
+			}
+		}
+		s.lastPrune = now
+	}
+
+	record, ok := s.records[key]
+	if ok && record.done && now.After(record.expires) {
+		ok = false
+	}
+	switch {
+	case !ok:
+		s.records[key] = &idempotencyRecord{requestHash: requestHash}
+		return nil, nil
+	case record.requestHash != requestHash:
+		return nil, &problem{
+			Title:  "Idempotency key reused.",
+			Status: http.StatusUnprocessableEntity,
+			Detail: fmt.Sprintf("the %v header was already used for a different request", idempotencyKeyHeader),
+			Code:   codeIdempotencyKeyReused,
+		}
+	case !record.done:
+		return nil, &problem{
+			Title:     "Request in progress.",
+			Status:    http.StatusConflict,
+			Detail:    fmt.Sprintf("a request with the same %v header is still in progress", idempotencyKeyHeader),
+			Code:      codeIdempotencyInProgress,
+			Retryable: true,
+		}
+	default:
+		return record, nil
+	}
+}
+
+// finish records the response to the request with the given key. Responses that are not replayable are discarded
+// along with the record, so that the request may be retried.
+func (s *idempotencyStore) finish(key string, rec *responseRecorder) {
+	if rec.status == 0 {
+		// The handler did not write a response, so the server responds with an empty 200.
+		rec.status, rec.header = http.StatusOK, rec.Header().Clone()
+	}
+	if !isReplayable(rec.status) {
+		s.discard(key)
+		return
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	record := s.records[key]
+	record.done, record.expires = true, time.Now().Add(s.window)
+	record.status, record.header, record.body = rec.status, rec.header, rec.body.Bytes()
+}
+
+// discard removes the record for the given key.
+func (s *idempotencyStore) discard(key string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	delete(s.records, key)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// idempotentRequest is a request sent to an idempotent handler and its expected outcome.
+type idempotentRequest struct {
+	key        string
+	body       string
+	remoteAddr string
+	status     int
+	replayed   bool
+	code       string
+}
+
+func TestIdempotent(t *testing.T) {
+	tests := []struct {
+		name     string
+		window   time.Duration
+		statuses []int
+		requests []idempotentRequest
+		calls    int
+	}{
+		{
+			name:     "replay",
+			statuses: []int{http.StatusCreated},
+			requests: []idempotentRequest{
+				{key: "k", body: "a", status: http.StatusCreated},
+				{key: "k", body: "a", status: http.StatusCreated, replayed: true},
+				{key: "k", body: "a", status: http.StatusCreated, replayed: true},
+			},
+			calls: 1,
+		},
+		{
+			name:     "no key",
+			statuses: []int{http.StatusCreated, http.StatusConflict},
+			requests: []idempotentRequest{
+				{body: "a", status: http.StatusCreated},
+				{body: "a", status: http.StatusConflict},
+			},
+			calls: 2,
+		},
+		{
+			name:     "key reused with a different body",
+			statuses: []int{http.StatusCreated},
+			requests: []idempotentRequest{
+				{key: "k", body: "a", status: http.StatusCreated},
+				{key: "k", body: "b", status: http.StatusUnprocessableEntity, code: codeIdempotencyKeyReused},
+			},
+			calls: 1,
+		},
+		{
+			name:     "keys are scoped to the client",
+			statuses: []int{http.StatusCreated, http.StatusConflict},
+			requests: []idempotentRequest{
+				{key: "k", body: "a", status: http.StatusCreated},
+				{key: "k", body: "a", remoteAddr: "198.51.100.1:1234", status: http.StatusConflict},
+			},
+			calls: 2,
+		},
+		{
+			name:     "transient failures are not replayed",
+			statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusAccepted},
+			requests: []idempotentRequest{
+				{key: "k", body: "a", status: http.StatusServiceUnavailable},
+				{key: "k", body: "a", status: http.StatusTooManyRequests},
+				{key: "k", body: "a", status: http.StatusAccepted},
+				{key: "k", body: "a", status: http.StatusAccepted, replayed: true},
+			},
+			calls: 3,
+		},
+		{
+			name:     "client errors are replayed",
+			statuses: []int{http.StatusNotFound},
+			requests: []idempotentRequest{
+				{key: "k", body: "a", status: http.StatusNotFound},
+				{key: "k", body: "a", status: http.StatusNotFound, replayed: true},
+			},
+			calls: 1,
+		},
+		{
+			name:     "invalid key",
+			requests: []idempotentRequest{{key: "a key", body: "a", status: http.StatusBadRequest, code: codeValidation}},
+		},
+		{
+			name:     "disabled",
+			window:   -1,
+			statuses: []int{http.StatusCreated, http.StatusCreated},
+			requests: []idempotentRequest{
+				{key: "k", body: "a", status: http.StatusCreated},
+				{key: "k", body: "a", status: http.StatusCreated},
+			},
+			calls: 2,
+		},
+	}
+	captureLog(t)
+
+	for _, tt := range tests {
+		window := time.Hour
+		if tt.window != 0 {
+			window = tt.window
+		}
+		store := newIdempotencyStore(window)
+		calls := 0
+		handler := store.idempotent(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+			body, _ := io.ReadAll(r.Body)
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(tt.statuses[calls])
+			fmt.Fprintf(w, "call %v: %s", calls, body)
+			calls++
+		})
+
+		var first string
+		for i, req := range tt.requests {
+			r := httptest.NewRequest(http.MethodPost, "/sites/blog", strings.NewReader(req.body))
+			r.RemoteAddr = "192.0.2.1:1234"
+			if req.remoteAddr != "" {
+				r.RemoteAddr = req.remoteAddr
+			}
+			if req.key != "" {
+				r.Header.Set(idempotencyKeyHeader, req.key)
+			}
+			w := httptest.NewRecorder()
+			handler(w, r, nil)
+
+			if w.Code != req.status {
+				t.Errorf("%s: request %v: got status %v, want %v", tt.name, i, w.Code, req.status)
+			}
+			if replayed := w.Header().Get(idempotentReplayedHeader) == "true"; replayed != req.replayed {
+				t.Errorf("%s: request %v: got replayed %v, want %v", tt.name, i, replayed, req.replayed)
+			}
+			if req.code != "" && !strings.Contains(w.Body.String(), `"code":"`+req.code+`"`) {
+				t.Errorf("%s: request %v: body %s doesn't have code %v", tt.name, i, w.Body, req.code)
+			}
+			if req.replayed && w.Body.String() != first {
+				t.Errorf("%s: request %v: replayed %q, want %q", tt.name, i, w.Body, first)
+			}
+			if !req.replayed {
+				first = w.Body.String()
+			}
+		}
+		if calls != tt.calls {
+			t.Errorf("%s: handler called %v times, want %v", tt.name, calls, tt.calls)
+		}
+	}
+}
+
+func TestIdempotentRequestInProgress(t *testing.T) {
+	store := newIdempotencyStore(time.Hour)
+	started, release := make(chan struct{}), make(chan struct{})
+	handler := store.idempotent(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusCreated)
+	})
+	newRequest := func() *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/sites/blog", strings.NewReader("a"))
+		r.Header.Set(idempotencyKeyHeader, "k")
+		return r
+	}
+
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		handler(w, newRequest(), nil)
+		done <- w.Code
+	}()
+	<-started
+
+	w := httptest.NewRecorder()
+	handler(w, newRequest(), nil)
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), codeIdempotencyInProgress) {
+		t.Errorf("got %v %s while the original request was in progress", w.Code, w.Body)
+	}
+
+	close(release)
+	if code := <-done; code != http.StatusCreated {
+		t.Errorf("original request got status %v", code)
+	}
+}
+
+func TestIdempotentRecordsExpire(t *testing.T) {
+	store := newIdempotencyStore(time.Hour)
+	var hash [sha256.Size]byte
+	if record, p := store.begin("k", hash); record != nil || p != nil {
+		t.Fatalf("begin of a new key returned %v, %v", record, p)
+	}
+	store.finish("k", &responseRecorder{ResponseWriter: httptest.NewRecorder(), status: http.StatusCreated})
+	if record, _ := store.begin("k", hash); record == nil {
+		t.Fatal("completed record was not returned")
+	}
+
+	store.records["k"].expires = time.Now().Add(-time.Second)
+	if record, p := store.begin("k", hash); record != nil || p != nil {
+		t.Errorf("begin of an expired key returned %v, %v", record, p)
+	}
+}
@@ -3,10 +3,14 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"flag"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/julienschmidt/httprouter"
 )
@@ -17,6 +21,8 @@ type createSiteRequest struct {
 	ID string `json:"id"`
 	// The content of the site's index.html.
 	Content string `json:"content"`
+	// An optional custom domain to serve the site from over HTTPS.
+	Domain string `json:"domain,omitempty"`
 }
 
 // updateSiteRequest defines the body of a request to the "update site" REST API.
@@ -25,24 +31,22 @@ type updateSiteRequest struct {
 	Content string `json:"content"`
 }
 
-// getSiteResponse defines the body of a response from the "create site" and "get site" REST APIs.
-type getSiteResponse struct {
-	ID     string `json:"id"`
-	URL    string `json:"url,omitempty"`
-	Status string `json:"status,omitempty"`
-}
-
-// internalServerError is a helper that writes a 500 response to w and logs the error to the terminal.
-func internalServerError(w http.ResponseWriter, err error) {
-	w.WriteHeader(http.StatusInternalServerError)
-	fmt.Fprintf(w, "Internal Server Error")
-	log.Printf("Internal Server Error: %v", err)
+// updateSiteResponse defines the body of a response from the "update site" REST API.
+type updateSiteResponse struct {
+	// The ID of the request.
+	RequestID string `json:"requestId"`
+	// True if the update was queued behind the site's current deployment rather than deployed immediately.
+	Queued bool `json:"queued"`
+	// The IDs of earlier requests whose queued updates were replaced by this update and will not be deployed.
+	Superseded []string `json:"superseded,omitempty"`
 }
 
-// siteNotFound is a helper that writes a 404 response to w.
-func siteNotFound(w http.ResponseWriter, id string) {
-	w.WriteHeader(http.StatusNotFound)
-	fmt.Fprintf(w, "Site '%s' not found", id)
+// getSiteResponse defines the body of a response from the "create site" and "get site" REST APIs.
+type getSiteResponse struct {
+	ID     string      `json:"id"`
+	URL    string      `json:"url,omitempty"`
+	Status string      `json:"status,omitempty"`
+	Domain *siteDomain `json:"domain,omitempty"`
 }
 
 // A siteServer serves the REST API that provides CRUD operations for static sites.
@@ -63,11 +67,31 @@ type siteServer struct {
 	// The org and project that will hold the stacks that back each static site.
 	org     string
 	project string
+
+	// Rate limits and quotas for site operations.
+	quotas *quotas
+
+	// Coalesces bursts of updates to each site.
+	updates *updateCoalescer
+
+	// Records responses to mutating requests made with idempotency keys.
+	idempotency *idempotencyStore
+
+	// Records the content deployed to each site.
+	revisions *revisionStore
+
+	// Tracks claims on custom domains and their verification.
+	domains *domainRegistry
+
+	// The stack outputs exposed by the "get site outputs" REST API, and the API keys that may read secret outputs. If
+	// outputMapping is empty, all outputs are exposed.
+	outputMapping    []outputField
+	secretOutputKeys []string
 }
 
 // updateStack is a helper that creates a deployment that will update the static site's underlying stack with the
-// given contents.
-func (s *siteServer) updateStack(ctx context.Context, stack, content string) error {
+// given contents. It returns the ID of the deployment.
+func (s *siteServer) updateStack(ctx context.Context, stack, content string) (string, error) {
 	return s.client.createDeployment(ctx, s.org, s.project, stack, createDeploymentRequest{
 		DeploymentSettings: DeploymentSettings{
 			OperationContext: &operationContext{
@@ -90,26 +114,75 @@ func (s *siteServer) updateStack(ctx context.Context, stack, content string) err
 //    session name, and will deploy to the configured region. Furthermore, deployments will run if the Pulumi program
 //    is updated by commits that are pushed to its branch and affect files in its directory.
 // 3. Using the Deployments API, start a deployment using for the Pulumi stack that will run the initial update.
+//
+// If the site has a custom domain, the domain is recorded in a tag on the site's stack and passed to deployments via the
+// SITE_DOMAIN environment variable. Domains may only be used by a single site.
 func (s *siteServer) create(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	var create createSiteRequest
-	if err := json.NewDecoder(r.Body).Decode(&create); err != nil {
-		w.WriteHeader(400)
-		fmt.Fprintf(w, "failed to parse create request")
+	if p := decodeJSONBody(w, r, &create); p != nil {
+		p.write(w, r)
+		return
+	}
+	create.Domain = normalizeDomain(create.Domain)
+	if p := validateParams(validateSiteID(create.ID), validateContent(create.Content), validateDomain(create.Domain)); p != nil {
+		p.write(w, r)
 		return
 	}
 
-	// Create the Pulumi stack.
+	// Reserve quota for the site and its initial deployment. The reservations are released if the site is not created.
 	stack := create.ID
-	err := s.client.createStack(r.Context(), s.org, s.project, stack)
+	releaseSite, p := s.quotas.reserveSite(clientKey(r), stack)
+	if p != nil {
+		p.write(w, r)
+		return
+	}
+	if p := s.quotas.reserveDeployment(stack); p != nil {
+		releaseSite()
+		p.write(w, r)
+		return
+	}
+	created, deployed := false, false
+	defer func() {
+		if !deployed {
+			s.quotas.releaseDeployment(stack)
+		}
+		if !created {
+			releaseSite()
+		}
+	}()
+
+	// Claim the site's custom domain, if any.
+	var tags map[string]string
+	if create.Domain != "" {
+		releaseDomain, p, err := s.claimDomain(r.Context(), stack, create.Domain)
+		if err != nil {
+			serverError(w, r, fmt.Errorf("checking domain: %w", err))
+			return
+		}
+		if p != nil {
+			p.write(w, r)
+			return
+		}
+		defer releaseDomain()
+		tags = map[string]string{domainTagName: create.Domain}
+	}
+
+	// Create the Pulumi stack.
+	err := s.client.createStack(r.Context(), s.org, s.project, stack, tags)
 	switch err {
 	case nil:
-		// OK
+		created = true
 	case errStackExists:
-		w.WriteHeader(http.StatusConflict)
-		fmt.Fprintf(w, "site already exists")
+		p := problem{
+			Title:  "Site already exists.",
+			Status: http.StatusConflict,
+			Detail: fmt.Sprintf("site '%s' already exists", stack),
+			Code:   codeSiteExists,
+		}
+		p.write(w, r)
 		return
 	default:
-		internalServerError(w, fmt.Errorf("creating stack: %w", err))
+		serverError(w, r, fmt.Errorf("creating stack: %w", err))
 		return
 	}
 
@@ -125,17 +198,7 @@ func (s *siteServer) create(w http.ResponseWriter, r *http.Request, _ httprouter
 				RepoDir: s.dir,
 			},
 		},
-		OperationContext: &operationContext{
-			Environment: map[string]string{
-				"AWS_REGION": s.region,
-			},
-			OIDC: &oidcContext{
-				AWS: &awsOIDCContext{
-					RoleARN:     s.roleARN,
-					SessionName: s.sessionName,
-				},
-			},
-		},
+		OperationContext: s.operationContext(create.Domain, false),
 		GitHub: &gitHubContext{
 			Repository:          s.repository,
 			Paths:               paths,
@@ -144,19 +207,23 @@ func (s *siteServer) create(w http.ResponseWriter, r *http.Request, _ httprouter
 		},
 	})
 	if err != nil {
-		internalServerError(w, fmt.Errorf("patching deployment settings: %w", err))
+		serverError(w, r, fmt.Errorf("patching deployment settings: %w", err))
 		return
 	}
 
 	// Run a deployment for the stack's initial update.
-	if err := s.updateStack(r.Context(), stack, create.Content); err != nil {
-		internalServerError(w, fmt.Errorf("starting deployment: %w", err))
+	if err := s.deploy(r.Context(), stack, contentUpdate{Content: create.Content, Author: clientKey(r)}); err != nil {
+		serverError(w, r, fmt.Errorf("starting deployment: %w", err))
 		return
 	}
+	deployed = true
+	s.updates.track(stack)
+	observedSites.set(stack, "DEPLOYING")
 
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusAccepted)
 	if err := json.NewEncoder(w).Encode(&getSiteResponse{ID: stack}); err != nil {
-		log.Printf("writing response: %v", err)
+		logf(r.Context(), "writing response: %v", err)
 	}
 }
 
@@ -165,65 +232,115 @@ func (s *siteServer) create(w http.ResponseWriter, r *http.Request, _ httprouter
 // The status of the site is determined by the status of the stack's current deployment, if any.
 func (s *siteServer) get(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	id := params.ByName("id")
+	if p := validateParams(validateSiteID(id)); p != nil {
+		p.write(w, r)
+		return
+	}
 
 	deploymentStatus, err := s.client.getStackCurrentDeploymentStatus(r.Context(), s.org, s.project, id)
 	if err != nil {
 		if err == errStackNotFound {
-			siteNotFound(w, id)
+			observedSites.remove(id)
+			siteNotFound(w, r, id)
 		} else {
-			internalServerError(w, fmt.Errorf("getting stack: %w", err))
+			serverError(w, r, fmt.Errorf("getting stack: %w", err))
 		}
 		return
 	}
 	status := "READY"
-	switch deploymentStatus {
-	case "not-started", "accepted", "running":
+	if isDeploymentInProgress(deploymentStatus) || s.updates.isPending(id) {
 		status = "DEPLOYING"
 	}
 
+	observedSites.set(id, status)
+
 	outputs, err := s.client.getStackOutputs(r.Context(), s.org, s.project, id)
 	if err != nil {
 		if err == errStackNotFound {
-			siteNotFound(w, id)
+			observedSites.remove(id)
+			siteNotFound(w, r, id)
 		} else {
-			internalServerError(w, fmt.Errorf("getting stack outputs: %w", err))
+			serverError(w, r, fmt.Errorf("getting stack outputs: %w", err))
 		}
 		return
 	}
 	url, _ := outputs["websiteUrl"].(string)
 
+	domain := s.getDomain(id, outputs, status == "DEPLOYING")
+	if domain != nil && domain.Status == domainActive {
+		url, _ = outputs["customDomainUrl"].(string)
+	}
+	if domain != nil && domain.Status == domainProvisioning {
+		status = "DEPLOYING"
+	}
+
 	resp := getSiteResponse{
 		ID:     id,
 		URL:    url,
 		Status: status,
+		Domain: domain,
 	}
+	w.Header().Set("Content-Type", "application/json")
 	if err = json.NewEncoder(w).Encode(&resp); err != nil {
-		log.Printf("encoding response: %v", err)
+		logf(r.Context(), "encoding response: %v", err)
 	}
 }
 
 // update implements the Update operation for a static site.
 //
-// Each update creates a new deployment for the site's stack. Updates are queued and will be processed in the order in
-// which they are received.
+// If the site has no deployment in progress, the update starts a new deployment for the site's stack. Otherwise, the
+// update is queued until the current deployment finishes, replacing any update that was already queued, so that a
+// burst of updates results in at most one further deployment of the latest content. The response reports whether the
+// update was queued and which earlier requests it superseded.
 func (s *siteServer) update(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	id := params.ByName("id")
 
 	var update updateSiteRequest
-	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
-		w.WriteHeader(400)
-		fmt.Fprintf(w, "failed to parse update request")
+	if p := decodeJSONBody(w, r, &update); p != nil {
+		p.write(w, r)
+		return
+	}
+	if p := validateParams(validateSiteID(id), validateContent(update.Content)); p != nil {
+		p.write(w, r)
+		return
+	}
+
+	s.submitUpdate(w, r, id, contentUpdate{Content: update.Content, Author: clientKey(r)})
+}
+
+// submitUpdate submits new content for a site to the update coalescer and writes the response for the "update site"
+// and "roll back site" REST APIs.
+func (s *siteServer) submitUpdate(w http.ResponseWriter, r *http.Request, id string, update contentUpdate) {
+	if p := s.quotas.reserveDeployment(id); p != nil {
+		p.write(w, r)
 		return
 	}
 
-	err := s.updateStack(r.Context(), id, update.Content)
+	result, err := s.updates.submit(r.Context(), id, update)
 	switch err {
 	case nil:
+		if len(result.Superseded) != 0 {
+			// The superseded update will no longer be deployed, so it no longer counts against the site's quota.
+			s.quotas.releaseDeployment(id)
+		}
+		observedSites.set(id, "DEPLOYING")
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusAccepted)
+		resp := updateSiteResponse{
+			RequestID:  requestIDFromContext(r.Context()),
+			Queued:     result.Queued,
+			Superseded: result.Superseded,
+		}
+		if err := json.NewEncoder(w).Encode(&resp); err != nil {
+			logf(r.Context(), "encoding response: %v", err)
+		}
 	case errStackNotFound:
-		siteNotFound(w, id)
+		observedSites.remove(id)
+		s.quotas.removeSite(id)
+		siteNotFound(w, r, id)
 	default:
-		internalServerError(w, fmt.Errorf("starting deployment: %w", err))
+		s.quotas.releaseDeployment(id)
+		serverError(w, r, fmt.Errorf("starting deployment: %w", err))
 	}
 }
 
@@ -231,88 +348,236 @@ func (s *siteServer) update(w http.ResponseWriter, r *http.Request, params httpr
 //
 // Site deletion requires two calls to this API: one to destroy the site's resources and another to delete the site's
 // stack. The `rm` query parameter controls this behavior: when present, the site's stack will be deleted, and when
-// absent, the site's resources will be destroyed.
+// absent, the site's resources will be destroyed. Any queued update to the site is discarded.
 func (s *siteServer) delete(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	id := params.ByName("id")
+	if p := validateParams(validateSiteID(id)); p != nil {
+		p.write(w, r)
+		return
+	}
+
+	if discarded := s.updates.cancel(id); len(discarded) != 0 {
+		s.quotas.releaseDeployment(id)
+		logf(r.Context(), "discarded queued update for site '%s' from requests %v", id, strings.Join(discarded, ", "))
+	}
 
 	var err error
 	var statusOK int
 	if !r.URL.Query().Has("rm") {
-		err = s.client.createDeployment(r.Context(), s.org, s.project, id, createDeploymentRequest{
+		if p := s.quotas.reserveDeployment(id); p != nil {
+			p.write(w, r)
+			return
+		}
+		_, err = s.client.createDeployment(r.Context(), s.org, s.project, id, createDeploymentRequest{
 			InheritSettings: true,
 			Operation:       "destroy",
 		})
+		if err != nil {
+			s.quotas.releaseDeployment(id)
+			err = fmt.Errorf("starting deployment: %w", err)
+		} else {
+			observedSites.set(id, "DEPLOYING")
+		}
 		statusOK = http.StatusAccepted
 	} else {
 		err = s.client.deleteStack(r.Context(), s.org, s.project, id)
+		if err != nil {
+			err = fmt.Errorf("deleting stack: %w", err)
+		} else {
+			observedSites.remove(id)
+			s.quotas.removeSite(id)
+			s.revisions.remove(id)
+			s.domains.forget(id)
+		}
 		statusOK = http.StatusOK
 	}
-	switch err {
-	case nil:
+	switch {
+	case err == nil:
 		w.WriteHeader(statusOK)
-	case errStackNotFound:
-		siteNotFound(w, id)
+	case errors.Is(err, errStackNotFound):
+		observedSites.remove(id)
+		s.quotas.removeSite(id)
+		siteNotFound(w, r, id)
 	default:
-		internalServerError(w, fmt.Errorf("starting deployment: %w", err))
+		serverError(w, r, err)
 	}
 }
 
-func main() {
-	// Parse our command line args.
-	repository := flag.String("repo", "", "the GitHub repository that contains the site's Pulumi program")
-	branch := flag.String("branch", "main", "the git branch that contains the site's Pulumi program")
-	dir := flag.String("dir", "", "the subdirectory of the git repository that contains the site's Pulumi program")
-	region := flag.String("region", "us-west-2", "the AWS region to deploy to")
-	roleARN := flag.String("role-arn", "", "the AWS IAM Role ARN to use for OIDC integration")
-	sessionName := flag.String("session-name", "site-deploy", "the session name to use for AWS OIDC integration")
-	apiToken := flag.String("token", "", "the Pulumi API token to use")
-	org := flag.String("org", "", "the Pulumi organization to use")
-	project := flag.String("project", "", "the Pulumi project to deploy")
-	addr := flag.String("addr", ":8080", "the address to listen on")
-	flag.Parse()
+// routes returns the routes that make up the REST API. Mutating routes accept idempotency keys and are subject to each
+// client's rate limit. Replayed responses do not count against the rate limit.
+func (s *siteServer) routes() []route {
+	return []route{
+		{http.MethodPost, "/sites", s.mutating(s.create)},
+		{http.MethodGet, "/sites/:id", s.get},
+		{http.MethodPost, "/sites/:id", s.mutating(s.update)},
+		{http.MethodDelete, "/sites/:id", s.mutating(s.delete)},
+		{http.MethodPost, "/sites/:id/domain/verify", s.mutating(s.verifyDomain)},
+		{http.MethodGet, "/sites/:id/outputs", s.getOutputs},
+		{http.MethodGet, "/sites/:id/revisions", s.listRevisions},
+		{http.MethodPost, "/sites/:id/rollback", s.mutating(s.rollback)},
+		{http.MethodGet, "/quotas", s.getQuotas},
+		{http.MethodGet, "/openapi.json", serveOpenAPISpec},
+		{http.MethodGet, "/metrics", serveMetrics},
+		{http.MethodGet, "/healthz", s.healthz},
+		{http.MethodGet, "/readyz", s.readyz},
+	}
+}
+
+// mutating wraps the handler for a route that modifies a site.
+func (s *siteServer) mutating(h httprouter.Handle) httprouter.Handle {
+	return s.idempotency.idempotent(s.quotas.limited(h))
+}
+
+// selectOrg determines the organization that will hold the sites' stacks.
+//
+// If an organization was requested, it must be accessible to the token. Personal tokens may also use the user's own
+// account. If no organization was requested, the token must have access to exactly one organization, which is used.
+func selectOrg(user *currentUser, requested string) (string, error) {
+	if requested != "" {
+		if user.TokenKind == tokenKindPersonal && requested == user.Name {
+			return requested, nil
+		}
+		for _, org := range user.Organizations {
+			if org == requested {
+				return requested, nil
+			}
+		}
+		if len(user.Organizations) == 0 {
+			return "", fmt.Errorf("the Pulumi API token cannot access organization '%s'", requested)
+		}
+		return "", fmt.Errorf("the Pulumi API token cannot access organization '%s'; it can access: %v", requested,
+			strings.Join(user.Organizations, ", "))
+	}
 
-	if *repository == "" {
-		log.Fatal("the -repo flag is required")
+	switch len(user.Organizations) {
+	case 0:
+		return "", errors.New("the Pulumi API token does not have access to any organizations; set -org to use a personal account")
+	case 1:
+		return user.Organizations[0], nil
+	default:
+		return "", fmt.Errorf("the Pulumi API token can access several organizations (%v); set -org to choose one",
+			strings.Join(user.Organizations, ", "))
 	}
-	if *roleARN == "" {
-		log.Fatal("the -role-arn flag is required")
+}
+
+func main() {
+	// Load and validate our settings.
+	cfg, printConfig, err := loadConfig(os.Args[1:], os.Getenv)
+	if err != nil {
+		log.Fatal(err)
 	}
-	if *apiToken == "" {
-		log.Fatal("the -token flag is required")
+	if printConfig {
+		if err := cfg.print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		if err := cfg.validate(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
 	}
-	if *project == "" {
-		log.Fatal("the -project flag is required")
+	if err := cfg.validate(); err != nil {
+		log.Fatal(err)
 	}
 
-	// Create a new Pulumi API client using the provided API token.
-	client := newPulumiClient(*apiToken)
-
-	// If no org was provided, use the current user's first organization.
-	if *org == "" {
-		orgs, err := client.getCurrentOrgs()
+	// Export traces if an OTLP endpoint was provided.
+	shutdownTracing := func(context.Context) error { return nil }
+	if cfg.otlpEndpoint != "" {
+		shutdown, err := setupTracing(context.Background(), cfg.otlpEndpoint)
 		if err != nil {
-			log.Fatalf("getting default organization: %v", err)
+			log.Fatalf("setting up tracing: %v", err)
 		}
-		*org = orgs[0]
+		shutdownTracing = shutdown
 	}
 
+	// Create a new Pulumi API client using the provided API token.
+	client := newPulumiClient(cfg.token)
+	client.outputsSource = cfg.outputsSource
+
+	// Identify the token and choose the organization to use.
+	user, err := client.getCurrentUser(context.Background())
+	if err != nil {
+		log.Fatalf("getting current user: %v", err)
+	}
+	switch user.TokenKind {
+	case tokenKindPersonal:
+		log.Printf("using a personal token for user '%s'", user.Name)
+	case tokenKindOrganization:
+		log.Printf("using organization token '%s' for organization '%s'", user.TokenName, user.TokenOrganization)
+	case tokenKindTeam:
+		log.Printf("using team token '%s' for team '%s' in organization '%s'", user.TokenName, user.TokenTeam,
+			user.TokenOrganization)
+	}
+	if cfg.org, err = selectOrg(user, cfg.org); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("using organization '%s'", cfg.org)
+
+	// Serve until we receive SIGINT or SIGTERM, then drain in-flight requests. A second signal terminates the server
+	// immediately.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
 	// Create a server for the static site REST API and start serving.
 	server := &siteServer{
 		client:      client,
-		repository:  *repository,
-		branch:      *branch,
-		dir:         *dir,
-		region:      *region,
-		roleARN:     *roleARN,
-		sessionName: *sessionName,
-		org:         *org,
-		project:     *project,
+		repository:  cfg.repository,
+		branch:      cfg.branch,
+		dir:         cfg.dir,
+		region:      cfg.region,
+		roleARN:     cfg.roleARN,
+		sessionName: cfg.sessionName,
+		org:         cfg.org,
+		project:     cfg.project,
+		quotas: newQuotas(quotaOptions{
+			rateLimit:             cfg.rateLimit,
+			rateBurst:             cfg.rateBurst,
+			maxSitesPerClient:     cfg.maxSitesPerClient,
+			maxDeploymentsPerSite: cfg.maxDeploymentsPerSite,
+		}),
+	}
+	// Queued updates are watched under their own context, which is canceled once in-flight requests have drained, so
+	// that the drain doesn't cut off a queued update's deployment as it is being started.
+	updatesCtx, stopUpdates := context.WithCancel(context.Background())
+	server.updates = newUpdateCoalescer(updatesCtx, server)
+	server.idempotency = newIdempotencyStore(cfg.idempotencyWindow)
+	server.revisions = newRevisionStore()
+	server.domains = newDomainRegistry()
+	if server.outputMapping, err = parseOutputMapping(cfg.outputs); err != nil {
+		log.Fatal(err)
 	}
+	server.secretOutputKeys = splitKeys(cfg.secretOutputKeys)
 	router := httprouter.New()
-	router.POST("/sites", server.create)
-	router.GET("/sites/:id", server.get)
-	router.POST("/sites/:id", server.update)
-	router.DELETE("/sites/:id", server.delete)
+	router.NotFound = http.HandlerFunc(notFound)
+	router.MethodNotAllowed = http.HandlerFunc(methodNotAllowed)
+	router.PanicHandler = panicked
+	for _, route := range server.routes() {
+		router.Handle(route.method, route.path, instrument(route.path, route.handler))
+	}
 
-	http.ListenAndServe(*addr, router)
+	err = serve(ctx, withRequestID(withClientKey(splitKeys(cfg.apiKeys), router)), serverOptions{
+		addr:              cfg.addr,
+		readHeaderTimeout: cfg.readHeaderTimeout,
+		readTimeout:       cfg.readTimeout,
+		writeTimeout:      cfg.writeTimeout,
+		idleTimeout:       cfg.idleTimeout,
+		shutdownTimeout:   cfg.shutdownTimeout,
+		tlsCertFile:       cfg.tlsCert,
+		tlsKeyFile:        cfg.tlsKey,
+	})
+	stopUpdates()
+	waitCtx, cancelWait := context.WithTimeout(context.Background(), cfg.shutdownTimeout)
+	if err := server.updates.wait(waitCtx); err != nil {
+		log.Printf("waiting for queued updates to start deploying: %v", err)
+	}
+	cancelWait()
+	if err := shutdownTracing(context.Background()); err != nil {
+		log.Printf("shutting down tracing: %v", err)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
 }
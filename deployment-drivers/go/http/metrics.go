@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsNamespace is the namespace of the server's Prometheus metrics.
+const metricsNamespace = "site_server"
+
+var (
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "The number of HTTP requests served, by route, method, and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "The latency of HTTP requests, by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	pulumiAPICallsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "pulumi_api_calls_total",
+		Help:      "The number of Pulumi API client calls, by client method.",
+	}, []string{"method"})
+
+	pulumiAPICallDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "pulumi_api_call_duration_seconds",
+		Help:      "The latency of Pulumi API client calls, by client method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+
+	pulumiAPICallErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "pulumi_api_call_errors_total",
+		Help:      "The number of failed Pulumi API client calls, by client method and status code.",
+	}, []string{"method", "code"})
+
+	deploymentsStartedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "deployments_started_total",
+		Help:      "The number of deployments started, by operation.",
+	}, []string{"operation"})
+
+	updatesSupersededTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "updates_superseded_total",
+		Help:      "The number of queued site updates that were replaced by a newer update before being deployed.",
+	})
+
+	// observedSites tracks the status of each site as last observed by this server.
+	observedSites = newSiteStatusCollector()
+)
+
+func init() {
+	prometheus.MustRegister(observedSites)
+}
+
+// metricsHandler serves the metrics in the default Prometheus registry.
+var metricsHandler = promhttp.Handler()
+
+// serveMetrics serves the server's Prometheus metrics.
+func serveMetrics(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	metricsHandler.ServeHTTP(w, r)
+}
+
+// statusRecorder is an http.ResponseWriter that records the status code of the response.
+type statusRecorder struct {
+	http.ResponseWriter
+
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// instrument wraps h so that requests to the given route are counted, timed, and traced.
+func instrument(route string, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		start := time.Now()
+		r, span := startHandlerSpan(r, route)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h(rec, r, params)
+		endHandlerSpan(span, rec.status)
+		httpRequestsTotal.WithLabelValues(route, r.Method, strconv.Itoa(rec.status)).Inc()
+		httpRequestDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	}
+}
+
+// observePulumiCall records a Pulumi API client call that began at start and returned err.
+func observePulumiCall(method string, start time.Time, err error) {
+	pulumiAPICallsTotal.WithLabelValues(method).Inc()
+	pulumiAPICallDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		pulumiAPICallErrorsTotal.WithLabelValues(method, errorCode(err)).Inc()
+	}
+}
+
+// errorCode returns the HTTP status code associated with a Pulumi API client error, or "transport" if the error did
+// not come from a response.
+func errorCode(err error) string {
+	var apiErr *pulumiAPIError
+	switch {
+	case errors.Is(err, errStackNotFound):
+		return strconv.Itoa(http.StatusNotFound)
+	case errors.Is(err, errStackExists):
+		return strconv.Itoa(http.StatusConflict)
+	case errors.As(err, &apiErr):
+		return strconv.Itoa(apiErr.StatusCode)
+	default:
+		return "transport"
+	}
+}
+
+// siteStatusCollector is a Prometheus collector that reports the number of sites in each status. Statuses are
+// recorded as the server creates, updates, reads, and deletes sites, so sites that this server has not touched since it
+// started are not counted.
+type siteStatusCollector struct {
+	desc *prometheus.Desc
+
+	m        sync.Mutex
+	statuses map[string]string
+}
+
+func newSiteStatusCollector() *siteStatusCollector {
+	return &siteStatusCollector{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "sites"),
+			"The number of sites, by status as last observed by this server.",
+			[]string{"status"}, nil),
+		statuses: map[string]string{},
+	}
+}
+
+// set records the status of the given site.
+func (c *siteStatusCollector) set(id, status string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.statuses[id] = status
+}
+
+// remove forgets the given site.
+func (c *siteStatusCollector) remove(id string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	delete(c.statuses, id)
+}
+
+func (c *siteStatusCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *siteStatusCollector) Collect(ch chan<- prometheus.Metric) {
+	c.m.Lock()
+	counts := map[string]int{"READY": 0, "DEPLOYING": 0}
+	for _, status := range c.statuses {
+		counts[status]++
+	}
+	c.m.Unlock()
+
+	statuses := make([]string, 0, len(counts))
+	for status := range counts {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+	for _, status := range statuses {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(counts[status]), status)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestErrorCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{errStackNotFound, "404"},
+		{fmt.Errorf("deleting: %w", errStackExists), "409"},
+		{&pulumiAPIError{StatusCode: http.StatusServiceUnavailable}, "503"},
+		{context.DeadlineExceeded, "transport"},
+	}
+	for _, tt := range tests {
+		if got := errorCode(tt.err); got != tt.want {
+			t.Errorf("errorCode(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestInstrumentCountsRequests(t *testing.T) {
+	const route = "/test/instrument"
+	handler := instrument(route, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	counted := httpRequestsTotal.WithLabelValues(route, http.MethodGet, "418")
+	before := testutil.ToFloat64(counted)
+	for i := 0; i < 2; i++ {
+		handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, route, nil), nil)
+	}
+
+	if got := testutil.ToFloat64(counted) - before; got != 2 {
+		t.Errorf("got %v requests counted, want 2", got)
+	}
+}
+
+func TestSiteStatusCollector(t *testing.T) {
+	c := newSiteStatusCollector()
+	c.set("a", "READY")
+	c.set("b", "DEPLOYING")
+	c.set("c", "DEPLOYING")
+	c.set("a", "DEPLOYING")
+	c.remove("c")
+
+	want := `
+# HELP site_server_sites The number of sites, by status as last observed by this server.
+# TYPE site_server_sites gauge
+site_server_sites{status="DEPLOYING"} 2
+site_server_sites{status="READY"} 0
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+}
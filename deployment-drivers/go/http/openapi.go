@@ -0,0 +1,29 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// openAPISpec is the OpenAPI document that describes the REST API. The typed client in the client package is generated
+// from this document.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// A route associates an HTTP method and path with the handler that serves it.
+type route struct {
+	method  string
+	path    string
+	handler httprouter.Handle
+}
+
+// serveOpenAPISpec serves the OpenAPI document that describes the REST API.
+func serveOpenAPISpec(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(openAPISpec); err != nil {
+		logf(r.Context(), "writing response: %v", err)
+	}
+}
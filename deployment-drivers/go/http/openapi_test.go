@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRoutesMatchSpec checks that the server's routes and the paths in the OpenAPI document describe exactly the same
+// set of operations, so that the document and the generated client can't drift from the server.
+func TestRoutesMatchSpec(t *testing.T) {
+	server := &siteServer{
+		quotas:      newQuotas(quotaOptions{}),
+		idempotency: newIdempotencyStore(time.Hour),
+	}
+	if err := checkRoutesMatchSpec(server.routes(), openAPISpec); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCheckRoutesMatchSpecReportsDrift(t *testing.T) {
+	spec := []byte(`{"paths": {"/sites/{id}": {"get": {}, "parameters": []}, "/quotas": {"get": {}}}}`)
+	routes := []route{{method: "GET", path: "/sites/:id"}, {method: "DELETE", path: "/sites/:id"}}
+
+	err := checkRoutesMatchSpec(routes, spec)
+	want := "routes do not match the OpenAPI document: DELETE /sites/:id is served but not documented; " +
+		"GET /quotas is documented but not served"
+	if err == nil || err.Error() != want {
+		t.Errorf("got %v, want %v", err, want)
+	}
+}
+
+// checkRoutesMatchSpec checks that routes and the paths in the OpenAPI document describe exactly the same set of
+// operations. Paths in the document use {param} syntax, while routes use :param syntax.
+func checkRoutesMatchSpec(routes []route, spec []byte) error {
+	// document is the subset of an OpenAPI document needed to enumerate its operations.
+	type document struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+
+	var doc document
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		return fmt.Errorf("parsing OpenAPI document: %w", err)
+	}
+
+	documented := map[string]bool{}
+	for path, item := range doc.Paths {
+		for method := range item {
+			switch method {
+			case "get", "put", "post", "delete", "options", "head", "patch", "trace":
+				documented[strings.ToUpper(method)+" "+routePath(path)] = true
+			}
+		}
+	}
+
+	served := map[string]bool{}
+	for _, r := range routes {
+		served[r.method+" "+r.path] = true
+	}
+
+	var problems []string
+	for op := range served {
+		if !documented[op] {
+			problems = append(problems, fmt.Sprintf("%v is served but not documented", op))
+		}
+	}
+	for op := range documented {
+		if !served[op] {
+			problems = append(problems, fmt.Sprintf("%v is documented but not served", op))
+		}
+	}
+	if len(problems) != 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("routes do not match the OpenAPI document: %v", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// routePath converts an OpenAPI path template to an httprouter path.
+func routePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+			segments[i] = ":" + s[1:len(s)-1]
+		}
+	}
+	return strings.Join(segments, "/")
+}
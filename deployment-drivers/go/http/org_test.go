@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGetCurrentUser(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want currentUser
+	}{
+		{
+			name: "personal",
+			body: `{"githubLogin": "octocat", "organizations": [{"githubLogin": "acme"}, {"githubLogin": "example"}]}`,
+			want: currentUser{Name: "octocat", Organizations: []string{"acme", "example"}, TokenKind: tokenKindPersonal},
+		},
+		{
+			name: "organization",
+			body: `{"githubLogin": "acme", "organizations": [{"githubLogin": "acme"}, {"githubLogin": "example"}],
+				"tokenInfo": {"name": "ci", "organization": "acme"}}`,
+			want: currentUser{Name: "acme", Organizations: []string{"acme"}, TokenKind: tokenKindOrganization,
+				TokenName: "ci", TokenOrganization: "acme"},
+		},
+		{
+			name: "team",
+			body: `{"githubLogin": "web", "organizations": [], "tokenInfo": {"name": "deploy", "organization": "acme", "team": "web"}}`,
+			want: currentUser{Name: "web", Organizations: []string{"acme"}, TokenKind: tokenKindTeam,
+				TokenName: "deploy", TokenOrganization: "acme", TokenTeam: "web"},
+		},
+	}
+	for _, tt := range tests {
+		client := fakePulumiClient(func(r *http.Request) (int, string) {
+			if r.URL.Path != "/api/user" || r.Header.Get("Authorization") != "token test-token" {
+				return http.StatusUnauthorized, `{"code": 401, "message": "unauthorized"}`
+			}
+			return http.StatusOK, tt.body
+		})
+		user, err := client.getCurrentUser(context.Background())
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(*user, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, *user, tt.want)
+		}
+	}
+}
+
+func TestSelectOrg(t *testing.T) {
+	personal := &currentUser{Name: "octocat", Organizations: []string{"acme", "example"}, TokenKind: tokenKindPersonal}
+	team := &currentUser{Name: "web", Organizations: []string{"acme"}, TokenKind: tokenKindTeam, TokenOrganization: "acme"}
+	noOrgs := &currentUser{Name: "octocat", TokenKind: tokenKindPersonal}
+
+	tests := []struct {
+		name      string
+		user      *currentUser
+		requested string
+		want      string
+		wantErr   string
+	}{
+		{"requested organization", personal, "example", "example", ""},
+		{"personal account", personal, "octocat", "octocat", ""},
+		{"personal account with a team token", team, "web", "", "it can access: acme"},
+		{"inaccessible organization", personal, "other", "", "it can access: acme, example"},
+		{"inaccessible organization without organizations", noOrgs, "other", "", "cannot access organization 'other'"},
+		{"only organization", team, "", "acme", ""},
+		{"several organizations", personal, "", "", "set -org to choose one"},
+		{"no organizations", noOrgs, "", "", "set -org to use a personal account"},
+	}
+	for _, tt := range tests {
+		got, err := selectOrg(tt.user, tt.requested)
+		switch {
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: got error %v, want one containing %q", tt.name, err, tt.wantErr)
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case got != tt.want:
+			t.Errorf("%s: got organization %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+)
+
+// outputField maps a stack output to a field of the "get site outputs" response.
+type outputField struct {
+	// The name of the stack output.
+	Output string
+	// The name of the response field.
+	Field string
+}
+
+// parseOutputMapping parses a comma-separated list of stack outputs to expose. Each entry is either the name of an
+// output, which is exposed under the same name, or "output=field", which exposes the output under the given field
+// name. An empty mapping exposes all outputs under their own names.
+func parseOutputMapping(mapping string) ([]outputField, error) {
+	var fields []outputField
+	outputs, names := map[string]bool{}, map[string]bool{}
+	for _, entry := range strings.Split(mapping, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		output, field, ok := strings.Cut(entry, "=")
+		if !ok {
+			field = output
+		}
+		output, field = strings.TrimSpace(output), strings.TrimSpace(field)
+		switch {
+		case output == "" || field == "":
+			return nil, fmt.Errorf("output mapping %q must be of the form output or output=field", entry)
+		case outputs[output]:
+			return nil, fmt.Errorf("output %q is mapped more than once", output)
+		case names[field]:
+			return nil, fmt.Errorf("field %q is mapped more than once", field)
+		}
+		outputs[output], names[field] = true, true
+		fields = append(fields, outputField{Output: output, Field: field})
+	}
+	return fields, nil
+}
+
+// isSecret returns true if v is a secret value from a Pulumi checkpoint, i.e. an object whose resource.SigKey property
+// is resource.SecretSig.
+func isSecret(v interface{}) bool {
+	m, ok := v.(map[string]interface{})
+	return ok && m[resource.SigKey] == resource.SecretSig
+}
+
+// containsSecret returns true if v is or contains a secret value.
+func containsSecret(v interface{}) bool {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if isSecret(v) {
+			return true
+		}
+		for _, e := range v {
+			if containsSecret(e) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, e := range v {
+			if containsSecret(e) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// revealSecrets returns a copy of v with each secret value replaced by its plaintext.
+func (s *siteServer) revealSecrets(ctx context.Context, site string, v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if isSecret(v) {
+			if plaintext, ok := v["plaintext"].(string); ok {
+				var value interface{}
+				if err := json.Unmarshal([]byte(plaintext), &value); err != nil {
+					return nil, fmt.Errorf("decoding secret: %w", err)
+				}
+				return s.revealSecrets(ctx, site, value)
+			}
+			ciphertext, ok := v["ciphertext"].(string)
+			if !ok {
+				return nil, errors.New("secret has neither a plaintext nor a ciphertext")
+			}
+			plaintext, err := s.client.decryptValue(ctx, s.org, s.project, site, ciphertext)
+			if err != nil {
+				return nil, fmt.Errorf("decrypting secret: %w", err)
+			}
+			var value interface{}
+			if err := json.Unmarshal(plaintext, &value); err != nil {
+				return nil, fmt.Errorf("decoding secret: %w", err)
+			}
+			return s.revealSecrets(ctx, site, value)
+		}
+		revealed := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			r, err := s.revealSecrets(ctx, site, e)
+			if err != nil {
+				return nil, err
+			}
+			revealed[k] = r
+		}
+		return revealed, nil
+	case []interface{}:
+		revealed := make([]interface{}, len(v))
+		for i, e := range v {
+			r, err := s.revealSecrets(ctx, site, e)
+			if err != nil {
+				return nil, err
+			}
+			revealed[i] = r
+		}
+		return revealed, nil
+	default:
+		return v, nil
+	}
+}
+
+// canReadSecrets returns true if the client that made r presented an API key that is authorized to read secret
+// outputs.
+func (s *siteServer) canReadSecrets(r *http.Request) bool {
+	key := r.Header.Get(apiKeyHeader)
+	if key == "" {
+		return false
+	}
+	authorized := false
+	for _, k := range s.secretOutputKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+			authorized = true
+		}
+	}
+	return authorized
+}
+
+// getSiteOutputsResponse defines the body of a response from the "get site outputs" REST API.
+type getSiteOutputsResponse struct {
+	// The site's exposed stack outputs, by field name. Secret outputs are omitted unless the caller is authorized to
+	// read them.
+	Outputs map[string]interface{} `json:"outputs"`
+	// The field names of the secret outputs that were omitted, if any.
+	Redacted []string `json:"redacted,omitempty"`
+}
+
+// getOutputs implements the "get site outputs" REST API, which returns the outputs of a site's stack as configured by
+// the server's output mapping.
+//
+// Outputs that are or contain secrets are only returned to callers whose API key is authorized to read secret
+// outputs. For other callers, such outputs are omitted and their field names are listed as redacted.
+func (s *siteServer) getOutputs(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	id := params.ByName("id")
+	if p := validateParams(validateSiteID(id)); p != nil {
+		p.write(w, r)
+		return
+	}
+
+	outputs, err := s.client.getStackOutputs(r.Context(), s.org, s.project, id)
+	if err != nil {
+		if err == errStackNotFound {
+			siteNotFound(w, r, id)
+		} else {
+			serverError(w, r, fmt.Errorf("getting stack outputs: %w", err))
+		}
+		return
+	}
+
+	mapping := s.outputMapping
+	if len(mapping) == 0 {
+		for name := range outputs {
+			mapping = append(mapping, outputField{Output: name, Field: name})
+		}
+	}
+
+	resp := getSiteOutputsResponse{Outputs: map[string]interface{}{}}
+	readSecrets := s.canReadSecrets(r)
+	for _, f := range mapping {
+		value, ok := outputs[f.Output]
+		if !ok {
+			continue
+		}
+		if containsSecret(value) {
+			if !readSecrets {
+				resp.Redacted = append(resp.Redacted, f.Field)
+				continue
+			}
+			if value, err = s.revealSecrets(r.Context(), id, value); err != nil {
+				serverError(w, r, fmt.Errorf("revealing output %q: %w", f.Output, err))
+				return
+			}
+		}
+		resp.Outputs[f.Field] = value
+	}
+	sort.Strings(resp.Redacted)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
+		logf(r.Context(), "encoding response: %v", err)
+	}
+}
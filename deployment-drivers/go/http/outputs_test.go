@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+)
+
+func TestParseOutputMapping(t *testing.T) {
+	tests := []struct {
+		mapping string
+		want    []outputField
+		wantErr string
+	}{
+		{"", nil, ""},
+		{"websiteUrl", []outputField{{"websiteUrl", "websiteUrl"}}, ""},
+		{" websiteUrl = url , bucketName ,", []outputField{{"websiteUrl", "url"}, {"bucketName", "bucketName"}}, ""},
+		{"=url", nil, "must be of the form output or output=field"},
+		{"websiteUrl=", nil, "must be of the form output or output=field"},
+		{"websiteUrl=a,websiteUrl=b", nil, `output "websiteUrl" is mapped more than once`},
+		{"websiteUrl=url,cdnUrl=url", nil, `field "url" is mapped more than once`},
+	}
+	for _, tt := range tests {
+		got, err := parseOutputMapping(tt.mapping)
+		switch {
+		case tt.wantErr != "":
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseOutputMapping(%q): got error %v, want one containing %q", tt.mapping, err, tt.wantErr)
+			}
+		case err != nil:
+			t.Errorf("parseOutputMapping(%q): %v", tt.mapping, err)
+		case !reflect.DeepEqual(got, tt.want):
+			t.Errorf("parseOutputMapping(%q) = %v, want %v", tt.mapping, got, tt.want)
+		}
+	}
+}
+
+// secretValue returns a checkpoint secret value with the given properties.
+func secretValue(props map[string]interface{}) map[string]interface{} {
+	secret := map[string]interface{}{resource.SigKey: resource.SecretSig}
+	for k, v := range props {
+		secret[k] = v
+	}
+	return secret
+}
+
+func TestContainsSecret(t *testing.T) {
+	secret := secretValue(map[string]interface{}{"ciphertext": "abc"})
+	tests := []struct {
+		name string
+		v    interface{}
+		want bool
+	}{
+		{"string", "hello", false},
+		{"object", map[string]interface{}{"a": 1.0}, false},
+		{"secret", secret, true},
+		{"nested in an object", map[string]interface{}{"a": map[string]interface{}{"b": secret}}, true},
+		{"nested in an array", []interface{}{"a", secret}, true},
+		{"other signature", map[string]interface{}{resource.SigKey: "other"}, false},
+	}
+	for _, tt := range tests {
+		if got := containsSecret(tt.v); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGetOutputs(t *testing.T) {
+	outputs := map[string]interface{}{
+		"websiteUrl": "http://bucket",
+		"bucketName": "bucket",
+		"apiKey":     secretValue(map[string]interface{}{"ciphertext": "Y2lwaGVy"}),
+		"config":     map[string]interface{}{"password": secretValue(map[string]interface{}{"plaintext": `"hunter2"`})},
+	}
+	tests := []struct {
+		name     string
+		mapping  string
+		key      string
+		want     map[string]interface{}
+		redacted []string
+	}{
+		{
+			name:     "all outputs without a key",
+			want:     map[string]interface{}{"websiteUrl": "http://bucket", "bucketName": "bucket"},
+			redacted: []string{"apiKey", "config"},
+		},
+		{
+			name:     "unauthorized key",
+			mapping:  "websiteUrl=url,apiKey",
+			key:      "other",
+			want:     map[string]interface{}{"url": "http://bucket"},
+			redacted: []string{"apiKey"},
+		},
+		{
+			name:    "authorized key",
+			mapping: "websiteUrl=url,apiKey=key,config,missing",
+			key:     "reader",
+			want: map[string]interface{}{
+				"url":    "http://bucket",
+				"key":    "decrypted",
+				"config": map[string]interface{}{"password": "hunter2"},
+			},
+		},
+	}
+	captureLog(t)
+
+	for _, tt := range tests {
+		var decrypted []string
+		client := fakePulumiClient(func(r *http.Request) (int, string) {
+			if strings.HasSuffix(r.URL.Path, "/decrypt") {
+				decrypted = append(decrypted, r.URL.Path)
+				// The plaintext is the base64 encoding of the JSON string "decrypted".
+				return http.StatusOK, `{"plaintext": "ImRlY3J5cHRlZCI="}`
+			}
+			state, _ := json.Marshal(map[string]interface{}{
+				"resources": []interface{}{map[string]interface{}{"type": stackResourceType, "outputs": outputs}},
+			})
+			return http.StatusOK, `{"version": 3, "deployment": ` + string(state) + `}`
+		})
+		mapping, err := parseOutputMapping(tt.mapping)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &siteServer{client: client, org: "acme", project: "sites", outputMapping: mapping, secretOutputKeys: []string{"reader"}}
+
+		r := httptest.NewRequest(http.MethodGet, "/sites/blog/outputs", nil)
+		if tt.key != "" {
+			r.Header.Set(apiKeyHeader, tt.key)
+		}
+		w := httptest.NewRecorder()
+		s.getOutputs(w, r, httprouter.Params{{Key: "id", Value: "blog"}})
+
+		var resp getSiteOutputsResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: %v: %s", tt.name, err, w.Body)
+		}
+		if !reflect.DeepEqual(resp.Outputs, tt.want) || !reflect.DeepEqual(resp.Redacted, tt.redacted) {
+			t.Errorf("%s: got outputs %v redacting %v, want %v redacting %v", tt.name, resp.Outputs, resp.Redacted, tt.want, tt.redacted)
+		}
+		if strings.Contains(w.Body.String(), "Y2lwaGVy") {
+			t.Errorf("%s: response contains a secret's ciphertext: %s", tt.name, w.Body)
+		}
+		if tt.key != "reader" && len(decrypted) != 0 {
+			t.Errorf("%s: decrypted secrets for an unauthorized caller", tt.name)
+		}
+	}
+}
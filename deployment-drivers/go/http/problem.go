@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// Machine-readable codes for the errors returned by the REST API. Each code also identifies the problem type: a
+// problem with code "site_not_found" has the type "/problems/site_not_found".
+const (
+	codeValidation            = "validation_failed"
+	codeMalformed             = "malformed_body"
+	codeUnsupportedMediaType  = "unsupported_media_type"
+	codeTooLarge              = "body_too_large"
+	codeNotFound              = "not_found"
+	codeMethodNotAllowed      = "method_not_allowed"
+	codeNotReady              = "not_ready"
+	codeSiteNotFound          = "site_not_found"
+	codeSiteExists            = "site_exists"
+	codeRevisionNotFound      = "revision_not_found"
+	codeRevisionNotDeployed   = "revision_not_deployed"
+	codeDomainClaimed         = "domain_claimed"
+	codeDomainNotFound        = "domain_not_found"
+	codeDomainNotValidated    = "domain_not_validated"
+	codeRateLimited           = "rate_limited"
+	codeQuotaExceeded         = "quota_exceeded"
+	codeIdempotencyKeyReused  = "idempotency_key_reused"
+	codeIdempotencyInProgress = "idempotency_in_progress"
+	codeInternal              = "internal_error"
+	codePulumiUnauthorized    = "pulumi_unauthorized"
+	codePulumiForbidden       = "pulumi_forbidden"
+	codePulumiConflict        = "pulumi_conflict"
+	codePulumiRateLimited     = "pulumi_rate_limited"
+	codePulumiUnavailable     = "pulumi_unavailable"
+)
+
+// problem defines the body of an error response from the REST API. Its fields follow RFC 7807, with extension members
+// for the error code, request ID, retryability, and any underlying Pulumi API error.
+type problem struct {
+	// A URI reference that identifies the problem type. Derived from Code if empty.
+	Type string `json:"type"`
+	// A short, human-readable summary of the problem type.
+	Title string `json:"title"`
+	// The HTTP status code for this occurrence of the problem.
+	Status int `json:"status"`
+	// A human-readable explanation specific to this occurrence of the problem.
+	Detail string `json:"detail,omitempty"`
+	// A machine-readable code for the problem type.
+	Code string `json:"code"`
+	// The ID of the request that caused the problem.
+	RequestID string `json:"requestId,omitempty"`
+	// True if the request may succeed if it is retried without modification.
+	Retryable bool `json:"retryable"`
+	// The request fields that failed validation, if any.
+	InvalidParams []invalidParam `json:"invalid-params,omitempty"`
+	// The error returned by the Pulumi API, if any.
+	Upstream *pulumiAPIError `json:"upstream,omitempty"`
+
+	// The value of the Retry-After header to send with the response, if any.
+	retryAfter string
+}
+
+// write writes p to w as an application/problem+json response.
+func (p *problem) write(w http.ResponseWriter, r *http.Request) {
+	if p.Type == "" {
+		p.Type = "/problems/" + p.Code
+	}
+	p.RequestID = requestIDFromContext(r.Context())
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	if p.retryAfter != "" {
+		w.Header().Set("Retry-After", p.retryAfter)
+	}
+	w.WriteHeader(p.Status)
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		logf(r.Context(), "writing problem response: %v", err)
+	}
+}
+
+// siteNotFound is a helper that writes a 404 response to w.
+func siteNotFound(w http.ResponseWriter, r *http.Request, id string) {
+	p := problem{
+		Title:  "Site not found.",
+		Status: http.StatusNotFound,
+		Detail: fmt.Sprintf("site '%s' not found", id),
+		Code:   codeSiteNotFound,
+	}
+	p.write(w, r)
+}
+
+// serverError is a helper that writes a response for an unexpected error to w and logs the error to the terminal.
+//
+// Errors returned by the Pulumi API are mapped to the most appropriate status code: authentication and authorization
+// failures indicate that the server is misconfigured and are reported as 502s, conflicts are reported as 409s, and
+// rate limiting is reported as a 429 with the upstream Retry-After header. Other upstream failures are reported as
+// retryable 502s. Any other error is reported as a 500.
+func serverError(w http.ResponseWriter, r *http.Request, err error) {
+	logf(r.Context(), "request failed: %v", err)
+
+	p := problem{
+		Title:  "Internal server error.",
+		Status: http.StatusInternalServerError,
+		Code:   codeInternal,
+	}
+
+	var apiErr *pulumiAPIError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &apiErr):
+		p.Detail, p.Upstream = apiErr.Message, apiErr
+		switch {
+		case apiErr.StatusCode == http.StatusUnauthorized:
+			p.Title, p.Status, p.Code = "The server's Pulumi access token was rejected.", http.StatusBadGateway, codePulumiUnauthorized
+		case apiErr.StatusCode == http.StatusForbidden:
+			p.Title, p.Status, p.Code = "The server is not permitted to perform this operation.", http.StatusBadGateway, codePulumiForbidden
+		case apiErr.StatusCode == http.StatusConflict:
+			p.Title, p.Status, p.Code = "The operation conflicts with the site's current state.", http.StatusConflict, codePulumiConflict
+			p.Retryable = true
+		case apiErr.StatusCode == http.StatusTooManyRequests:
+			p.Title, p.Status, p.Code = "The Pulumi API rate limit was exceeded.", http.StatusTooManyRequests, codePulumiRateLimited
+			p.Retryable, p.retryAfter = true, apiErr.retryAfter
+		case apiErr.StatusCode >= 500:
+			p.Title, p.Status, p.Code = "The Pulumi API is unavailable.", http.StatusBadGateway, codePulumiUnavailable
+			p.Retryable = true
+		}
+	case errors.As(err, &netErr), errors.Is(err, context.DeadlineExceeded):
+		p.Title, p.Status, p.Code = "The Pulumi API is unavailable.", http.StatusBadGateway, codePulumiUnavailable
+		p.Retryable = true
+	}
+
+	p.write(w, r)
+}
+
+// notFound writes a 404 response for requests that do not match any route.
+func notFound(w http.ResponseWriter, r *http.Request) {
+	p := problem{
+		Title:  "Not found.",
+		Status: http.StatusNotFound,
+		Detail: fmt.Sprintf("no route for %v", r.URL.Path),
+		Code:   codeNotFound,
+	}
+	p.write(w, r)
+}
+
+// methodNotAllowed writes a 405 response for requests whose method does not match any route for their path.
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	p := problem{
+		Title:  "Method not allowed.",
+		Status: http.StatusMethodNotAllowed,
+		Detail: fmt.Sprintf("%v is not supported for %v", r.Method, r.URL.Path),
+		Code:   codeMethodNotAllowed,
+	}
+	p.write(w, r)
+}
+
+// panicked writes a 500 response for requests whose handler panicked.
+func panicked(w http.ResponseWriter, r *http.Request, v interface{}) {
+	serverError(w, r, fmt.Errorf("panic: %v", v))
+}
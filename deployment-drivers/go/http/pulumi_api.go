@@ -5,15 +5,31 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"path"
 
 	"github.com/go-resty/resty/v2"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const pulumiURL = "https://api.pulumi.com/api"
 
+// stackResourceType is the type of the resource that holds a stack's outputs.
+const stackResourceType = "pulumi:pulumi:Stack"
+
+// The sources that stack outputs can be read from.
+const (
+	// The stack's checkpoint is exported and its secret outputs are decrypted one by one.
+	outputsSourceExport = "export"
+	// The Pulumi service's stack outputs API returns the outputs with their secrets decrypted.
+	outputsSourceAPI = "api"
+)
+
 // DeploymentSettings defines a settings payload for the Deployment API.
 type DeploymentSettings struct {
 	SourceContext    *sourceContext    `json:"sourceContext,omitempty"`
@@ -80,8 +96,22 @@ type createDeploymentRequest struct {
 	Operation string `json:"operation"`
 }
 
+// createDeploymentResponse defines the body of a response from the "create deployment" REST API.
+type createDeploymentResponse struct {
+	// The ID of the new deployment.
+	ID string `json:"id"`
+}
+
+// getDeploymentResponse defines the body of a response from the "get deployment" REST API.
+type getDeploymentResponse struct {
+	// Status is the current status of the deployment.
+	Status string `json:"status"`
+}
+
 // listDeploymentRequest defines the body of a request to the "list deployments" REST API.
 type listDeploymentsResponse struct {
+	// Version is the deployment's version, which increases with each deployment of the stack.
+	Version int `json:"version"`
 	// Status is the current status of the deployment.
 	Status string `json:"status"`
 }
@@ -89,28 +119,91 @@ type listDeploymentsResponse struct {
 var errStackExists = errors.New("stack already exists")
 var errStackNotFound = errors.New("stack not found")
 
+// pulumiAPIError describes an unexpected error response from the Pulumi API.
+type pulumiAPIError struct {
+	// The HTTP status code of the response.
+	StatusCode int `json:"status"`
+	// The error message from the response body.
+	Message string `json:"message"`
+
+	// The value of the response's Retry-After header, if any.
+	retryAfter string
+}
+
+func (e *pulumiAPIError) Error() string {
+	return fmt.Sprintf("%v: %s", e.StatusCode, e.Message)
+}
+
+// newPulumiAPIError creates a pulumiAPIError from an unexpected response. If the response was not parsed, newPulumiAPIError
+// reads its raw body.
+func newPulumiAPIError(resp *resty.Response) error {
+	// errorResponse defines the body of an error response from the Pulumi API.
+	type errorResponse struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+
+	body := resp.Body()
+	if body == nil && resp.RawBody() != nil {
+		body, _ = io.ReadAll(io.LimitReader(resp.RawBody(), 64*1024))
+	}
+
+	message := string(body)
+	var errResp errorResponse
+	if err := json.Unmarshal(body, &errResp); err == nil && errResp.Message != "" {
+		message = errResp.Message
+	}
+	return &pulumiAPIError{
+		StatusCode: resp.StatusCode(),
+		Message:    message,
+		retryAfter: resp.Header().Get("Retry-After"),
+	}
+}
+
 type pulumiClient struct {
 	client *resty.Client
 	token  string
+
+	// Where getStackOutputs reads stack outputs from. One of outputsSourceExport or outputsSourceAPI.
+	outputsSource string
 }
 
 func newPulumiClient(token string) *pulumiClient {
+	client := resty.New().
+		OnBeforeRequest(func(_ *resty.Client, req *resty.Request) error {
+			// Forward the ID of the request being served, if any, so that Pulumi API calls can be correlated with it.
+			if id := requestIDFromContext(req.Context()); id != "" {
+				req.SetHeader(requestIDHeader, id)
+			}
+			// Propagate the current trace.
+			otel.GetTextMapPropagator().Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+			return nil
+		}).
+		OnAfterResponse(func(_ *resty.Client, resp *resty.Response) error {
+			trace.SpanFromContext(resp.Request.Context()).SetAttributes(semconv.HTTPStatusCodeKey.Int(resp.StatusCode()))
+			return nil
+		})
 	return &pulumiClient{
-		client: resty.New(),
+		client: client,
 		token:  token,
 	}
 }
 
-func (c *pulumiClient) createStack(ctx context.Context, org, project, stack string) error {
+func (c *pulumiClient) createStack(ctx context.Context, org, project, stack string, tags map[string]string) (err error) {
+	ctx, end := startPulumiCall(ctx, "createStack", stackAttributes(org, project, stack)...)
+	defer end(&err)
+
 	// createStackRequest defines the body of a request to the "create stack" REST API.
 	type createStackRequest struct {
 		// The name of the stack to create.
 		StackName string `json:"stackName"`
+		// The stack's initial tags.
+		Tags map[string]string `json:"tags,omitempty"`
 	}
 
 	resp, err := c.client.R().
 		SetContext(ctx).
-		SetBody(createStackRequest{StackName: stack}).
+		SetBody(createStackRequest{StackName: stack, Tags: tags}).
 		SetHeader("Authorization", "token "+c.token).
 		SetHeader("Accept", "application/json").
 		Post(pulumiURL + path.Join("/stacks", org, project))
@@ -123,11 +216,74 @@ func (c *pulumiClient) createStack(ctx context.Context, org, project, stack stri
 	case http.StatusConflict:
 		return errStackExists
 	default:
-		return fmt.Errorf("%v: %s", resp.StatusCode(), string(resp.Body()))
+		return newPulumiAPIError(resp)
 	}
 }
 
-func (c *pulumiClient) deleteStack(ctx context.Context, org, project, stack string) error {
+// listStacksWithTag returns the names of the stacks in the given project that have a tag with the given name and value.
+func (c *pulumiClient) listStacksWithTag(ctx context.Context, org, project, tagName, tagValue string) (_ []string, err error) {
+	ctx, end := startPulumiCall(ctx, "listStacksWithTag", pulumiOrgKey.String(org), pulumiProjectKey.String(project))
+	defer end(&err)
+
+	// stackSummary describes a stack in a response from the "list stacks" REST API.
+	type stackSummary struct {
+		// The name of the stack's project.
+		ProjectName string `json:"projectName"`
+		// The name of the stack.
+		StackName string `json:"stackName"`
+	}
+
+	// listStacksResponse defines the body of a response from the "list stacks" REST API.
+	type listStacksResponse struct {
+		// A page of stacks.
+		Stacks []stackSummary `json:"stacks"`
+		// The token for the next page, if any.
+		ContinuationToken *string `json:"continuationToken,omitempty"`
+	}
+
+	var stacks []string
+	for continuationToken := ""; ; {
+		params := map[string]string{
+			"organization": org,
+			"project":      project,
+			"tagName":      tagName,
+			"tagValue":     tagValue,
+		}
+		if continuationToken != "" {
+			params["continuationToken"] = continuationToken
+		}
+
+		var respBody listStacksResponse
+		resp, err := c.client.R().
+			SetContext(ctx).
+			SetQueryParams(params).
+			SetResult(&respBody).
+			SetHeader("Authorization", "token "+c.token).
+			SetHeader("Accept", "application/json").
+			Get(pulumiURL + "/user/stacks")
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode() != http.StatusOK {
+			return nil, newPulumiAPIError(resp)
+		}
+
+		for _, s := range respBody.Stacks {
+			if s.ProjectName == project {
+				stacks = append(stacks, s.StackName)
+			}
+		}
+		if respBody.ContinuationToken == nil || *respBody.ContinuationToken == "" {
+			return stacks, nil
+		}
+		continuationToken = *respBody.ContinuationToken
+	}
+}
+
+func (c *pulumiClient) deleteStack(ctx context.Context, org, project, stack string) (err error) {
+	ctx, end := startPulumiCall(ctx, "deleteStack", stackAttributes(org, project, stack)...)
+	defer end(&err)
+
 	resp, err := c.client.R().
 		SetContext(ctx).
 		SetHeader("Authorization", "token "+c.token).
@@ -142,11 +298,14 @@ func (c *pulumiClient) deleteStack(ctx context.Context, org, project, stack stri
 	case http.StatusNotFound:
 		return errStackNotFound
 	default:
-		return fmt.Errorf("%v: %s", resp.StatusCode(), string(resp.Body()))
+		return newPulumiAPIError(resp)
 	}
 }
 
-func (c *pulumiClient) patchDeploymentSettings(ctx context.Context, org, project, stack string, settings DeploymentSettings) error {
+func (c *pulumiClient) patchDeploymentSettings(ctx context.Context, org, project, stack string, settings DeploymentSettings) (err error) {
+	ctx, end := startPulumiCall(ctx, "patchDeploymentSettings", stackAttributes(org, project, stack)...)
+	defer end(&err)
+
 	resp, err := c.client.R().
 		SetContext(ctx).
 		SetBody(settings).
@@ -162,31 +321,65 @@ func (c *pulumiClient) patchDeploymentSettings(ctx context.Context, org, project
 	case http.StatusNotFound:
 		return errStackNotFound
 	default:
-		return fmt.Errorf("%v: %s", resp.StatusCode(), string(resp.Body()))
+		return newPulumiAPIError(resp)
 	}
 }
 
-func (c *pulumiClient) createDeployment(ctx context.Context, org, project, stack string, req createDeploymentRequest) error {
+func (c *pulumiClient) createDeployment(ctx context.Context, org, project, stack string, req createDeploymentRequest) (_ string, err error) {
+	ctx, end := startPulumiCall(ctx, "createDeployment",
+		append(stackAttributes(org, project, stack), pulumiOperationKey.String(req.Operation))...)
+	defer end(&err)
+
+	var respBody createDeploymentResponse
 	resp, err := c.client.R().
 		SetContext(ctx).
 		SetBody(req).
+		SetResult(&respBody).
 		SetHeader("Authorization", "token "+c.token).
 		SetHeader("Accept", "application/json").
 		Post(pulumiURL + path.Join("/preview", org, project, stack, "deployments"))
 	if err != nil {
-		return err
+		return "", err
 	}
 	switch resp.StatusCode() {
 	case http.StatusAccepted:
-		return nil
+		deploymentsStartedTotal.WithLabelValues(req.Operation).Inc()
+		return respBody.ID, nil
 	case http.StatusNotFound:
-		return errStackNotFound
+		return "", errStackNotFound
 	default:
-		return fmt.Errorf("%v: %s", resp.StatusCode(), string(resp.Body()))
+		return "", newPulumiAPIError(resp)
 	}
 }
 
-func (c *pulumiClient) listStackDeployments(ctx context.Context, org, project, stack string, page int) ([]listDeploymentsResponse, error) {
+func (c *pulumiClient) getDeploymentStatus(ctx context.Context, org, project, stack, id string) (_ string, err error) {
+	ctx, end := startPulumiCall(ctx, "getDeploymentStatus", stackAttributes(org, project, stack)...)
+	defer end(&err)
+
+	var respBody getDeploymentResponse
+	resp, err := c.client.R().
+		SetContext(ctx).
+		SetResult(&respBody).
+		SetHeader("Authorization", "token "+c.token).
+		SetHeader("Accept", "application/json").
+		Get(pulumiURL + path.Join("/preview", org, project, stack, "deployments", id))
+	if err != nil {
+		return "", err
+	}
+	switch resp.StatusCode() {
+	case http.StatusOK:
+		return respBody.Status, nil
+	case http.StatusNotFound:
+		return "", errStackNotFound
+	default:
+		return "", newPulumiAPIError(resp)
+	}
+}
+
+func (c *pulumiClient) listStackDeployments(ctx context.Context, org, project, stack string, page int) (_ []listDeploymentsResponse, err error) {
+	ctx, end := startPulumiCall(ctx, "listStackDeployments", stackAttributes(org, project, stack)...)
+	defer end(&err)
+
 	resp, err := c.client.R().
 		SetContext(ctx).
 		SetHeader("Authorization", "token "+c.token).
@@ -196,15 +389,15 @@ func (c *pulumiClient) listStackDeployments(ctx context.Context, org, project, s
 	if err != nil {
 		return nil, err
 	}
+	defer resp.RawBody().Close()
 	switch resp.StatusCode() {
 	case http.StatusOK:
 		// OK
 	case http.StatusNotFound:
 		return nil, errStackNotFound
 	default:
-		return nil, fmt.Errorf("%v: %s", resp.StatusCode(), string(resp.Body()))
+		return nil, newPulumiAPIError(resp)
 	}
-	defer resp.RawBody().Close()
 
 	var respBody []listDeploymentsResponse
 	if err = json.NewDecoder(resp.RawBody()).Decode(&respBody); err != nil {
@@ -213,20 +406,37 @@ func (c *pulumiClient) listStackDeployments(ctx context.Context, org, project, s
 	return respBody, nil
 }
 
-func (c *pulumiClient) getStackCurrentDeploymentStatus(ctx context.Context, org, project, stack string) (string, error) {
-	for page, lastDeploymentStatus := 1, ""; ; page++ {
+func (c *pulumiClient) getStackCurrentDeploymentStatus(ctx context.Context, org, project, stack string) (_ string, err error) {
+	ctx, end := startPulumiCall(ctx, "getStackCurrentDeploymentStatus", stackAttributes(org, project, stack)...)
+	defer end(&err)
+
+	// The order of the listed deployments isn't relied upon: the current deployment is the one with the highest version.
+	var current listDeploymentsResponse
+	for page := 1; ; page++ {
 		deployments, err := c.listStackDeployments(ctx, org, project, stack, page)
 		if err != nil {
 			return "", err
 		}
 		if len(deployments) == 0 {
-			return lastDeploymentStatus, nil
+			return current.Status, nil
+		}
+		for _, d := range deployments {
+			if d.Version > current.Version {
+				current = d
+			}
 		}
-		lastDeploymentStatus = deployments[len(deployments)-1].Status
 	}
 }
 
-func (c *pulumiClient) getStackOutputs(ctx context.Context, org, project, stack string) (map[string]interface{}, error) {
+// getStackOutputs returns the outputs of a stack, read from the source chosen by the client's outputsSource.
+func (c *pulumiClient) getStackOutputs(ctx context.Context, org, project, stack string) (_ map[string]interface{}, err error) {
+	if c.outputsSource == outputsSourceAPI {
+		return c.getStackOutputsDecrypted(ctx, org, project, stack)
+	}
+
+	ctx, end := startPulumiCall(ctx, "getStackOutputs", stackAttributes(org, project, stack)...)
+	defer end(&err)
+
 	resp, err := c.client.R().
 		SetContext(ctx).
 		SetHeader("Authorization", "token "+c.token).
@@ -236,54 +446,186 @@ func (c *pulumiClient) getStackOutputs(ctx context.Context, org, project, stack
 	if err != nil {
 		return nil, err
 	}
+	defer resp.RawBody().Close()
 	switch resp.StatusCode() {
 	case http.StatusOK:
 		// OK
 	case http.StatusNotFound:
 		return nil, errStackNotFound
 	default:
-		return nil, fmt.Errorf("%v: %s", resp.StatusCode(), string(resp.Body()))
+		return nil, newPulumiAPIError(resp)
 	}
-	defer resp.RawBody().Close()
 
 	var respBody apitype.UntypedDeployment
 	if err = json.NewDecoder(resp.RawBody()).Decode(&respBody); err != nil {
 		return nil, err
 	}
-	if respBody.Version != apitype.DeploymentSchemaVersionCurrent {
+	return checkpointOutputs(respBody)
+}
+
+// checkpoint is the part of an exported stack checkpoint that holds the stack's outputs. Versions 1 through 3 of the
+// checkpoint schema share this shape.
+type checkpoint struct {
+	Resources []struct {
+		Type    string                 `json:"type"`
+		Outputs map[string]interface{} `json:"outputs"`
+	} `json:"resources"`
+}
+
+// checkpointOutputs returns the outputs of the stack resource in an exported checkpoint. If the checkpoint has no
+// stack resource, e.g. because the stack has never been deployed, checkpointOutputs returns nil. Secret outputs are
+// returned as-is, i.e. as objects marked with resource.SigKey that hold the secret's ciphertext.
+func checkpointOutputs(deployment apitype.UntypedDeployment) (map[string]interface{}, error) {
+	if deployment.Version < 1 || deployment.Version > apitype.DeploymentSchemaVersionCurrent {
+		return nil, fmt.Errorf("unsupported checkpoint version %v; versions 1 through %v are supported",
+			deployment.Version, apitype.DeploymentSchemaVersionCurrent)
+	}
+	if len(deployment.Deployment) == 0 {
 		return nil, nil
 	}
-	var state apitype.DeploymentV3
-	if err = json.Unmarshal([]byte(respBody.Deployment), &state); err != nil {
-		return nil, fmt.Errorf("unmarshaling deployment: %w", err)
+
+	var state checkpoint
+	if err := json.Unmarshal(deployment.Deployment, &state); err != nil {
+		return nil, fmt.Errorf("unmarshaling version %v checkpoint: %w", deployment.Version, err)
 	}
-	var stackResource *apitype.ResourceV3
 	for _, r := range state.Resources {
-		if r.Type == "pulumi:pulumi:Stack" {
-			stackResource = &r
-			break
+		if r.Type == stackResourceType {
+			return r.Outputs, nil
 		}
 	}
-	if stackResource == nil {
-		return nil, nil
+	return nil, nil
+}
+
+// getStackOutputsDecrypted returns the outputs of a stack using the Pulumi service's stack outputs API rather than by
+// exporting the stack's checkpoint, so that the stack's whole state is not downloaded. Secret outputs are returned
+// decrypted, but still marked with resource.SigKey so that they can be redacted.
+func (c *pulumiClient) getStackOutputsDecrypted(ctx context.Context, org, project, stack string) (_ map[string]interface{}, err error) {
+	ctx, end := startPulumiCall(ctx, "getStackOutputsDecrypted", stackAttributes(org, project, stack)...)
+	defer end(&err)
+
+	// stackOutputsResponse defines the body of a response from the "get stack outputs" REST API.
+	type stackOutputsResponse struct {
+		// The stack's outputs. Each secret output is an object with a "plaintext" property that holds the secret's
+		// JSON-encoded value.
+		Outputs map[string]interface{} `json:"outputs"`
+	}
+
+	var respBody stackOutputsResponse
+	resp, err := c.client.R().
+		SetContext(ctx).
+		SetQueryParam("decrypt", "true").
+		SetResult(&respBody).
+		SetHeader("Authorization", "token "+c.token).
+		SetHeader("Accept", "application/json").
+		Get(pulumiURL + path.Join("/stacks", org, project, stack, "outputs"))
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode() {
+	case http.StatusOK:
+		return respBody.Outputs, nil
+	case http.StatusNotFound:
+		return nil, errStackNotFound
+	default:
+		return nil, newPulumiAPIError(resp)
+	}
+}
+
+// decryptValue decrypts a secret value from a stack's checkpoint using the stack's service-managed secrets provider.
+// The ciphertext is the base64-encoded value of the secret's "ciphertext" property.
+func (c *pulumiClient) decryptValue(ctx context.Context, org, project, stack, ciphertext string) (_ []byte, err error) {
+	ctx, end := startPulumiCall(ctx, "decryptValue", stackAttributes(org, project, stack)...)
+	defer end(&err)
+
+	// decryptValueRequest defines the body of a request to the "decrypt value" REST API.
+	type decryptValueRequest struct {
+		// The base64-encoded ciphertext to decrypt.
+		Ciphertext string `json:"ciphertext"`
+	}
+
+	// decryptValueResponse defines the body of a response from the "decrypt value" REST API.
+	type decryptValueResponse struct {
+		// The decrypted value. Encoded as base64 in JSON.
+		Plaintext []byte `json:"plaintext"`
+	}
+
+	var respBody decryptValueResponse
+	resp, err := c.client.R().
+		SetContext(ctx).
+		SetBody(decryptValueRequest{Ciphertext: ciphertext}).
+		SetResult(&respBody).
+		SetHeader("Authorization", "token "+c.token).
+		SetHeader("Accept", "application/json").
+		Post(pulumiURL + path.Join("/stacks", org, project, stack, "decrypt"))
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode() {
+	case http.StatusOK:
+		return respBody.Plaintext, nil
+	case http.StatusNotFound:
+		return nil, errStackNotFound
+	default:
+		return nil, newPulumiAPIError(resp)
 	}
-	return stackResource.Outputs, nil
 }
 
-func (c *pulumiClient) getCurrentOrgs() ([]string, error) {
+// Kinds of Pulumi API tokens.
+const (
+	tokenKindPersonal     = "personal"
+	tokenKindOrganization = "organization"
+	tokenKindTeam         = "team"
+)
+
+// currentUser describes the identity associated with a Pulumi API token.
+type currentUser struct {
+	// The name of the user. For organization and team tokens, this is the name of the token's service identity.
+	Name string
+	// The organizations the token can access.
+	Organizations []string
+
+	// The kind of the token: one of tokenKindPersonal, tokenKindOrganization, or tokenKindTeam.
+	TokenKind string
+	// The name of the token. Only set for organization and team tokens.
+	TokenName string
+	// The organization that owns the token. Only set for organization and team tokens.
+	TokenOrganization string
+	// The team that owns the token. Only set for team tokens.
+	TokenTeam string
+}
+
+func (c *pulumiClient) getCurrentUser(ctx context.Context) (_ *currentUser, err error) {
+	ctx, end := startPulumiCall(ctx, "getCurrentUser")
+	defer end(&err)
+
 	// organizationSummary describes summary information about a Pulumi organization.
 	type organizationSummary struct {
 		// The short name of the Pulumi organization (e.g. "pulumi").
 		GitHubLogin string `json:"githubLogin"`
 	}
 
+	// tokenInfo describes a non-personal access token.
+	type tokenInfo struct {
+		// The name of the token.
+		Name string `json:"name"`
+		// The organization that owns the token.
+		Organization string `json:"organization,omitempty"`
+		// The team that owns the token, if it is a team token.
+		Team string `json:"team,omitempty"`
+	}
+
 	// getUserResponse defines the body of a response from the "get current user" REST API.
 	type getUserResponse struct {
+		// The short name of the user (e.g. "octocat").
+		GitHubLogin string `json:"githubLogin"`
 		// The set of organizations the user belongs to.
 		Organizations []organizationSummary `json:"organizations"`
+		// Information about the token used to make the request. Absent for personal tokens.
+		TokenInfo *tokenInfo `json:"tokenInfo,omitempty"`
 	}
 
 	resp, err := c.client.R().
+		SetContext(ctx).
 		SetHeader("Authorization", "token "+c.token).
 		SetHeader("Accept", "application/json").
 		SetDoNotParseResponse(true).
@@ -291,19 +633,34 @@ func (c *pulumiClient) getCurrentOrgs() ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer resp.RawBody().Close()
 	if resp.StatusCode() != http.StatusOK {
-		return nil, fmt.Errorf("%v: %v", resp.StatusCode(), (string(resp.Body())))
+		return nil, newPulumiAPIError(resp)
 	}
-	defer resp.RawBody().Close()
 
 	var body getUserResponse
 	if err := json.NewDecoder(resp.RawBody()).Decode(&body); err != nil {
 		return nil, fmt.Errorf("decoding user response: %w", err)
 	}
 
-	orgs := make([]string, len(body.Organizations))
-	for i, o := range body.Organizations {
-		orgs[i] = o.GitHubLogin
+	user := &currentUser{
+		Name:      body.GitHubLogin,
+		TokenKind: tokenKindPersonal,
+	}
+	for _, o := range body.Organizations {
+		user.Organizations = append(user.Organizations, o.GitHubLogin)
+	}
+	if info := body.TokenInfo; info != nil {
+		user.TokenKind = tokenKindOrganization
+		if info.Team != "" {
+			user.TokenKind = tokenKindTeam
+		}
+		user.TokenName, user.TokenOrganization, user.TokenTeam = info.Name, info.Organization, info.Team
+
+		// Organization and team tokens can only access the organization that owns them.
+		if info.Organization != "" {
+			user.Organizations = []string{info.Organization}
+		}
 	}
-	return orgs, nil
+	return user, nil
 }
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+)
+
+func TestCheckpointOutputs(t *testing.T) {
+	state := `{"resources": [
+		{"type": "aws:s3/bucket:Bucket", "outputs": {"bucket": "b"}},
+		{"type": "pulumi:pulumi:Stack", "outputs": {"websiteUrl": "http://bucket"}}
+	]}`
+	tests := []struct {
+		name       string
+		deployment apitype.UntypedDeployment
+		want       map[string]interface{}
+		wantErr    string
+	}{
+		{"version 1", apitype.UntypedDeployment{Version: 1, Deployment: json.RawMessage(state)}, map[string]interface{}{"websiteUrl": "http://bucket"}, ""},
+		{"version 2", apitype.UntypedDeployment{Version: 2, Deployment: json.RawMessage(state)}, map[string]interface{}{"websiteUrl": "http://bucket"}, ""},
+		{"version 3", apitype.UntypedDeployment{Version: 3, Deployment: json.RawMessage(state)}, map[string]interface{}{"websiteUrl": "http://bucket"}, ""},
+		{"never deployed", apitype.UntypedDeployment{Version: 3}, nil, ""},
+		{"no stack resource", apitype.UntypedDeployment{Version: 3, Deployment: json.RawMessage(`{"resources": []}`)}, nil, ""},
+		{"version 0", apitype.UntypedDeployment{Version: 0, Deployment: json.RawMessage(state)}, nil, "unsupported checkpoint version 0"},
+		{"future version", apitype.UntypedDeployment{Version: apitype.DeploymentSchemaVersionCurrent + 1, Deployment: json.RawMessage(state)}, nil, "unsupported checkpoint version"},
+		{"malformed", apitype.UntypedDeployment{Version: 3, Deployment: json.RawMessage(`[]`)}, nil, "unmarshaling version 3 checkpoint"},
+	}
+	for _, tt := range tests {
+		got, err := checkpointOutputs(tt.deployment)
+		switch {
+		case tt.wantErr != "":
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: got error %v, want one containing %q", tt.name, err, tt.wantErr)
+			}
+		case err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case !reflect.DeepEqual(got, tt.want):
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGetStackOutputsSources(t *testing.T) {
+	tests := []struct {
+		source string
+		path   string
+		body   string
+	}{
+		{outputsSourceExport, "/api/stacks/acme/sites/blog/export", `{"version": 2, "deployment": {"resources": [{"type": "pulumi:pulumi:Stack", "outputs": {"websiteUrl": "http://bucket"}}]}}`},
+		{outputsSourceAPI, "/api/stacks/acme/sites/blog/outputs", `{"outputs": {"websiteUrl": "http://bucket"}}`},
+	}
+	for _, tt := range tests {
+		var path, decrypt string
+		c := fakePulumiClient(func(r *http.Request) (int, string) {
+			path, decrypt = r.URL.Path, r.URL.Query().Get("decrypt")
+			return http.StatusOK, tt.body
+		})
+		c.outputsSource = tt.source
+
+		outputs, err := c.getStackOutputs(context.Background(), "acme", "sites", "blog")
+		if err != nil {
+			t.Errorf("%s: %v", tt.source, err)
+			continue
+		}
+		if path != tt.path {
+			t.Errorf("%s: requested %v, want %v", tt.source, path, tt.path)
+		}
+		if tt.source == outputsSourceAPI && decrypt != "true" {
+			t.Errorf("%s: outputs were not requested decrypted", tt.source)
+		}
+		if outputs["websiteUrl"] != "http://bucket" {
+			t.Errorf("%s: got outputs %v", tt.source, outputs)
+		}
+	}
+}
+
+func TestGetStackOutputsNotFound(t *testing.T) {
+	for _, source := range []string{outputsSourceExport, outputsSourceAPI} {
+		c := fakePulumiClient(func(r *http.Request) (int, string) {
+			return http.StatusNotFound, `{"code": 404, "message": "stack not found"}`
+		})
+		c.outputsSource = source
+		if _, err := c.getStackOutputs(context.Background(), "acme", "sites", "blog"); !errors.Is(err, errStackNotFound) {
+			t.Errorf("%s: got error %v, want %v", source, err, errStackNotFound)
+		}
+	}
+}
+
+func TestGetStackCurrentDeploymentStatus(t *testing.T) {
+	tests := []struct {
+		name  string
+		pages []string
+		want  string
+	}{
+		{"never deployed", nil, ""},
+		{"oldest first", []string{`[{"version": 1, "status": "failed"}, {"version": 2, "status": "running"}]`}, "running"},
+		{"newest first", []string{`[{"version": 2, "status": "running"}, {"version": 1, "status": "failed"}]`}, "running"},
+		{"across pages", []string{`[{"version": 3, "status": "succeeded"}]`, `[{"version": 4, "status": "queued"}]`}, "queued"},
+	}
+	for _, tt := range tests {
+		c := fakePulumiClient(func(r *http.Request) (int, string) {
+			page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+			if page < 1 || page > len(tt.pages) {
+				return http.StatusOK, `[]`
+			}
+			return http.StatusOK, tt.pages[page-1]
+		})
+		got, err := c.getStackCurrentDeploymentStatus(context.Background(), "acme", "sites", "blog")
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if got != tt.want {
+			t.Errorf("%s: got status %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// apiKeyHeader is the header that identifies a client for rate limiting and quotas. Clients that do not send one of
+	// the server's API keys are identified by their IP address.
+	apiKeyHeader = "X-API-Key"
+
+	// deploymentQuotaWindow is the window over which deployments per site are counted.
+	deploymentQuotaWindow = time.Hour
+
+	// limiterIdleTimeout is the time after which an unused client rate limiter is discarded.
+	limiterIdleTimeout = 10 * time.Minute
+)
+
+// quotaOptions configures rate limits and quotas. A zero value for any option disables the corresponding limit.
+type quotaOptions struct {
+	// The sustained rate of mutating requests allowed per client, in requests per second.
+	rateLimit float64
+	// The number of mutating requests a client may make in a burst.
+	rateBurst int
+	// The maximum number of sites each client may own.
+	maxSitesPerClient int
+	// The maximum number of deployments that may be started for each site per hour.
+	maxDeploymentsPerSite int
+}
+
+// clientLimiter is a client's rate limiter and the time it was last used.
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastUsed time.Time
+}
+
+// quotas enforces per-client rate limits and quotas on site operations.
+//
+// Site ownership and deployment counts are tracked in memory, so sites and deployments created before the server
+// started are not counted.
+type quotas struct {
+	opts quotaOptions
+
+	m           sync.Mutex
+	limiters    map[string]*clientLimiter
+	lastPrune   time.Time
+	owners      map[string]string
+	deployments map[string][]time.Time
+}
+
+func newQuotas(opts quotaOptions) *quotas {
+	return &quotas{
+		opts:        opts,
+		limiters:    map[string]*clientLimiter{},
+		lastPrune:   time.Now(),
+		owners:      map[string]string{},
+		deployments: map[string][]time.Time{},
+	}
+}
+
+type clientKeyKey struct{}
+
+// withClientKey is middleware that identifies the client that made each request. Clients that send one of the given
+// API keys are identified by a hash of the key so that keys are not retained; other clients, including those that send
+// an unknown key, are identified by their IP address. Otherwise a client could evade its rate limit and quotas by
+// sending a new key with each request. The identity is available to handlers via clientKey.
+func withClientKey(apiKeys []string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := remoteClientKey(r)
+		if key := r.Header.Get(apiKeyHeader); key != "" {
+			for _, k := range apiKeys {
+				if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+					sum := sha256.Sum256([]byte(key))
+					client = "key:" + hex.EncodeToString(sum[:8])
+				}
+			}
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientKeyKey{}, client)))
+	})
+}
+
+// clientKey returns the identity of the client that made r, as determined by withClientKey. If r did not pass through
+// withClientKey, the client is identified by its IP address.
+func clientKey(r *http.Request) string {
+	if client, ok := r.Context().Value(clientKeyKey{}).(string); ok {
+		return client
+	}
+	return remoteClientKey(r)
+}
+
+// remoteClientKey identifies the client that made r by its IP address.
+func remoteClientKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// retryAfter formats d as the value of a Retry-After header.
+func retryAfter(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// limited wraps h so that requests are subject to the client's rate limit.
+func (q *quotas) limited(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		if delay, ok := q.allow(clientKey(r)); !ok {
+			p := problem{
+				Title:      "Rate limit exceeded.",
+				Status:     http.StatusTooManyRequests,
+				Detail:     fmt.Sprintf("too many requests; retry in %v", delay.Round(time.Millisecond)),
+				Code:       codeRateLimited,
+				Retryable:  true,
+				retryAfter: retryAfter(delay),
+			}
+			p.write(w, r)
+			return
+		}
+		h(w, r, params)
+	}
+}
+
+// allow takes a token from the client's bucket. If the bucket is empty, allow returns false and the time until a token
+// will be available.
+func (q *quotas) allow(client string) (time.Duration, bool) {
+	if q.opts.rateLimit <= 0 {
+		return 0, true
+	}
+
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	now := time.Now()
+	if now.Sub(q.lastPrune) >= limiterIdleTimeout {
+		for k, l := range q.limiters {
+			if now.Sub(l.lastUsed) >= limiterIdleTimeout {
+				delete(q.limiters, k)
+			}
+		}
+		q.lastPrune = now
+	}
+
+	l, ok := q.limiters[client]
+	if !ok {
+		burst := q.opts.rateBurst
+		if burst < 1 {
+			burst = 1
+		}
+		l = &clientLimiter{limiter: rate.NewLimiter(rate.Limit(q.opts.rateLimit), burst)}
+		q.limiters[client] = l
+	}
+	l.lastUsed = now
+
+	reservation := l.limiter.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return delay, false
+	}
+	return 0, true
+}
+
+// reserveSite records that client owns the given site. If the client already owns the maximum number of sites,
+// reserveSite returns a problem instead. The returned function releases the reservation and must be called if the site
+// is not created. If the site already has an owner, its ownership is left unchanged and the function does nothing.
+func (q *quotas) reserveSite(client, site string) (func(), *problem) {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	if _, ok := q.owners[site]; ok {
+		return func() {}, nil
+	}
+	if max := q.opts.maxSitesPerClient; max > 0 {
+		if owned := q.countSites(client); owned >= max {
+			return nil, &problem{
+				Title:  "Site quota exceeded.",
+				Status: http.StatusTooManyRequests,
+				Detail: fmt.Sprintf("you own %v of at most %v sites; delete a site before creating another", owned, max),
+				Code:   codeQuotaExceeded,
+			}
+		}
+	}
+	q.owners[site] = client
+	return func() { q.removeSite(site) }, nil
+}
+
+// removeSite forgets the given site's owner and deployments.
+func (q *quotas) removeSite(site string) {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	delete(q.owners, site)
+	delete(q.deployments, site)
+}
+
+// countSites returns the number of sites owned by client. The caller must hold q.m.
+func (q *quotas) countSites(client string) int {
+	owned := 0
+	for _, owner := range q.owners {
+		if owner == client {
+			owned++
+		}
+	}
+	return owned
+}
+
+// recentDeployments returns the start times of the site's deployments within the quota window, discarding older
+// entries. The caller must hold q.m.
+func (q *quotas) recentDeployments(site string, now time.Time) []time.Time {
+	times := q.deployments[site]
+	i := sort.Search(len(times), func(i int) bool {
+		return now.Sub(times[i]) < deploymentQuotaWindow
+	})
+	times = times[i:]
+	if len(times) == 0 {
+		delete(q.deployments, site)
+	} else {
+		q.deployments[site] = times
+	}
+	return times
+}
+
+// reserveDeployment records a deployment for the given site. If the site has already had the maximum number of
+// deployments in the last hour, reserveDeployment returns a problem instead. A reservation for a deployment that is not
+// successfully started must be released with releaseDeployment.
+func (q *quotas) reserveDeployment(site string) *problem {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	now := time.Now()
+	times := q.recentDeployments(site, now)
+	if max := q.opts.maxDeploymentsPerSite; max > 0 && len(times) >= max {
+		delay := deploymentQuotaWindow - now.Sub(times[0])
+		return &problem{
+			Title:  "Deployment quota exceeded.",
+			Status: http.StatusTooManyRequests,
+			Detail: fmt.Sprintf("site '%s' has had %v of at most %v deployments in the last hour; retry in %v", site,
+				len(times), max, delay.Round(time.Second)),
+			Code:       codeQuotaExceeded,
+			Retryable:  true,
+			retryAfter: retryAfter(delay),
+		}
+	}
+	q.deployments[site] = append(times, now)
+	return nil
+}
+
+// releaseDeployment releases the most recent deployment reservation for the given site.
+func (q *quotas) releaseDeployment(site string) {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	if times := q.deployments[site]; len(times) != 0 {
+		q.deployments[site] = times[:len(times)-1]
+	}
+}
+
+// quotaLimit describes the usage of a single quota.
+type quotaLimit struct {
+	// The amount of the quota in use.
+	Used int `json:"used"`
+	// The quota's limit. Zero if the quota is unlimited.
+	Limit int `json:"limit"`
+}
+
+// siteDeploymentQuota describes the usage of a site's deployment quota.
+type siteDeploymentQuota struct {
+	quotaLimit
+
+	// The ID of the site.
+	Site string `json:"site"`
+	// When the oldest deployment counted against the quota leaves the quota window.
+	ResetsAt *time.Time `json:"resetsAt,omitempty"`
+}
+
+// rateLimit describes a client's rate limit.
+type rateLimit struct {
+	// The sustained rate of mutating requests allowed, in requests per second. Zero if requests are not rate limited.
+	RequestsPerSecond float64 `json:"requestsPerSecond"`
+	// The number of mutating requests that may be made in a burst.
+	Burst int `json:"burst"`
+}
+
+// getQuotasResponse defines the body of a response from the "get quotas" REST API.
+type getQuotasResponse struct {
+	// The identity of the client that the quotas apply to.
+	Client string `json:"client"`
+	// The client's rate limit for mutating requests.
+	RateLimit rateLimit `json:"rateLimit"`
+	// The client's site quota.
+	Sites quotaLimit `json:"sites"`
+	// The deployment quota of each of the client's sites.
+	Deployments []siteDeploymentQuota `json:"deployments"`
+}
+
+// getQuotas implements the "get quotas" REST API, which reports the calling client's quota usage.
+func (s *siteServer) getQuotas(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	q, client := s.quotas, clientKey(r)
+
+	resp := getQuotasResponse{
+		Client: client,
+		RateLimit: rateLimit{
+			RequestsPerSecond: q.opts.rateLimit,
+			Burst:             q.opts.rateBurst,
+		},
+		Deployments: []siteDeploymentQuota{},
+	}
+
+	q.m.Lock()
+	now := time.Now()
+	resp.Sites = quotaLimit{Used: q.countSites(client), Limit: q.opts.maxSitesPerClient}
+	for site, owner := range q.owners {
+		if owner != client {
+			continue
+		}
+		quota := siteDeploymentQuota{Site: site, quotaLimit: quotaLimit{Limit: q.opts.maxDeploymentsPerSite}}
+		if times := q.recentDeployments(site, now); len(times) != 0 {
+			resetsAt := times[0].Add(deploymentQuotaWindow).UTC()
+			quota.Used, quota.ResetsAt = len(times), &resetsAt
+		}
+		resp.Deployments = append(resp.Deployments, quota)
+	}
+	q.m.Unlock()
+
+	sort.Slice(resp.Deployments, func(i, j int) bool {
+		return resp.Deployments[i].Site < resp.Deployments[j].Site
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
+		logf(r.Context(), "encoding response: %v", err)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// identify returns the client key that withClientKey assigns to a request from remoteAddr with the given API key.
+func identify(apiKeys []string, remoteAddr, key string) string {
+	var client string
+	h := withClientKey(apiKeys, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client = clientKey(r)
+	}))
+	r := httptest.NewRequest(http.MethodPost, "/sites", nil)
+	r.RemoteAddr = remoteAddr
+	if key != "" {
+		r.Header.Set(apiKeyHeader, key)
+	}
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	return client
+}
+
+func TestWithClientKey(t *testing.T) {
+	apiKeys := []string{"key-1", "key-2"}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		key        string
+		want       string
+	}{
+		{"no key", "192.0.2.1:1234", "", "ip:192.0.2.1"},
+		{"unknown key", "192.0.2.1:1234", "key-3", "ip:192.0.2.1"},
+		{"configured key", "192.0.2.1:1234", "key-1", "key:"},
+		{"address without a port", "192.0.2.1", "", "ip:192.0.2.1"},
+	}
+	for _, tt := range tests {
+		got := identify(apiKeys, tt.remoteAddr, tt.key)
+		if !strings.HasPrefix(got, tt.want) || (tt.want == "key:" && strings.Contains(got, tt.key)) {
+			t.Errorf("%s: got client %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	if identify(apiKeys, "192.0.2.1:1", "key-1") == identify(apiKeys, "192.0.2.1:1", "key-2") {
+		t.Error("different API keys identify the same client")
+	}
+	if identify(apiKeys, "192.0.2.1:1", "key-1") != identify(apiKeys, "198.51.100.1:1", "key-1") {
+		t.Error("an API key identifies different clients from different addresses")
+	}
+	if identify(nil, "192.0.2.1:1", "key-1") != "ip:192.0.2.1" {
+		t.Error("an API key identified a client when no keys are configured")
+	}
+}
+
+func TestRateLimitIgnoresUnknownKeys(t *testing.T) {
+	q := newQuotas(quotaOptions{rateLimit: 0.001, rateBurst: 2})
+	handler := withClientKey([]string{"known"}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q.limited(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+			w.WriteHeader(http.StatusNoContent)
+		})(w, r, nil)
+	}))
+	send := func(key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/sites", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		r.Header.Set(apiKeyHeader, key)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// Rotating unknown keys doesn't give the client a new bucket.
+	for i, key := range []string{"a", "b", "c"} {
+		w := send(key)
+		if want := i < 2; (w.Code == http.StatusNoContent) != want {
+			t.Errorf("request %v with key %q: got status %v", i, key, w.Code)
+		}
+		if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+			t.Errorf("request %v: rate limited without Retry-After", i)
+		}
+	}
+	// A configured key has its own bucket.
+	if w := send("known"); w.Code != http.StatusNoContent {
+		t.Errorf("request with a configured key: got status %v", w.Code)
+	}
+}
+
+func TestAllow(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    quotaOptions
+		allowed int
+	}{
+		{"disabled", quotaOptions{}, 10},
+		{"burst", quotaOptions{rateLimit: 0.001, rateBurst: 3}, 3},
+		{"burst defaults to one", quotaOptions{rateLimit: 0.001}, 1},
+	}
+	for _, tt := range tests {
+		q := newQuotas(tt.opts)
+		allowed := 0
+		for i := 0; i < 10; i++ {
+			delay, ok := q.allow("ip:192.0.2.1")
+			if ok {
+				allowed++
+			} else if delay <= 0 {
+				t.Errorf("%s: rejected with delay %v", tt.name, delay)
+			}
+		}
+		if allowed != tt.allowed {
+			t.Errorf("%s: allowed %v requests, want %v", tt.name, allowed, tt.allowed)
+		}
+		if _, ok := q.allow("ip:198.51.100.1"); !ok {
+			t.Errorf("%s: another client was rate limited", tt.name)
+		}
+	}
+}
+
+func TestReserveSite(t *testing.T) {
+	q := newQuotas(quotaOptions{maxSitesPerClient: 2})
+
+	for _, site := range []string{"a", "b"} {
+		if _, p := q.reserveSite("alice", site); p != nil {
+			t.Fatalf("reserving site %v: %v", site, p.Detail)
+		}
+	}
+	if _, p := q.reserveSite("alice", "c"); p == nil || p.Code != codeQuotaExceeded {
+		t.Errorf("got %+v reserving a third site, want a quota problem", p)
+	}
+	if _, p := q.reserveSite("bob", "c"); p != nil {
+		t.Errorf("another client's quota was exceeded: %v", p.Detail)
+	}
+
+	// Releasing a reservation and deleting a site both free quota.
+	release, p := q.reserveSite("bob", "d")
+	if p != nil {
+		t.Fatal(p.Detail)
+	}
+	release()
+	q.removeSite("a")
+	if got := q.countSites("alice"); got != 1 {
+		t.Errorf("alice owns %v sites, want 1", got)
+	}
+	if got := q.countSites("bob"); got != 1 {
+		t.Errorf("bob owns %v sites, want 1", got)
+	}
+}
+
+func TestReserveDeployment(t *testing.T) {
+	q := newQuotas(quotaOptions{maxDeploymentsPerSite: 2})
+
+	for i := 0; i < 2; i++ {
+		if p := q.reserveDeployment("blog"); p != nil {
+			t.Fatalf("deployment %v: %v", i, p.Detail)
+		}
+	}
+	p := q.reserveDeployment("blog")
+	if p == nil || p.Code != codeQuotaExceeded || !p.Retryable || p.retryAfter == "" {
+		t.Fatalf("got %+v for a third deployment, want a retryable quota problem", p)
+	}
+	if p := q.reserveDeployment("docs"); p != nil {
+		t.Errorf("another site's quota was exceeded: %v", p.Detail)
+	}
+
+	q.releaseDeployment("blog")
+	if p := q.reserveDeployment("blog"); p != nil {
+		t.Errorf("deployment after a release: %v", p.Detail)
+	}
+}
+
+func TestGetQuotas(t *testing.T) {
+	s := &siteServer{quotas: newQuotas(quotaOptions{rateLimit: 1, rateBurst: 5, maxSitesPerClient: 3, maxDeploymentsPerSite: 10})}
+	s.quotas.reserveSite("ip:192.0.2.1", "blog")
+	s.quotas.reserveSite("ip:192.0.2.1", "about")
+	s.quotas.reserveSite("ip:198.51.100.1", "docs")
+	s.quotas.reserveDeployment("blog")
+
+	r := httptest.NewRequest(http.MethodGet, "/quotas", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	w := httptest.NewRecorder()
+	s.getQuotas(w, r, nil)
+
+	var resp getQuotasResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Client != "ip:192.0.2.1" || resp.RateLimit.Burst != 5 || resp.Sites != (quotaLimit{Used: 2, Limit: 3}) {
+		t.Errorf("got %+v", resp)
+	}
+	if len(resp.Deployments) != 2 {
+		t.Fatalf("got deployment quotas %+v, want about and blog", resp.Deployments)
+	}
+	about, blog := resp.Deployments[0], resp.Deployments[1]
+	if about.Site != "about" || about.Used != 0 || about.ResetsAt != nil {
+		t.Errorf("got %+v for about", about)
+	}
+	if blog.Site != "blog" || blog.Used != 1 || blog.Limit != 10 || blog.ResetsAt == nil {
+		t.Errorf("got %+v for blog", blog)
+	}
+}
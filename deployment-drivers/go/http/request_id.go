@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// requestIDHeader is the header used to accept and return request IDs. The same header is sent with each Pulumi API
+// call made on behalf of a request.
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength is the maximum length of a client-supplied request ID.
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// withRequestID is middleware that assigns an ID to each request. If the client supplied a well-formed ID in the
+// X-Request-ID header, that ID is used; otherwise a new ID is generated. The ID is returned in the response's
+// X-Request-ID header and is available to handlers via requestIDFromContext.
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !isValidRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		h.ServeHTTP(w, r.WithContext(contextWithRequestID(r.Context(), id)))
+	})
+}
+
+// contextWithRequestID returns a copy of ctx that is associated with the given request ID.
+func contextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestIDFromContext returns the ID of the request associated with ctx, if any.
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// isValidRequestID returns true if id is a non-empty string of printable ASCII characters of reasonable length.
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID generates a random request ID.
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Errorf("generating request ID: %w", err))
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// logf logs a message prefixed with the ID of the request associated with ctx, if any. The ID may come from the
+// client, so it is passed as an argument rather than made part of the format.
+func logf(ctx context.Context, format string, args ...interface{}) {
+	if id := requestIDFromContext(ctx); id != "" {
+		log.Printf("[%s] "+format, append([]interface{}{id}, args...)...)
+		return
+	}
+	log.Printf(format, args...)
+}
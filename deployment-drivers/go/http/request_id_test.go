@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// captureLog redirects the standard logger to a buffer, without timestamps, until the test ends.
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	})
+	return &buf
+}
+
+func TestWithRequestID(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		keep   bool
+	}{
+		{"client ID", "abc-123", true},
+		{"missing", "", false},
+		{"too long", strings.Repeat("a", maxRequestIDLength+1), false},
+		{"space", "abc 123", false},
+		{"control character", "abc\x01", false},
+	}
+	for _, tt := range tests {
+		var seen string
+		h := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen = requestIDFromContext(r.Context())
+		}))
+		r := httptest.NewRequest(http.MethodGet, "/sites", nil)
+		if tt.header != "" {
+			r.Header.Set(requestIDHeader, tt.header)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		got := w.Header().Get(requestIDHeader)
+		switch {
+		case got == "" || got != seen:
+			t.Errorf("%s: response ID %q doesn't match context ID %q", tt.name, got, seen)
+		case tt.keep && got != tt.header:
+			t.Errorf("%s: got ID %q, want %q", tt.name, got, tt.header)
+		case !tt.keep && got == tt.header:
+			t.Errorf("%s: invalid ID %q was not replaced", tt.name, tt.header)
+		}
+	}
+}
+
+func TestLogfRequestIDIsNotAFormat(t *testing.T) {
+	buf := captureLog(t)
+
+	logf(contextWithRequestID(context.Background(), "%s%d"), "site '%s' has %d revisions", "blog", 3)
+	if got, want := buf.String(), "[%s%d] site 'blog' has 3 revisions\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestServerErrorMapsPulumiAPIErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		status    int
+		code      string
+		retryable bool
+	}{
+		{"unauthorized", &pulumiAPIError{StatusCode: http.StatusUnauthorized}, http.StatusBadGateway, codePulumiUnauthorized, false},
+		{"forbidden", &pulumiAPIError{StatusCode: http.StatusForbidden}, http.StatusBadGateway, codePulumiForbidden, false},
+		{"conflict", &pulumiAPIError{StatusCode: http.StatusConflict}, http.StatusConflict, codePulumiConflict, true},
+		{"rate limited", &pulumiAPIError{StatusCode: http.StatusTooManyRequests, retryAfter: "7"}, http.StatusTooManyRequests, codePulumiRateLimited, true},
+		{"unavailable", &pulumiAPIError{StatusCode: http.StatusServiceUnavailable}, http.StatusBadGateway, codePulumiUnavailable, true},
+		{"deadline", context.DeadlineExceeded, http.StatusBadGateway, codePulumiUnavailable, true},
+		{"other", context.Canceled, http.StatusInternalServerError, codeInternal, false},
+	}
+	captureLog(t)
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/sites", nil)
+		r = r.WithContext(contextWithRequestID(r.Context(), "req-1"))
+		serverError(w, r, tt.err)
+
+		if w.Code != tt.status {
+			t.Errorf("%s: got status %v, want %v", tt.name, w.Code, tt.status)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/problem+json" {
+			t.Errorf("%s: got content type %q", tt.name, ct)
+		}
+		body := w.Body.String()
+		for _, want := range []string{`"code":"` + tt.code + `"`, `"type":"/problems/` + tt.code + `"`, `"requestId":"req-1"`} {
+			if !strings.Contains(body, want) {
+				t.Errorf("%s: body %s doesn't contain %s", tt.name, body, want)
+			}
+		}
+		if retryable := strings.Contains(body, `"retryable":true`); retryable != tt.retryable {
+			t.Errorf("%s: got retryable %v, want %v", tt.name, retryable, tt.retryable)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxRevisionsPerSite is the number of revisions kept for each site. Older revisions are discarded.
+const maxRevisionsPerSite = 100
+
+// maxStatusLookups is the number of deployment statuses looked up at once when listing a site's revisions.
+const maxStatusLookups = 8
+
+// contentUpdate describes new content for a site.
+type contentUpdate struct {
+	// The content of the site's index.html.
+	Content string
+	// The client that submitted the update.
+	Author string
+	// The number of the revision whose content is being restored, if the update is a rollback.
+	RestoredFrom int
+}
+
+// revision records content that was deployed to a site. Apart from the status of its deployment, a revision is
+// immutable.
+type revision struct {
+	// The revision's number. Revisions are numbered from 1 in the order in which they were deployed.
+	Number int `json:"number"`
+	// The content of the site's index.html.
+	Content string `json:"content"`
+	// The hex-encoded SHA-256 hash of the content.
+	ContentHash string `json:"contentHash"`
+	// The ID of the deployment that deployed the content. It is empty if the deployment failed to start.
+	DeploymentID string `json:"deploymentId"`
+	// The client that submitted the content.
+	Author string `json:"author"`
+	// The ID of the request that submitted the content.
+	RequestID string `json:"requestId,omitempty"`
+	// When the content's deployment was started.
+	CreatedAt time.Time `json:"createdAt"`
+	// The status of the content's deployment, as last observed by the server (e.g. "running" or "succeeded").
+	Status string `json:"status"`
+	// The number of the revision whose content was restored, if the revision is a rollback.
+	RestoredFrom int `json:"restoredFrom,omitempty"`
+}
+
+// siteRevisions holds the revisions of a single site.
+type siteRevisions struct {
+	// The site's most recent revisions, oldest first.
+	revisions []revision
+	// The number of the site's most recent revision.
+	last int
+}
+
+// revisionStore records the revisions of each site.
+//
+// Only revisions deployed by this server process are known, so a site has no revisions to roll back to after the
+// server restarts or if its updates were handled by another replica.
+type revisionStore struct {
+	m     sync.Mutex
+	sites map[string]*siteRevisions
+}
+
+func newRevisionStore() *revisionStore {
+	return &revisionStore{sites: map[string]*siteRevisions{}}
+}
+
+// add records a new revision for a site and returns it. The revision's number is assigned by add.
+func (s *revisionStore) add(site string, rev revision) revision {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	revs, ok := s.sites[site]
+	if !ok {
+		revs = &siteRevisions{}
+		s.sites[site] = revs
+	}
+	revs.last++
+	rev.Number = revs.last
+	revs.revisions = append(revs.revisions, rev)
+	if len(revs.revisions) > maxRevisionsPerSite {
+		revs.revisions = append([]revision(nil), revs.revisions[len(revs.revisions)-maxRevisionsPerSite:]...)
+	}
+	return rev
+}
+
+// list returns a site's revisions, newest first.
+func (s *revisionStore) list(site string) []revision {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	revs, ok := s.sites[site]
+	if !ok {
+		return nil
+	}
+	list := make([]revision, len(revs.revisions))
+	for i, rev := range revs.revisions {
+		list[len(list)-1-i] = rev
+	}
+	return list
+}
+
+// get returns the revision of a site with the given number, if it is still held.
+func (s *revisionStore) get(site string, number int) (revision, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if revs, ok := s.sites[site]; ok {
+		for _, rev := range revs.revisions {
+			if rev.Number == number {
+				return rev, true
+			}
+		}
+	}
+	return revision{}, false
+}
+
+// setStatus records the status of the deployment of a site's revision.
+func (s *revisionStore) setStatus(site string, number int, status string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if revs, ok := s.sites[site]; ok {
+		for i := range revs.revisions {
+			if revs.revisions[i].Number == number {
+				revs.revisions[i].Status = status
+			}
+		}
+	}
+}
+
+// remove discards a site's revisions.
+func (s *revisionStore) remove(site string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	delete(s.sites, site)
+}
+
+// deploy starts a deployment of an update to a site and records the update as a new revision.
+func (s *siteServer) deploy(ctx context.Context, site string, update contentUpdate) error {
+	deploymentID, err := s.updateStack(ctx, site, update.Content)
+	if err != nil {
+		return err
+	}
+
+	rev := s.revisions.add(site, newRevision(ctx, update, deploymentID, "not-started"))
+	logf(ctx, "deploying revision %v of site '%s' in deployment %v", rev.Number, site, deploymentID)
+	return nil
+}
+
+// queuedUpdateFailed handles a queued update whose deployment failed to start. The update's deployment reservation is
+// released, and unless the site no longer exists, the update is recorded as a failed revision so that the client that
+// submitted it can find out.
+func (s *siteServer) queuedUpdateFailed(ctx context.Context, site string, update contentUpdate, err error) {
+	s.quotas.releaseDeployment(site)
+	if errors.Is(err, errStackNotFound) {
+		return
+	}
+	rev := s.revisions.add(site, newRevision(ctx, update, "", "failed"))
+	logf(ctx, "recorded failed revision %v of site '%s'", rev.Number, site)
+}
+
+// newRevision returns a revision of update, submitted by the request in ctx, with the given deployment and status.
+func newRevision(ctx context.Context, update contentUpdate, deploymentID, status string) revision {
+	hash := sha256.Sum256([]byte(update.Content))
+	return revision{
+		Content:      update.Content,
+		ContentHash:  hex.EncodeToString(hash[:]),
+		DeploymentID: deploymentID,
+		Author:       update.Author,
+		RequestID:    requestIDFromContext(ctx),
+		CreatedAt:    time.Now().UTC(),
+		Status:       status,
+		RestoredFrom: update.RestoredFrom,
+	}
+}
+
+// refreshStatus returns rev with the current status of its deployment. The status is only looked up while the
+// deployment is in progress; once it finishes, the recorded outcome is final.
+func (s *siteServer) refreshStatus(ctx context.Context, site string, rev revision) (revision, error) {
+	if !isDeploymentInProgress(rev.Status) {
+		return rev, nil
+	}
+	status, err := s.client.getDeploymentStatus(ctx, s.org, s.project, site, rev.DeploymentID)
+	if err != nil {
+		return rev, fmt.Errorf("getting status of deployment %v: %w", rev.DeploymentID, err)
+	}
+	s.revisions.setStatus(site, rev.Number, status)
+	rev.Status = status
+	return rev, nil
+}
+
+// latestDeployedRevision returns the newest revision of a site whose deployment succeeded, refreshing the statuses of
+// revisions that are still deploying. latestDeployedRevision returns false if there is no such revision.
+func (s *siteServer) latestDeployedRevision(ctx context.Context, site string) (revision, bool, error) {
+	for _, rev := range s.revisions.list(site) {
+		rev, err := s.refreshStatus(ctx, site, rev)
+		if err != nil {
+			return revision{}, false, err
+		}
+		if rev.Status == "succeeded" {
+			return rev, true, nil
+		}
+	}
+	return revision{}, false, nil
+}
+
+// refreshStatuses updates revs with the current statuses of their deployments. Only revisions whose deployments are
+// in progress are looked up, at most maxStatusLookups at a time. If a status can't be looked up, the last status
+// observed is kept.
+func (s *siteServer) refreshStatuses(ctx context.Context, site string, revs []revision) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxStatusLookups)
+	for i := range revs {
+		if !isDeploymentInProgress(revs[i].Status) {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(rev *revision) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			refreshed, err := s.refreshStatus(ctx, site, *rev)
+			if err != nil {
+				logf(ctx, "revision %v of site '%s': %v", rev.Number, site, err)
+				return
+			}
+			*rev = refreshed
+		}(&revs[i])
+	}
+	wg.Wait()
+}
+
+// listRevisionsResponse defines the body of a response from the "list revisions" REST API.
+type listRevisionsResponse struct {
+	// The site's revisions, newest first.
+	Revisions []revision `json:"revisions"`
+}
+
+// listRevisions implements the "list revisions" REST API, which returns the content revisions deployed to a site.
+func (s *siteServer) listRevisions(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	id := params.ByName("id")
+	if p := validateParams(validateSiteID(id)); p != nil {
+		p.write(w, r)
+		return
+	}
+
+	revisions := s.revisions.list(id)
+	if len(revisions) == 0 {
+		// The server has no revisions for the site. Check that the site exists so that unknown sites are reported as
+		// such.
+		if _, err := s.client.getStackCurrentDeploymentStatus(r.Context(), s.org, s.project, id); err != nil {
+			if err == errStackNotFound {
+				siteNotFound(w, r, id)
+			} else {
+				serverError(w, r, fmt.Errorf("getting stack: %w", err))
+			}
+			return
+		}
+		revisions = []revision{}
+	}
+	s.refreshStatuses(r.Context(), id, revisions)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&listRevisionsResponse{Revisions: revisions}); err != nil {
+		logf(r.Context(), "encoding response: %v", err)
+	}
+}
+
+// rollbackSiteRequest defines the body of a request to the "roll back site" REST API.
+type rollbackSiteRequest struct {
+	// The number of the revision to restore.
+	Revision int `json:"revision"`
+}
+
+// rollback implements the "roll back site" REST API, which redeploys the content of one of a site's earlier
+// revisions. Only revisions whose deployments succeeded can be restored. The rollback is submitted like any other
+// update, so it is queued behind a deployment that is in progress and is recorded as a new revision once it is
+// deployed.
+func (s *siteServer) rollback(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	id := params.ByName("id")
+
+	var req rollbackSiteRequest
+	if p := decodeJSONBody(w, r, &req); p != nil {
+		p.write(w, r)
+		return
+	}
+	if p := validateParams(validateSiteID(id), validateRevision(req.Revision)); p != nil {
+		p.write(w, r)
+		return
+	}
+
+	rev, ok := s.revisions.get(id, req.Revision)
+	if !ok {
+		p := problem{
+			Title:  "Revision not found.",
+			Status: http.StatusNotFound,
+			Detail: fmt.Sprintf("site '%s' has no revision %v", id, req.Revision),
+			Code:   codeRevisionNotFound,
+		}
+		p.write(w, r)
+		return
+	}
+	rev, err := s.refreshStatus(r.Context(), id, rev)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if rev.Status != "succeeded" {
+		p := problem{
+			Title:  "Revision not deployed.",
+			Status: http.StatusConflict,
+			Detail: fmt.Sprintf("revision %v of site '%s' has deployment status '%s'; only revisions that were deployed "+
+				"successfully can be restored", rev.Number, id, rev.Status),
+			Code:      codeRevisionNotDeployed,
+			Retryable: isDeploymentInProgress(rev.Status),
+		}
+		p.write(w, r)
+		return
+	}
+
+	s.submitUpdate(w, r, id, contentUpdate{Content: rev.Content, Author: clientKey(r), RestoredFrom: rev.Number})
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestRevisionStore(t *testing.T) {
+	s := newRevisionStore()
+	for i := 1; i <= maxRevisionsPerSite+2; i++ {
+		rev := s.add("blog", revision{Content: fmt.Sprint(i), Status: "not-started"})
+		if rev.Number != i {
+			t.Fatalf("got revision number %v, want %v", rev.Number, i)
+		}
+	}
+	s.add("docs", revision{Content: "docs"})
+
+	list := s.list("blog")
+	if len(list) != maxRevisionsPerSite || list[0].Number != maxRevisionsPerSite+2 || list[len(list)-1].Number != 3 {
+		t.Errorf("got %v revisions from %v to %v, want the newest %v", len(list), list[0].Number,
+			list[len(list)-1].Number, maxRevisionsPerSite)
+	}
+	if _, ok := s.get("blog", 2); ok {
+		t.Error("discarded revision 2 is still held")
+	}
+
+	s.setStatus("blog", 3, "succeeded")
+	if rev, ok := s.get("blog", 3); !ok || rev.Status != "succeeded" {
+		t.Errorf("got revision %+v, want status succeeded", rev)
+	}
+
+	s.remove("blog")
+	if list := s.list("blog"); list != nil {
+		t.Errorf("got %v revisions after remove", len(list))
+	}
+	if list := s.list("docs"); len(list) != 1 {
+		t.Errorf("another site's revisions were removed")
+	}
+}
+
+// newRevisionsTestServer returns a site server whose Pulumi API reports the given deployment statuses and accepts new
+// deployments, and which holds a revision of the "blog" site for each status, numbered in order.
+func newRevisionsTestServer(t *testing.T, statuses ...string) *siteServer {
+	lookups := map[string]string{}
+	client := fakePulumiClient(func(r *http.Request) (int, string) {
+		switch {
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/deployments"):
+			return http.StatusAccepted, `{"id": "d-new"}`
+		case r.Method == http.MethodGet && strings.HasPrefix(path.Base(r.URL.Path), "d-"):
+			return http.StatusOK, fmt.Sprintf(`{"status": %q}`, lookups[path.Base(r.URL.Path)])
+		default:
+			return http.StatusOK, `[]`
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := &siteServer{
+		client:    client,
+		org:       "acme",
+		project:   "sites",
+		quotas:    newQuotas(quotaOptions{}),
+		revisions: newRevisionStore(),
+	}
+	s.updates = newUpdateCoalescer(ctx, s)
+	for i, status := range statuses {
+		id := fmt.Sprintf("d-%v", i+1)
+		lookups[id] = status
+		s.revisions.add("blog", revision{Content: fmt.Sprintf("content %v", i+1), DeploymentID: id, Status: "running"})
+	}
+	return s
+}
+
+func TestRollback(t *testing.T) {
+	tests := []struct {
+		name      string
+		revision  int
+		status    int
+		code      string
+		retryable bool
+	}{
+		{"succeeded", 1, http.StatusAccepted, "", false},
+		{"failed", 2, http.StatusConflict, codeRevisionNotDeployed, false},
+		{"running", 3, http.StatusConflict, codeRevisionNotDeployed, true},
+		{"unknown revision", 9, http.StatusNotFound, codeRevisionNotFound, false},
+	}
+	captureLog(t)
+
+	for _, tt := range tests {
+		s := newRevisionsTestServer(t, "succeeded", "failed", "running")
+		r := httptest.NewRequest(http.MethodPost, "/sites/blog/rollback", strings.NewReader(fmt.Sprintf(`{"revision": %v}`, tt.revision)))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		s.rollback(w, r, httprouter.Params{{Key: "id", Value: "blog"}})
+
+		if w.Code != tt.status {
+			t.Errorf("%s: got status %v, want %v: %s", tt.name, w.Code, tt.status, w.Body)
+			continue
+		}
+		if tt.code != "" {
+			body := w.Body.String()
+			if !strings.Contains(body, `"code":"`+tt.code+`"`) {
+				t.Errorf("%s: body %s doesn't have code %v", tt.name, body, tt.code)
+			}
+			if retryable := strings.Contains(body, `"retryable":true`); retryable != tt.retryable {
+				t.Errorf("%s: got retryable %v, want %v", tt.name, retryable, tt.retryable)
+			}
+			continue
+		}
+
+		latest := s.revisions.list("blog")[0]
+		if latest.Number != 4 || latest.RestoredFrom != tt.revision || latest.Content != "content 1" || latest.Status != "not-started" {
+			t.Errorf("%s: got new revision %+v", tt.name, latest)
+		}
+	}
+}
+
+func TestListRevisionsRefreshesStatus(t *testing.T) {
+	s := newRevisionsTestServer(t, "succeeded", "failed")
+	s.revisions.setStatus("blog", 1, "failed")
+
+	w := httptest.NewRecorder()
+	s.listRevisions(w, httptest.NewRequest(http.MethodGet, "/sites/blog/revisions", nil), httprouter.Params{{Key: "id", Value: "blog"}})
+
+	var resp listRevisionsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, rev := range resp.Revisions {
+		got = append(got, fmt.Sprintf("%v:%v", rev.Number, rev.Status))
+	}
+	// Revision 1's outcome was already recorded, so it isn't looked up again.
+	if want := "2:failed 1:failed"; strings.Join(got, " ") != want {
+		t.Errorf("got revisions %v, want %v", got, want)
+	}
+	if rev, _ := s.revisions.get("blog", 2); rev.Status != "failed" {
+		t.Errorf("refreshed status wasn't recorded: %+v", rev)
+	}
+}
+
+func TestListRevisionsBoundsStatusLookups(t *testing.T) {
+	var m sync.Mutex
+	inFlight, maxInFlight, lookups := 0, 0, 0
+	client := fakePulumiClient(func(r *http.Request) (int, string) {
+		m.Lock()
+		inFlight++
+		lookups++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		m.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		m.Lock()
+		inFlight--
+		m.Unlock()
+		return http.StatusOK, `{"status": "succeeded"}`
+	})
+	s := &siteServer{client: client, org: "acme", project: "sites", revisions: newRevisionStore()}
+	for i := 1; i <= 3*maxStatusLookups; i++ {
+		status := "running"
+		if i%3 == 0 {
+			status = "failed"
+		}
+		s.revisions.add("blog", revision{DeploymentID: fmt.Sprintf("d-%v", i), Status: status})
+	}
+
+	w := httptest.NewRecorder()
+	s.listRevisions(w, httptest.NewRequest(http.MethodGet, "/sites/blog/revisions", nil), httprouter.Params{{Key: "id", Value: "blog"}})
+
+	var resp listRevisionsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	for _, rev := range resp.Revisions {
+		want := "succeeded"
+		if rev.Number%3 == 0 {
+			want = "failed"
+		}
+		if rev.Status != want {
+			t.Errorf("revision %v has status %v, want %v", rev.Number, rev.Status, want)
+		}
+	}
+	// Only the revisions that were still running are looked up.
+	if lookups != 2*maxStatusLookups {
+		t.Errorf("looked up %v statuses, want %v", lookups, 2*maxStatusLookups)
+	}
+	if maxInFlight > maxStatusLookups {
+		t.Errorf("looked up %v statuses at once, want at most %v", maxInFlight, maxStatusLookups)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is the minimum time between checks for updated TLS certificate files.
+const certCheckInterval = 10 * time.Second
+
+// serverOptions configures the HTTP server that serves the REST API.
+type serverOptions struct {
+	// The address to listen on.
+	addr string
+
+	// Timeouts for reading request headers, reading entire requests, writing responses, and idle keep-alive
+	// connections.
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+
+	// The maximum time to wait for in-flight requests to complete during shutdown.
+	shutdownTimeout time.Duration
+
+	// The TLS certificate and key files. If both are empty, the server serves plaintext HTTP.
+	tlsCertFile string
+	tlsKeyFile  string
+}
+
+// serve serves handler until ctx is canceled or the server fails.
+//
+// When ctx is canceled, the server stops accepting new connections and waits up to opts.shutdownTimeout for in-flight
+// requests to complete. Request contexts are not canceled during shutdown, so multi-step handlers such as site creation
+// are able to finish. serve returns an error if the server failed to listen or serve, or failed to shut down in time.
+func serve(ctx context.Context, handler http.Handler, opts serverOptions) error {
+	srv := &http.Server{
+		Addr:              opts.addr,
+		Handler:           handler,
+		ReadHeaderTimeout: opts.readHeaderTimeout,
+		ReadTimeout:       opts.readTimeout,
+		WriteTimeout:      opts.writeTimeout,
+		IdleTimeout:       opts.idleTimeout,
+	}
+
+	useTLS := opts.tlsCertFile != "" || opts.tlsKeyFile != ""
+	if useTLS {
+		certs, err := newCertReloader(opts.tlsCertFile, opts.tlsKeyFile)
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certs.getCertificate,
+		}
+	}
+
+	ln, err := net.Listen("tcp", opts.addr)
+	if err != nil {
+		return fmt.Errorf("listening: %w", err)
+	}
+	log.Printf("listening on %v", ln.Addr())
+
+	errs := make(chan error, 1)
+	go func() {
+		if useTLS {
+			// The certificate and key are provided by the TLS config.
+			errs <- srv.ServeTLS(ln, "", "")
+		} else {
+			errs <- srv.Serve(ln)
+		}
+	}()
+
+	select {
+	case err := <-errs:
+		return fmt.Errorf("serving: %w", err)
+	case <-ctx.Done():
+	}
+
+	log.Printf("shutting down; waiting up to %v for in-flight requests", opts.shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), opts.shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		srv.Close()
+		return fmt.Errorf("shutting down: %w", err)
+	}
+	if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("serving: %w", err)
+	}
+	log.Printf("shut down")
+	return nil
+}
+
+// certReloader serves a TLS certificate loaded from files, reloading the certificate when the files change.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	m         sync.Mutex
+	cert      *tls.Certificate
+	modTimes  [2]time.Time
+	lastCheck time.Time
+}
+
+// newCertReloader creates a certReloader for the given files and loads the initial certificate.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("both a TLS certificate file and a TLS key file are required")
+	}
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	modTimes, err := r.stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(modTimes); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// stat returns the modification times of the certificate and key files.
+func (r *certReloader) stat() ([2]time.Time, error) {
+	var modTimes [2]time.Time
+	for i, path := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return modTimes, fmt.Errorf("reading TLS file: %w", err)
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+// load loads the certificate from disk. The caller must hold r.m or have exclusive access to r.
+func (r *certReloader) load(modTimes [2]time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading TLS certificate: %w", err)
+	}
+	r.cert, r.modTimes, r.lastCheck = &cert, modTimes, time.Now()
+	return nil
+}
+
+// getCertificate implements tls.Config.GetCertificate. If the certificate files have changed since they were last
+// loaded, the certificate is reloaded. If reloading fails, the previous certificate continues to be served.
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if time.Since(r.lastCheck) >= certCheckInterval {
+		r.lastCheck = time.Now()
+		modTimes, err := r.stat()
+		switch {
+		case err != nil:
+			log.Printf("checking TLS certificate: %v", err)
+		case modTimes != r.modTimes:
+			if err := r.load(modTimes); err != nil {
+				log.Printf("reloading TLS certificate: %v", err)
+			} else {
+				log.Printf("reloaded TLS certificate")
+			}
+		}
+	}
+	return r.cert, nil
+}
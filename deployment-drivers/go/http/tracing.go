@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// serviceName identifies the server in exported traces.
+const serviceName = "site-server"
+
+// Span attributes that describe the target of a Pulumi API call.
+const (
+	pulumiOrgKey       = attribute.Key("pulumi.org")
+	pulumiProjectKey   = attribute.Key("pulumi.project")
+	pulumiStackKey     = attribute.Key("pulumi.stack")
+	pulumiOperationKey = attribute.Key("pulumi.operation")
+	requestIDAttrKey   = attribute.Key("http.request_id")
+)
+
+// tracer creates the server's spans. It uses the global tracer provider, so spans are discarded unless
+// newTracerProvider has been installed via otel.SetTracerProvider.
+var tracer = otel.Tracer("github.com/pulumi/deploy-demos/deployment-drivers/go/http")
+
+// newTracerProvider creates a tracer provider that batches spans to the given exporter. Any sdktrace.SpanExporter may be
+// used, e.g. an OTLP exporter created by newOTLPExporter or an in-memory exporter from
+// go.opentelemetry.io/otel/sdk/trace/tracetest.
+func newTracerProvider(exporter sdktrace.SpanExporter) (*sdktrace.TracerProvider, error) {
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(serviceName),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("creating resource: %w", err)
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	), nil
+}
+
+// newOTLPExporter creates an exporter that sends spans to the OTLP/HTTP collector at the given endpoint, e.g.
+// "http://localhost:4318". Plaintext HTTP is used if the endpoint's scheme is "http".
+func newOTLPExporter(ctx context.Context, endpoint string) (sdktrace.SpanExporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parsing OTLP endpoint: %w", err)
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(u.Host)}
+	switch u.Scheme {
+	case "http":
+		opts = append(opts, otlptracehttp.WithInsecure())
+	case "https":
+		// OK
+	default:
+		return nil, fmt.Errorf("OTLP endpoint must be an http or https URL")
+	}
+	if u.Path != "" && u.Path != "/" {
+		opts = append(opts, otlptracehttp.WithURLPath(u.Path))
+	}
+	return otlptracehttp.New(ctx, opts...)
+}
+
+// setupTracing installs a tracer provider that exports to the given OTLP endpoint and a W3C Trace Context propagator.
+// The returned function flushes and shuts down the tracer provider.
+func setupTracing(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+	exporter, err := newOTLPExporter(ctx, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	tp, err := newTracerProvider(exporter)
+	if err != nil {
+		return nil, err
+	}
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return tp.Shutdown, nil
+}
+
+// startHandlerSpan starts a server span for a request to the given route. The span continues any trace described by
+// the request's traceparent header.
+func startHandlerSpan(r *http.Request, route string) (*http.Request, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, r.Method+" "+route,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPMethodKey.String(r.Method),
+			semconv.HTTPRouteKey.String(route),
+			requestIDAttrKey.String(requestIDFromContext(r.Context())),
+		))
+	return r.WithContext(ctx), span
+}
+
+// endHandlerSpan records the response's status code on span and ends it.
+func endHandlerSpan(span trace.Span, status int) {
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(status))
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	span.End()
+}
+
+// stackAttributes returns the span attributes that identify a stack.
+func stackAttributes(org, project, stack string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		pulumiOrgKey.String(org),
+		pulumiProjectKey.String(project),
+		pulumiStackKey.String(stack),
+	}
+}
+
+// startPulumiCall starts a client span and timer for a call to the given Pulumi API client method. The returned
+// function must be called with a pointer to the call's result when the call completes. It ends the span and records
+// the call's metrics. The intended usage is:
+//
+//	ctx, end := startPulumiCall(ctx, "createStack", stackAttributes(org, project, stack)...)
+//	defer end(&err)
+func startPulumiCall(ctx context.Context, method string, attrs ...attribute.KeyValue) (context.Context, func(*error)) {
+	start := time.Now()
+	ctx, span := tracer.Start(ctx, "pulumiClient."+method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...))
+	return ctx, func(err *error) {
+		if *err != nil {
+			span.RecordError(*err)
+			span.SetStatus(codes.Error, (*err).Error())
+		}
+		span.End()
+		observePulumiCall(method, start, *err)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	installTracingOnce sync.Once
+	testSpans          *tracetest.InMemoryExporter
+)
+
+// installTestTracing installs a tracer provider that records spans in memory and a W3C Trace Context propagator.
+// The global tracer provider can only be replaced once, so the provider is shared by all tests; the recorded spans are
+// reset for each test.
+func installTestTracing(t *testing.T) *tracetest.InMemoryExporter {
+	installTracingOnce.Do(func() {
+		testSpans = tracetest.NewInMemoryExporter()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(testSpans)))
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	})
+	testSpans.Reset()
+	return testSpans
+}
+
+// roundTripFunc is an http.RoundTripper that serves requests with a function, so that Pulumi API calls can be tested
+// without a network.
+type roundTripFunc func(*http.Request) *http.Response
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r), nil
+}
+
+// fakePulumiClient returns a Pulumi API client whose requests are served by serve.
+func fakePulumiClient(serve func(*http.Request) (int, string)) *pulumiClient {
+	c := newPulumiClient("test-token")
+	c.client.SetTransport(roundTripFunc(func(r *http.Request) *http.Response {
+		status, body := serve(r)
+		return &http.Response{
+			StatusCode: status,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    r,
+		}
+	}))
+	return c
+}
+
+func TestTracing(t *testing.T) {
+	spans := installTestTracing(t)
+
+	const (
+		traceID      = "4bf92f3577b34da6a3ce929d0e0e4736"
+		parentSpanID = "00f067aa0ba902b7"
+	)
+	var upstreamTraceparent string
+	client := fakePulumiClient(func(r *http.Request) (int, string) {
+		upstreamTraceparent = r.Header.Get("traceparent")
+		return http.StatusAccepted, `{"id": "deployment-1"}`
+	})
+	handler := instrument("/sites/:id", func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		_, err := client.createDeployment(r.Context(), "acme", "sites", params.ByName("id"), createDeploymentRequest{Operation: "update"})
+		if err != nil {
+			t.Errorf("createDeployment: %v", err)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	r := httptest.NewRequest(http.MethodPost, "/sites/blog", nil)
+	r.Header.Set("traceparent", "00-"+traceID+"-"+parentSpanID+"-01")
+	handler(httptest.NewRecorder(), r, httprouter.Params{{Key: "id", Value: "blog"}})
+
+	ended := spans.GetSpans()
+	if len(ended) != 2 {
+		t.Fatalf("got %v spans, want 2", len(ended))
+	}
+	call, server := ended[0], ended[1]
+
+	if server.Name != "POST /sites/:id" || server.SpanKind != trace.SpanKindServer {
+		t.Errorf("got server span %q of kind %v", server.Name, server.SpanKind)
+	}
+	if got := server.SpanContext.TraceID().String(); got != traceID {
+		t.Errorf("server span has trace ID %v, want the incoming trace %v", got, traceID)
+	}
+	if got := server.Parent.SpanID().String(); got != parentSpanID {
+		t.Errorf("server span has parent %v, want the incoming span %v", got, parentSpanID)
+	}
+	if got := attributeValue(server.Attributes, "http.status_code"); got != "202" {
+		t.Errorf("server span has status code %q, want 202", got)
+	}
+
+	if call.Name != "pulumiClient.createDeployment" || call.SpanKind != trace.SpanKindClient {
+		t.Errorf("got Pulumi API span %q of kind %v", call.Name, call.SpanKind)
+	}
+	if call.Parent.SpanID() != server.SpanContext.SpanID() {
+		t.Errorf("Pulumi API span's parent is %v, want the server span %v", call.Parent.SpanID(), server.SpanContext.SpanID())
+	}
+	wantAttrs := map[attribute.Key]string{
+		pulumiOrgKey:       "acme",
+		pulumiProjectKey:   "sites",
+		pulumiStackKey:     "blog",
+		pulumiOperationKey: "update",
+	}
+	for key, want := range wantAttrs {
+		if got := attributeValue(call.Attributes, key); got != want {
+			t.Errorf("Pulumi API span has %v %q, want %q", key, got, want)
+		}
+	}
+
+	if !strings.Contains(upstreamTraceparent, traceID) {
+		t.Errorf("Pulumi API request has traceparent %q, want trace %v", upstreamTraceparent, traceID)
+	}
+}
+
+// attributeValue returns the value of the attribute with the given key, or "" if there is none.
+func attributeValue(attrs []attribute.KeyValue, key attribute.Key) string {
+	for _, kv := range attrs {
+		if kv.Key == key {
+			return kv.Value.Emit()
+		}
+	}
+	return ""
+}
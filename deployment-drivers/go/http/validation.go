@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"unicode/utf8"
+)
+
+const (
+	// maxSiteIDLength is the maximum length of a site ID. Site IDs are used as Pulumi stack names, which are limited to
+	// 100 characters.
+	maxSiteIDLength = 100
+
+	// maxContentBytes is the maximum size of a site's content. Content is passed to deployments via an environment
+	// variable, so it must be kept reasonably small.
+	maxContentBytes = 64 * 1024
+
+	// maxRequestBodyBytes is the maximum size of a request body. This leaves room for JSON escaping of the content.
+	maxRequestBodyBytes = 2*maxContentBytes + 1024
+)
+
+// siteIDPattern matches valid site IDs. Pulumi stack names may only contain alphanumerics, hyphens, underscores, and
+// periods.
+var siteIDPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// reservedSiteIDs is the set of IDs that may not be used for sites. "." and ".." are valid stack names, but are
+// removed from request paths by URL cleaning and so could never be addressed by the REST API.
+var reservedSiteIDs = map[string]bool{
+	".":  true,
+	"..": true,
+}
+
+// invalidParam describes a single invalid field in a request.
+type invalidParam struct {
+	// The name of the invalid field.
+	Name string `json:"name"`
+	// Why the field's value is invalid.
+	Reason string `json:"reason"`
+}
+
+// validateSiteID checks that id is usable as both a site ID and a Pulumi stack name.
+func validateSiteID(id string) *invalidParam {
+	var reason string
+	switch {
+	case id == "":
+		reason = "must not be empty"
+	case len(id) > maxSiteIDLength:
+		reason = fmt.Sprintf("must be at most %v characters", maxSiteIDLength)
+	case !siteIDPattern.MatchString(id):
+		reason = "may only contain alphanumerics, hyphens, underscores, and periods"
+	case reservedSiteIDs[id]:
+		reason = fmt.Sprintf("'%s' is reserved", id)
+	default:
+		return nil
+	}
+	return &invalidParam{Name: "id", Reason: reason}
+}
+
+// validateContent checks that content is usable as a site's content.
+func validateContent(content string) *invalidParam {
+	var reason string
+	switch {
+	case len(content) > maxContentBytes:
+		reason = fmt.Sprintf("must be at most %v bytes", maxContentBytes)
+	case !utf8.ValidString(content):
+		reason = "must be valid UTF-8"
+	default:
+		return nil
+	}
+	return &invalidParam{Name: "content", Reason: reason}
+}
+
+// validateRevision checks that number is usable as a revision number.
+func validateRevision(number int) *invalidParam {
+	if number < 1 {
+		return &invalidParam{Name: "revision", Reason: "must be at least 1"}
+	}
+	return nil
+}
+
+// validateParams collects the non-nil results of a set of validations into a problem. If all validations passed,
+// validateParams returns nil.
+func validateParams(params ...*invalidParam) *problem {
+	var invalid []invalidParam
+	for _, p := range params {
+		if p != nil {
+			invalid = append(invalid, *p)
+		}
+	}
+	if len(invalid) == 0 {
+		return nil
+	}
+	return &problem{
+		Code:          codeValidation,
+		Title:         "Your request parameters didn't validate.",
+		Status:        http.StatusBadRequest,
+		InvalidParams: invalid,
+	}
+}
+
+// decodeJSONBody decodes the JSON body of r into v. The request must have a JSON content type and a body no larger
+// than maxRequestBodyBytes.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v interface{}) *problem {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		return &problem{
+			Code:   codeUnsupportedMediaType,
+			Title:  "Unsupported media type.",
+			Status: http.StatusUnsupportedMediaType,
+			Detail: "request bodies must have content type application/json",
+		}
+	}
+
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBodyBytes))
+	if err := dec.Decode(v); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return &problem{
+				Code:   codeTooLarge,
+				Title:  "Request body too large.",
+				Status: http.StatusRequestEntityTooLarge,
+				Detail: fmt.Sprintf("request bodies must be at most %v bytes", maxBytesErr.Limit),
+			}
+		}
+		return &problem{
+			Code:   codeMalformed,
+			Title:  "Malformed request body.",
+			Status: http.StatusBadRequest,
+			Detail: err.Error(),
+		}
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return &problem{
+			Code:   codeMalformed,
+			Title:  "Malformed request body.",
+			Status: http.StatusBadRequest,
+			Detail: "request body must contain a single JSON value",
+		}
+	}
+	return nil
+}
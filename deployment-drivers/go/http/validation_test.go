@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidateSiteID(t *testing.T) {
+	tests := []struct {
+		id    string
+		valid bool
+	}{
+		{"my-site", true},
+		{"My_Site.2", true},
+		{strings.Repeat("a", maxSiteIDLength), true},
+		{"", false},
+		{strings.Repeat("a", maxSiteIDLength+1), false},
+		{"my site", false},
+		{"my/site", false},
+		{".", false},
+		{"..", false},
+	}
+	for _, tt := range tests {
+		if got := validateSiteID(tt.id); (got == nil) != tt.valid {
+			t.Errorf("validateSiteID(%q) = %+v, want valid %v", tt.id, got, tt.valid)
+		}
+	}
+}
+
+func TestValidateContent(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		valid   bool
+	}{
+		{"empty", "", true},
+		{"html", "<h1>hello</h1>", true},
+		{"max size", strings.Repeat("a", maxContentBytes), true},
+		{"too large", strings.Repeat("a", maxContentBytes+1), false},
+		{"invalid utf-8", "\xff\xfe", false},
+	}
+	for _, tt := range tests {
+		if got := validateContent(tt.content); (got == nil) != tt.valid {
+			t.Errorf("%s: validateContent = %+v, want valid %v", tt.name, got, tt.valid)
+		}
+	}
+}
+
+func TestValidateParams(t *testing.T) {
+	if p := validateParams(nil, nil); p != nil {
+		t.Errorf("validateParams(nil, nil) = %+v, want nil", p)
+	}
+
+	p := validateParams(validateSiteID(""), nil, validateRevision(0))
+	if p == nil {
+		t.Fatal("validateParams returned nil for invalid params")
+	}
+	if p.Status != http.StatusBadRequest || p.Code != codeValidation {
+		t.Errorf("got status %v and code %v, want %v and %v", p.Status, p.Code, http.StatusBadRequest, codeValidation)
+	}
+	if len(p.InvalidParams) != 2 || p.InvalidParams[0].Name != "id" || p.InvalidParams[1].Name != "revision" {
+		t.Errorf("got invalid params %+v, want id and revision", p.InvalidParams)
+	}
+}
+
+func TestDecodeJSONBody(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+	}{
+		{"valid", "application/json", `{"content": "hi"}`, 0},
+		{"charset", "application/json; charset=utf-8", `{"content": "hi"}`, 0},
+		{"wrong content type", "text/plain", `{"content": "hi"}`, http.StatusUnsupportedMediaType},
+		{"no content type", "", `{"content": "hi"}`, http.StatusUnsupportedMediaType},
+		{"malformed", "application/json", `{"content": `, http.StatusBadRequest},
+		{"trailing value", "application/json", `{"content": "hi"} {}`, http.StatusBadRequest},
+		{"too large", "application/json", `{"content": "` + strings.Repeat("a", maxRequestBodyBytes) + `"}`, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/sites", strings.NewReader(tt.body))
+		if tt.contentType != "" {
+			r.Header.Set("Content-Type", tt.contentType)
+		}
+		var v struct {
+			Content string `json:"content"`
+		}
+		p := decodeJSONBody(httptest.NewRecorder(), r, &v)
+		switch {
+		case tt.status == 0 && p != nil:
+			t.Errorf("%s: got problem %+v, want none", tt.name, p)
+		case tt.status != 0 && (p == nil || p.Status != tt.status):
+			t.Errorf("%s: got problem %+v, want status %v", tt.name, p, tt.status)
+		}
+	}
+}
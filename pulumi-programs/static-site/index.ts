@@ -34,5 +34,76 @@ new aws.s3.BucketPolicy("bucket-policy", {
     },
 });
 
+// If the site has a custom domain, request a TLS certificate for it. The certificate is validated via DNS: the
+// domain's owner must create the validation record that we export below. Once the record exists, the server sets
+// SITE_DOMAIN_VERIFIED and redeploys, and we serve the site over HTTPS from a CloudFront distribution.
+const domain = process.env["SITE_DOMAIN"];
+const domainVerified = process.env["SITE_DOMAIN_VERIFIED"] === "true";
+
+let certificate: aws.acm.Certificate | undefined;
+let cdn: aws.cloudfront.Distribution | undefined;
+if (domain) {
+    // CloudFront requires certificates to be issued in us-east-1.
+    const usEast1 = new aws.Provider("us-east-1", { region: "us-east-1" });
+    certificate = new aws.acm.Certificate("certificate", {
+        domainName: domain,
+        validationMethod: "DNS",
+    }, { provider: usEast1 });
+
+    if (domainVerified) {
+        const validation = new aws.acm.CertificateValidation("certificate-validation", {
+            certificateArn: certificate.arn,
+        }, { provider: usEast1 });
+
+        cdn = new aws.cloudfront.Distribution("cdn", {
+            enabled: true,
+            aliases: [domain],
+            defaultRootObject: "index.html",
+            origins: [{
+                originId: "site-bucket",
+                domainName: bucket.websiteEndpoint,
+                customOriginConfig: {
+                    httpPort: 80,
+                    httpsPort: 443,
+                    originProtocolPolicy: "http-only",
+                    originSslProtocols: ["TLSv1.2"],
+                },
+            }],
+            defaultCacheBehavior: {
+                targetOriginId: "site-bucket",
+                viewerProtocolPolicy: "redirect-to-https",
+                allowedMethods: ["GET", "HEAD"],
+                cachedMethods: ["GET", "HEAD"],
+                forwardedValues: {
+                    queryString: false,
+                    cookies: { forward: "none" },
+                },
+                minTtl: 0,
+                defaultTtl: 60,
+                maxTtl: 300,
+            },
+            restrictions: {
+                geoRestriction: { restrictionType: "none" },
+            },
+            viewerCertificate: {
+                acmCertificateArn: validation.certificateArn,
+                sslSupportMethod: "sni-only",
+                minimumProtocolVersion: "TLSv1.2_2021",
+            },
+        });
+    }
+}
+
 // Export the website URL
 export const websiteUrl = pulumi.interpolate`http://${bucket.websiteEndpoint}`;
+
+// Export the custom domain's status: the DNS record that validates the domain's certificate, and, once the domain is
+// verified, the CNAME target for the domain and the site's HTTPS URL.
+export const customDomain = domain;
+export const domainValidationRecord = certificate?.domainValidationOptions.apply(options => ({
+    name: options[0].resourceRecordName,
+    type: options[0].resourceRecordType,
+    value: options[0].resourceRecordValue,
+}));
+export const customDomainTarget = cdn?.domainName;
+export const customDomainUrl = cdn ? `https://${domain}` : undefined;